@@ -3,191 +3,348 @@ package bencode
 import (
 	"bufio"
 	"bytes"
-	"errors"
-	_ "fmt"
+	"fmt"
 	"io"
-	"strconv"
 )
 
-// Decoder is a simple decoder for 'bencoded' data
-type Decoder struct {
-	reader *bufio.Reader
+// SyntaxError describes malformed (or, in strict mode, non-canonical) input
+type SyntaxError struct {
+	msg string
+	// Offset is the position in the input where the error occurred
+	Offset int64
+	// Path is the path (dictionary keys and list indexes) to the value
+	Path string
 }
 
-func (d Decoder) skip() error {
-	_, err := d.reader.ReadByte()
-	return err
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("decoder: %s at offset %d", e.msg, e.Offset)
+	}
+
+	return fmt.Sprintf("decoder: %s at offset %d (in '%s')", e.msg, e.Offset, e.Path)
 }
 
-func (d Decoder) peek() (byte, error) {
-	bytes, err := d.reader.Peek(1)
-	if err != nil {
-		return 0, err
-	}
+// decodeState is a simple decoder for 'bencoded' data held in memory, built on
+// top of the Scanner (which also validates the data)
+type decodeState struct {
+	scanner Scanner
+}
 
-	return bytes[0], nil
+func newDecodeState(data []byte, c config, base int64) *decodeState {
+	return &decodeState{scanner: Scanner{data: data, config: c, base: base}}
 }
 
-func (d Decoder) consumeString() (string, error) {
-	sizeStr, err := d.reader.ReadString(':')
-	if err != nil {
-		return "", err
+// integer returns the value of an integer token as an int, or as an int64 or
+// *big.Int if it's too large
+func (d *decodeState) integer(tok Token) (any, error) {
+	if i, err := tok.Int(); err == nil {
+		return i, nil
 	}
 
-	size, err := strconv.Atoi(sizeStr[:len(sizeStr)-1])
-	if err != nil {
-		return "", err
+	if i, err := tok.Int64(); err == nil {
+		return i, nil
 	}
 
-	if size < 0 {
-		return "", errors.New("decoder: negative string length not allowed")
-	}
+	return tok.BigInt()
+}
+
+func (d *decodeState) consumeList() ([]any, error) {
+	var list []any
 
-	if size == 0 {
-		return "", nil
+	for {
+		tok, err := d.scanner.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.Kind == TokenEnd {
+			return list, nil
+		}
+
+		item, err := d.consumeValue(tok)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, item)
 	}
+}
 
-	buf := make([]byte, size)
+func (d *decodeState) consumeDictionary() (map[string]any, error) {
+	dict := make(map[string]any)
 
-	if _, err := io.ReadFull(d.reader, buf); err != nil {
-		return "", err
+	for {
+		tok, err := d.scanner.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.Kind == TokenEnd {
+			return dict, nil
+		}
+
+		key := string(tok.Value)
+
+		value, err := d.consume()
+		if err != nil {
+			return nil, err
+		}
+
+		dict[key] = value
 	}
+}
 
-	return string(buf), nil
+// consumeValue decodes the value starting with `tok`
+func (d *decodeState) consumeValue(tok Token) (any, error) {
+	switch tok.Kind {
+	case TokenListStart:
+		return d.consumeList()
+	case TokenDictStart:
+		return d.consumeDictionary()
+	case TokenInteger:
+		return d.integer(tok)
+	default:
+		return string(tok.Value), nil
+	}
 }
 
-func (d Decoder) consumeInteger() (int, error) {
-	iStr, err := d.reader.ReadString('e')
+func (d *decodeState) consume() (any, error) {
+	tok, err := d.scanner.Next()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	if len(iStr) < 3 {
-		return 0, errors.New("decoder: integer string is too short")
+	return d.consumeValue(tok)
+}
+
+// checkTrailing makes sure there's no data after the value in strict mode
+func (d *decodeState) checkTrailing() error {
+	if d.scanner.config.strict && d.scanner.off < len(d.scanner.data) {
+		return d.scanner.syntaxError(d.scanner.off, "trailing data after value")
 	}
 
-	if len(iStr) > 3 {
-		if iStr[1] == '-' && iStr[2] == '0' {
-			return 0, errors.New("decoder: integers cannot start with -0")
-		}
+	return nil
+}
 
-		if iStr[1] == '0' && iStr[2] != 'e' {
-			return 0, errors.New("decoder: integers cannot start with 0")
-		}
+// Decode decodes the first bencoded value in `data`, any bytes following the
+// value are returned as `rest`. In strict mode (see the `Strict` option) the
+// value has to be in canonical form and there can't be any trailing data.
+func Decode(data []byte, opts ...Option) (values any, rest []byte, err error) {
+	d := newDecodeState(data, newConfig(opts), 0)
+
+	if values, err = d.consume(); err != nil {
+		return nil, nil, err
+	}
+
+	if err = d.checkTrailing(); err != nil {
+		return nil, nil, err
 	}
 
-	i, err := strconv.Atoi(iStr[1 : len(iStr)-1])
+	return values, data[d.scanner.off:], nil
+}
+
+// Decoder reads bencoded values, one after another, from an input stream
+type Decoder struct {
+	reader *bufio.Reader
+	config config
+	// offset is the number of bytes consumed from the stream so far
+	offset int64
+	// buf holds the raw bytes of the value currently being read
+	buf []byte
+	// depth and elements are used to enforce the limits while reading
+	depth    int
+	elements int
+}
+
+// chunkSize is the maximum number of bytes allocated at once when reading a
+// string, so that we never allocate much more than what the stream contains
+const chunkSize = 64 << 10
+
+func (d *Decoder) limitError(err error) error {
+	return fmt.Errorf("%w at offset %d", err, d.offset)
+}
+
+func (d *Decoder) peek() (byte, error) {
+	bytes, err := d.reader.Peek(1)
 	if err != nil {
 		return 0, err
 	}
 
-	return i, nil
+	return bytes[0], nil
 }
 
-func (d Decoder) consumeList() ([]any, error) {
-	var list []any
+func (d *Decoder) readByte() (byte, error) {
+	if d.config.maxSize > 0 && int64(len(d.buf)) >= d.config.maxSize {
+		return 0, d.limitError(ErrMaxSize)
+	}
 
-	if err := d.skip(); err != nil {
-		return nil, err
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		return 0, err
 	}
 
-	for {
-		char, err := d.peek()
+	d.offset++
+	d.buf = append(d.buf, b)
+	return b, nil
+}
 
-		if err == io.EOF {
-			break
+// readUntil reads up until (and including) `delim` and returns the bytes read
+// (excluding `delim`), at most `max` bytes are read (unless `max` is zero)
+func (d *Decoder) readUntil(delim byte, max int) ([]byte, error) {
+	start := len(d.buf)
+
+	for {
+		if max > 0 && len(d.buf)-start > max {
+			return nil, &SyntaxError{msg: "value is too long", Offset: d.offset}
 		}
 
+		b, err := d.readByte()
 		if err != nil {
 			return nil, err
 		}
 
-		if char == 'e' {
-			break
+		if b == delim {
+			return d.buf[start : len(d.buf)-1], nil
 		}
+	}
+}
 
-		item, err := d.consume()
-		if err != nil {
-			return nil, err
-		}
+func (d *Decoder) readString() error {
+	// NOTE: the length can't be longer than the digits of the largest int
+	sizeStr, err := d.readUntil(':', 20)
+	if err != nil {
+		return err
+	}
 
-		list = append(list, item)
+	size, err := parseInteger(sizeStr)
+	if err != nil {
+		return &SyntaxError{msg: "invalid string length", Offset: d.offset}
 	}
 
-	if err := d.skip(); err != nil {
-		return nil, err
+	if size < 0 {
+		return &SyntaxError{msg: "negative string length not allowed", Offset: d.offset}
+	}
+
+	if d.config.maxStringLength > 0 && size > int64(d.config.maxStringLength) {
+		return d.limitError(ErrMaxStringLength)
+	}
+
+	if d.config.maxSize > 0 && int64(len(d.buf))+size > d.config.maxSize {
+		return d.limitError(ErrMaxSize)
 	}
 
-	return list, nil
+	for size > 0 {
+		n := size
+		if n > chunkSize {
+			n = chunkSize
+		}
+
+		start := len(d.buf)
+		d.buf = append(d.buf, make([]byte, n)...)
+
+		read, err := io.ReadFull(d.reader, d.buf[start:])
+		d.offset += int64(read)
+		if err != nil {
+			return err
+		}
+
+		size -= n
+	}
+
+	return nil
 }
 
-func (d Decoder) consumeDictionary() (map[string]any, error) {
-	dict := make(map[string]any)
+func (d *Decoder) readContainer() error {
+	if d.config.maxDepth > 0 && d.depth >= d.config.maxDepth {
+		return d.limitError(ErrMaxDepth)
+	}
 
-	if err := d.skip(); err != nil {
-		return nil, err
+	d.depth++
+	defer func() { d.depth-- }()
+
+	if _, err := d.readByte(); err != nil {
+		return err
 	}
 
 	for {
 		char, err := d.peek()
-
-		if err == io.EOF {
-			// NOTE: investigate why `break` wasn't needed here...
-		}
-
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if char == 'e' {
 			break
 		}
 
-		key, err := d.consumeString()
-		if err != nil {
-			return nil, err
+		if err := d.readValue(); err != nil {
+			return err
 		}
+	}
 
-		value, err := d.consume()
-		if err != nil {
-			return nil, err
-		}
+	_, err := d.readByte()
+	return err
+}
 
-		dict[key] = value
-	}
+// readValue reads the raw bytes of one (complete) value from the stream, the
+// actual validation of the value is done when it is decoded
+func (d *Decoder) readValue() error {
+	d.elements++
 
-	if err := d.skip(); err != nil {
-		return nil, err
+	if d.config.maxElements > 0 && d.elements > d.config.maxElements {
+		return d.limitError(ErrMaxElements)
 	}
 
-	return dict, nil
-}
-
-func (d Decoder) consume() (any, error) {
 	char, err := d.peek()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	switch char {
-	case 'l':
-		return d.consumeList()
-	case 'd':
-		return d.consumeDictionary()
+	case 'l', 'd':
+		return d.readContainer()
 	case 'i':
-		return d.consumeInteger()
+		_, err := d.readUntil('e', 0)
+		return err
 	default:
-		return d.consumeString()
+		return d.readString()
 	}
 }
 
-func Decode(data []byte) (values any, rest []byte, err error) {
-	d := &Decoder{reader: bufio.NewReader(bytes.NewReader(data))}
+// Decode reads the next bencoded value from the stream and stores it in the
+// value pointed to by `v`. It returns io.EOF when there are no more values.
+func (d *Decoder) Decode(v any) error {
+	// NOTE: we allocate a new buffer for each value since the decoded value
+	// 		 might keep references to it
+	d.buf = nil
+	d.depth = 0
+	d.elements = 0
+	start := d.offset
+
+	if err := d.readValue(); err != nil {
+		if err == io.EOF && len(d.buf) > 0 {
+			return io.ErrUnexpectedEOF
+		}
 
-	if values, err = d.consume(); err != nil {
-		return
+		return err
 	}
 
-	rest, err = io.ReadAll(d.reader)
-	return
+	return newDecodeState(d.buf, d.config, start).unmarshalValue(v)
+}
+
+// InputOffset returns the number of bytes consumed from the stream so far,
+// i.e. the offset directly after the most recently decoded value
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Buffered returns a reader of the data remaining in the Decoder's buffer
+func (d *Decoder) Buffered() io.Reader {
+	n := d.reader.Buffered()
+	data, _ := d.reader.Peek(n)
+	return bytes.NewReader(data)
+}
+
+// NewDecoder returns a Decoder which reads from `r`
+func NewDecoder(r io.Reader, opts ...Option) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r), config: newConfig(opts)}
 }
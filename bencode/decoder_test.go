@@ -1,7 +1,10 @@
 package bencode
 
 import (
-	_ "fmt"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -102,3 +105,185 @@ func TestBencodedDictionaryWithRest(t *testing.T) {
 		t.Fatalf("rest[0] != 255 (%v)", rest)
 	}
 }
+
+func TestDecoderMultipleValues(t *testing.T) {
+	data := "5:helloi42ed3:foo3:bare"
+	d := NewDecoder(strings.NewReader(data))
+
+	var str any
+	if err := d.Decode(&str); err != nil || str != "hello" {
+		t.Fatalf("Unable to decode first value of '%v' with reason '%v'", data, err)
+	}
+
+	if d.InputOffset() != 7 {
+		t.Fatalf("Invalid input offset %v after first value", d.InputOffset())
+	}
+
+	var i any
+	if err := d.Decode(&i); err != nil || i != 42 {
+		t.Fatalf("Unable to decode second value of '%v' with reason '%v'", data, err)
+	}
+
+	type Container struct {
+		Foo string `bencode:"foo"`
+	}
+
+	c := &Container{}
+	if err := d.Decode(c); err != nil || c.Foo != "bar" {
+		t.Fatalf("Unable to decode third value of '%v' with reason '%v'", data, err)
+	}
+
+	if d.InputOffset() != int64(len(data)) {
+		t.Fatalf("Invalid input offset %v after last value", d.InputOffset())
+	}
+
+	if err := d.Decode(&i); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last value, got '%v'", err)
+	}
+}
+
+func TestDecoderUnexpectedEOF(t *testing.T) {
+	data := "d3:foo3:ba"
+	d := NewDecoder(strings.NewReader(data))
+
+	var v any
+	if err := d.Decode(&v); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF when decoding '%v', got '%v'", data, err)
+	}
+}
+
+func TestDecoderBuffered(t *testing.T) {
+	data := append([]byte("d3:foo3:bare"), byte(255), byte(0))
+	d := NewDecoder(bytes.NewReader(data))
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("Unable to decode '%v' with reason '%v'", data, err)
+	}
+
+	rest, _ := io.ReadAll(d.Buffered())
+	if len(rest) != 2 || rest[0] != 255 {
+		t.Fatalf("Invalid buffered data (%v)", rest)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	valid := []string{
+		"i0e",
+		"i-42e",
+		"0:",
+		"d1:a0:1:bi1ee",
+		"ld1:ai1eed1:bi2eee",
+	}
+
+	for _, data := range valid {
+		if _, _, err := Decode([]byte(data), Strict()); err != nil {
+			t.Fatalf("Unable to decode canonical '%v' with reason '%v'", data, err)
+		}
+	}
+
+	invalid := []struct {
+		data   string
+		offset int64
+		path   string
+	}{
+		{"d1:bi1e1:ai2ee", 7, ""},
+		{"d1:ai1e1:ai2ee", 7, ""},
+		{"d4:infod4:name1:a4:name1:bee", 17, "info"},
+		{"d5:filesld1:b0:1:a0:eee", 15, "files.0"},
+		{"i+1e", 0, ""},
+		{"05:hello", 0, ""},
+		{"li1ei+2ee", 4, "1"},
+		{"i42etrailing", 4, ""},
+	}
+
+	for _, tc := range invalid {
+		_, _, err := Decode([]byte(tc.data), Strict())
+
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("Expected a *SyntaxError when decoding '%v', got '%v'", tc.data, err)
+		}
+
+		if syntaxErr.Offset != tc.offset || syntaxErr.Path != tc.path {
+			t.Fatalf("Unexpected error '%v' when decoding '%v'", err, tc.data)
+		}
+
+		// None of these are rejected when not in strict mode
+		if _, _, err := Decode([]byte(tc.data)); err != nil {
+			t.Fatalf("Unable to decode '%v' in non-strict mode with reason '%v'", tc.data, err)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	type Container struct {
+		A int `bencode:"a"`
+		B int `bencode:"b"`
+	}
+
+	if err := Unmarshal([]byte("d1:bi1e1:ai2ee"), &Container{}, Strict()); err == nil {
+		t.Fatal("Should not be able to unmarshal unsorted keys in strict mode")
+	}
+
+	if err := Unmarshal([]byte("d1:ai1e1:bi2eeextra"), &Container{}, Strict()); err == nil {
+		t.Fatal("Should not be able to unmarshal trailing data in strict mode")
+	}
+
+	d := NewDecoder(strings.NewReader("i1ed1:bi1e1:ai2ee"), Strict())
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("Unable to decode first value with reason '%v'", err)
+	}
+
+	err := d.Decode(&v)
+	if syntaxErr, ok := err.(*SyntaxError); !ok || syntaxErr.Offset != 10 {
+		t.Fatalf("Expected a *SyntaxError at offset 10, got '%v'", err)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		data string
+		opt  Option
+		err  error
+	}{
+		{"d3:foo5:helloe", MaxStringLength(4), ErrMaxStringLength},
+		{"llleee", MaxDepth(2), ErrMaxDepth},
+		{"li1ei2ei3ee", MaxElements(3), ErrMaxElements},
+		{"5:hello", MaxSize(6), ErrMaxSize},
+	}
+
+	for _, tc := range tests {
+		if _, _, err := Decode([]byte(tc.data), tc.opt); !errors.Is(err, tc.err) {
+			t.Fatalf("Expected '%v' when decoding '%v', got '%v'", tc.err, tc.data, err)
+		}
+
+		var v any
+		if err := Unmarshal([]byte(tc.data), &v, tc.opt); !errors.Is(err, tc.err) {
+			t.Fatalf("Expected '%v' when unmarshaling '%v', got '%v'", tc.err, tc.data, err)
+		}
+
+		d := NewDecoder(strings.NewReader(tc.data), tc.opt)
+		if err := d.Decode(&v); !errors.Is(err, tc.err) {
+			t.Fatalf("Expected '%v' when stream decoding '%v', got '%v'", tc.err, tc.data, err)
+		}
+	}
+}
+
+func TestDecoderHugeStringLength(t *testing.T) {
+	// A hostile peer claiming a huge string should not make us allocate it
+	data := "999999999999:short"
+
+	var v any
+	d := NewDecoder(strings.NewReader(data))
+	if err := d.Decode(&v); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF when decoding '%v', got '%v'", data, err)
+	}
+
+	d = NewDecoder(strings.NewReader(data), NetworkLimits())
+	if err := d.Decode(&v); !errors.Is(err, ErrMaxStringLength) {
+		t.Fatalf("Expected ErrMaxStringLength when decoding '%v', got '%v'", data, err)
+	}
+}
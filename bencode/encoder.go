@@ -1,119 +1,302 @@
 package bencode
 
 import (
-	"bytes"
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"reflect"
 	"sort"
+	"strconv"
 )
 
-// Encoder is a simple encoder to encode 'bencoded' data
+// Encoder writes 'bencoded' data to an output stream
 type Encoder struct {
-	buffer *bytes.Buffer
+	w      io.Writer
+	writer *bufio.Writer
+	config config
+	// written is the number of bytes written by the current call to Encode
+	written int64
+	// scratch is used when formatting integers and string lengths
+	scratch [24]byte
 }
 
-// getSortedDictionaryKeys sorts the dictionary keys alphabetically
-func (e Encoder) getSortedDictionaryKeys(dict map[string]any) []string {
-	i := 0
-	keys := make([]string, len(dict))
+// field represents one key/value pair of a dictionary
+type field struct {
+	key   string
+	value reflect.Value
+}
+
+func (e *Encoder) write(data []byte) error {
+	if e.config.maxSize > 0 && e.written+int64(len(data)) > e.config.maxSize {
+		return ErrMaxSize
+	}
+
+	n, err := e.writer.Write(data)
+	e.written += int64(n)
+	return err
+}
 
-	for key := range dict {
-		keys[i] = key
-		i++
+func (e *Encoder) writeString(str string) error {
+	if e.config.maxSize > 0 && e.written+int64(len(str)) > e.config.maxSize {
+		return ErrMaxSize
 	}
 
-	sort.Strings(keys)
-	return keys
+	n, err := e.writer.WriteString(str)
+	e.written += int64(n)
+	return err
 }
 
-func (e Encoder) consumeString(str string) error {
-	size := len(str)
-	data := fmt.Sprintf("%v:%v", size, str)
+func (e *Encoder) consumeString(str string) error {
+	data := strconv.AppendInt(e.scratch[:0], int64(len(str)), 10)
+	data = append(data, ':')
 
-	if _, err := e.buffer.WriteString(data); err != nil {
+	if err := e.write(data); err != nil {
 		return err
 	}
 
-	return nil
+	return e.writeString(str)
 }
 
-func (e Encoder) consumeInteger(i int) error {
-	data := fmt.Sprintf("i%ve", i)
+func (e *Encoder) consumeInteger(i int64) error {
+	data := append(e.scratch[:0], 'i')
+	data = strconv.AppendInt(data, i, 10)
+	data = append(data, 'e')
+	return e.write(data)
+}
 
-	if _, err := e.buffer.WriteString(data); err != nil {
-		return err
+func (e *Encoder) consumeUnsignedInteger(i uint64) error {
+	data := append(e.scratch[:0], 'i')
+	data = strconv.AppendUint(data, i, 10)
+	data = append(data, 'e')
+	return e.write(data)
+}
+
+// consumeBigInteger writes a big.Int, which isn't addressable when it's held
+// by value (e.g. in a map), in which case we make a copy
+func (e *Encoder) consumeBigInteger(v reflect.Value) error {
+	var i *big.Int
+
+	if v.CanAddr() {
+		i = v.Addr().Interface().(*big.Int)
+	} else {
+		value := v.Interface().(big.Int)
+		i = &value
 	}
 
-	return nil
+	data := append(e.scratch[:0], 'i')
+	data = i.Append(data, 10)
+	data = append(data, 'e')
+	return e.write(data)
 }
 
-func (e Encoder) consumeList(list []any) error {
-	if _, err := e.buffer.WriteString("l"); err != nil {
+func (e *Encoder) consumeList(v reflect.Value) error {
+	if err := e.writeString("l"); err != nil {
 		return err
 	}
 
-	for _, value := range list {
-		if err := e.consume(value); err != nil {
+	for i := 0; i < v.Len(); i++ {
+		if err := e.consume(v.Index(i)); err != nil {
 			return err
 		}
 	}
 
-	if _, err := e.buffer.WriteString("e"); err != nil {
+	return e.writeString("e")
+}
+
+// consumeFields writes `fields` as a dictionary, according to the spec
+// dictionary keys should be sorted
+func (e *Encoder) consumeFields(fields []field) error {
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+
+	if err := e.writeString("d"); err != nil {
 		return err
 	}
 
-	return nil
+	for i, f := range fields {
+		if i+1 < len(fields) && fields[i+1].key == f.key {
+			if e.config.strict {
+				return fmt.Errorf("encoder: duplicate dictionary key '%s'", f.key)
+			}
+
+			// The last value of a duplicate key wins
+			continue
+		}
+
+		if err := e.consumeString(f.key); err != nil {
+			return err
+		}
+
+		if err := e.consume(f.value); err != nil {
+			return err
+		}
+	}
+
+	return e.writeString("e")
 }
 
-func (e Encoder) consumeDictionary(dict map[string]any) error {
-	if _, err := e.buffer.WriteString("d"); err != nil {
-		return err
+func (e *Encoder) consumeDictionary(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("encoder: unable to consume map with key type %s", v.Type().Key())
 	}
 
-	// NOTE: according to the spec dictionary keys should be sorted
-	keys := e.getSortedDictionaryKeys(dict)
+	fields := make([]field, 0, v.Len())
+	iter := v.MapRange()
 
-	for _, key := range keys {
-		if err := e.consumeString(key); err != nil {
-			return err
+	for iter.Next() {
+		fields = append(fields, field{key: iter.Key().String(), value: iter.Value()})
+	}
+
+	return e.consumeFields(fields)
+}
+
+// isEmptyValue reports whether `v` is empty in regards to the omitempty option
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+func (e *Encoder) consumeStruct(v reflect.Value) error {
+	var fields []field
+
+	for _, f := range typeFields(v.Type()).list {
+		fieldValue := fieldByIndex(v, f.index)
+
+		// Skip fields of nil embedded structs
+		if !fieldValue.IsValid() {
+			continue
 		}
 
-		value := dict[key]
+		// There's no null in bencode, so nil pointers are always skipped
+		if (fieldValue.Kind() == reflect.Pointer || fieldValue.Kind() == reflect.Interface) && fieldValue.IsNil() {
+			continue
+		}
 
-		if err := e.consume(value); err != nil {
-			return err
+		if f.omitEmpty && isEmptyValue(fieldValue) {
+			continue
 		}
+
+		fields = append(fields, field{key: f.key, value: fieldValue})
+	}
+
+	return e.consumeFields(fields)
+}
+
+// consumeBytes writes a byte slice (or array) as a string
+func (e *Encoder) consumeBytes(v reflect.Value) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem() == reflect.TypeOf(byte(0)) {
+		return e.consumeString(string(v.Bytes()))
 	}
 
-	if _, err := e.buffer.WriteString("e"); err != nil {
+	buf := make([]byte, v.Len())
+	for i := range buf {
+		buf[i] = byte(v.Index(i).Uint())
+	}
+
+	return e.consumeString(string(buf))
+}
+
+// consumeMarshaler writes the output of a Marshaler, which has to be exactly
+// one valid bencoded value
+func (e *Encoder) consumeMarshaler(m Marshaler) error {
+	data, err := m.MarshalBencode()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	// NOTE: in strict mode the data also has to be in canonical form
+	s := Scanner{data: data, config: config{strict: e.config.strict}}
+	if err := s.Skip(); err != nil || s.off != len(data) {
+		return fmt.Errorf("encoder: %T returned invalid bencoded data", m)
+	}
+
+	return e.write(data)
 }
 
-func (e Encoder) consume(value any) error {
-	// TODO: add support for more types
-	switch v := value.(type) {
-	case string:
-		return e.consumeString(v)
-	case int:
-		return e.consumeInteger(v)
-	case []any:
+func (e *Encoder) consume(v reflect.Value) error {
+	if m, ok := asMarshaler(v); ok {
+		return e.consumeMarshaler(m)
+	}
+
+	if v.IsValid() && v.Type() == bigIntType {
+		return e.consumeBigInteger(v)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return e.consumeString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.consumeInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.consumeUnsignedInteger(v.Uint())
+	case reflect.Bool:
+		if v.Bool() {
+			return e.consumeInteger(1)
+		}
+
+		return e.consumeInteger(0)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.consumeBytes(v)
+		}
+
 		return e.consumeList(v)
-	case map[string]any:
+	case reflect.Map:
 		return e.consumeDictionary(v)
+	case reflect.Struct:
+		return e.consumeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("encoder: unable to consume nil %s", v.Type())
+		}
+
+		return e.consume(v.Elem())
+	case reflect.Invalid:
+		return errors.New("encoder: unable to consume invalid value")
 	default:
-		return errors.New("encoder: unable to consume unknown type")
+		return fmt.Errorf("encoder: unable to consume unknown type %s", v.Type())
 	}
 }
 
-func Encode(data any) ([]byte, error) {
-	e := &Encoder{buffer: &bytes.Buffer{}}
+// Encode writes the bencoding of `v` to the stream. Values are written while
+// they're being encoded, so a failed Encode might have written parts of `v`
+func (e *Encoder) Encode(v any) error {
+	e.written = 0
+
+	if err := e.consume(reflect.ValueOf(v)); err != nil {
+		// Discard anything buffered so far
+		e.writer.Reset(e.w)
+		return err
+	}
 
-	if err := e.consume(data); err != nil {
-		return nil, err
+	return e.writer.Flush()
+}
+
+// NewEncoder returns an Encoder which writes to `w`
+func NewEncoder(w io.Writer, opts ...Option) *Encoder {
+	return &Encoder{
+		w:      w,
+		writer: bufio.NewWriter(w),
+		config: newConfig(opts),
 	}
+}
 
-	return e.buffer.Bytes(), nil
+// Encode returns the bencoded `data`
+func Encode(data any) ([]byte, error) {
+	return Marshal(data)
 }
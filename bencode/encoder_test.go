@@ -104,3 +104,87 @@ func TestEncodeDictionary(t *testing.T) {
 		t.Fatalf("Encoded dict %v not encoded as '%v'", b.String(), bencoded)
 	}
 }
+
+func TestEncoderWritesToStream(t *testing.T) {
+	b := &bytes.Buffer{}
+	e := NewEncoder(b)
+
+	if err := e.Encode("hello"); err != nil {
+		t.Fatalf("Unable to encode string with reason '%v'", err)
+	}
+
+	if err := e.Encode(42); err != nil {
+		t.Fatalf("Unable to encode integer with reason '%v'", err)
+	}
+
+	if b.String() != "5:helloi42e" {
+		t.Fatalf("Encoded stream %v not encoded as '5:helloi42e'", b.String())
+	}
+}
+
+func TestEncoderMaxSize(t *testing.T) {
+	b := &bytes.Buffer{}
+	e := NewEncoder(b, MaxSize(6))
+
+	if err := e.Encode("hello"); err != ErrMaxSize {
+		t.Fatalf("Expected ErrMaxSize when encoding past the limit, got '%v'", err)
+	}
+
+	if b.Len() != 0 {
+		t.Fatalf("Expected nothing to be written, got '%v'", b.String())
+	}
+
+	if err := e.Encode("hi"); err != nil || b.String() != "2:hi" {
+		t.Fatalf("Unable to encode within the limit, got '%v' with reason '%v'", b.String(), err)
+	}
+}
+
+func TestEncoderStrictDuplicateKeys(t *testing.T) {
+	type Container struct {
+		A string `bencode:"key"`
+		B string `bencode:"key"`
+	}
+
+	input := Container{A: "foo", B: "bar"}
+
+	if _, err := Marshal(input, Strict()); err == nil {
+		t.Fatal("Should not be able to encode duplicate keys in strict mode")
+	}
+
+	result, err := Marshal(input)
+	if err != nil || string(result) != "d3:key3:bare" {
+		t.Fatalf("Encoded struct %s not encoded as 'd3:key3:bare' (%v)", result, err)
+	}
+}
+
+func TestMarshalStructSortsKeys(t *testing.T) {
+	type Container struct {
+		B int    `bencode:"b"`
+		A string `bencode:"a"`
+	}
+
+	result, err := Marshal(&Container{B: 42, A: "hello"})
+	if err != nil || string(result) != "d1:a5:hello1:bi42ee" {
+		t.Fatalf("Encoded struct %s not encoded as 'd1:a5:hello1:bi42ee' (%v)", result, err)
+	}
+}
+
+func TestMarshalTagOptions(t *testing.T) {
+	type Container struct {
+		Private int    `bencode:"private"`
+		Comment string `bencode:"comment,omitempty"`
+		Ignored string `bencode:"-"`
+		Name    string
+		Ptr     *int `bencode:"ptr"`
+	}
+
+	result, err := Marshal(Container{Comment: "", Ignored: "ignored", Name: ""})
+	if err != nil {
+		t.Fatalf("Unable to marshal struct with reason '%v'", err)
+	}
+
+	bencoded := "d4:Name0:7:privatei0ee"
+	if string(result) != bencoded {
+		t.Fatalf("Encoded struct %s not encoded as '%v'", result, bencoded)
+	}
+}
@@ -0,0 +1,195 @@
+package bencode
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structField represents an exported struct field and the dictionary key it
+// is stored under
+type structField struct {
+	key string
+	// index is the index sequence used with reflect's FieldByIndex, embedded
+	// structs results in an index longer than one
+	index []int
+	// omitEmpty skips the field when encoding if it has an empty value
+	omitEmpty bool
+	// required makes decoding fail if the key is missing
+	required bool
+}
+
+// structFields holds the fields of a struct type, both in order and by key
+type structFields struct {
+	list     []structField
+	byKey    map[string]structField
+	required bool
+}
+
+// parseTag splits a struct tag into its key and options, e.g. the tag
+// `bencode:"name,omitempty,required"` has the key "name" and two options
+func parseTag(tag string) (string, []string) {
+	parts := strings.Split(tag, ",")
+	return parts[0], parts[1:]
+}
+
+func hasOption(opts []string, option string) bool {
+	for _, opt := range opts {
+		if opt == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fieldCache stores the fields of each struct type we've seen so far
+var fieldCache sync.Map
+
+// typeFields returns the fields of struct type `t`, the fields of embedded
+// (untagged) structs are promoted just like in Go. Fields at a shallower depth
+// hides fields with the same key at a deeper depth. A field is stored under the
+// key of its tag, or its name if it has no tag, and fields tagged with "-" are
+// ignored.
+func typeFields(t reflect.Type) structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(structFields)
+	}
+
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var (
+		fields  []structField
+		hidden  = make(map[string]bool)
+		visited = make(map[reflect.Type]bool)
+		current = []embedded{{typ: t}}
+	)
+
+	// NOTE: we walk the embedded structs breadth-first in order to handle
+	// 		 fields hiding each other
+	for len(current) > 0 {
+		var (
+			next  []embedded
+			found = make(map[string]bool)
+		)
+
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+
+			visited[e.typ] = true
+
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag := sf.Tag.Get("bencode")
+
+				if tag == "-" {
+					continue
+				}
+
+				key, opts := parseTag(tag)
+
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				if sf.Anonymous && key == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						// We're unable to allocate unexported pointers
+						if !sf.IsExported() {
+							continue
+						}
+
+						ft = ft.Elem()
+					}
+
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{typ: ft, index: index})
+						continue
+					}
+				}
+
+				if !sf.IsExported() {
+					continue
+				}
+
+				if key == "" {
+					key = sf.Name
+				}
+
+				if hidden[key] {
+					continue
+				}
+
+				found[key] = true
+				fields = append(fields, structField{
+					key:       key,
+					index:     index,
+					omitEmpty: hasOption(opts, "omitempty"),
+					required:  hasOption(opts, "required"),
+				})
+			}
+		}
+
+		for key := range found {
+			hidden[key] = true
+		}
+
+		current = next
+	}
+
+	result := structFields{
+		list:  fields,
+		byKey: make(map[string]structField, len(fields)),
+	}
+
+	for _, f := range fields {
+		// The last of any duplicate keys wins
+		result.byKey[f.key] = f
+		result.required = result.required || f.required
+	}
+
+	cached, _ := fieldCache.LoadOrStore(t, result)
+	return cached.(structFields)
+}
+
+// fieldByIndex returns the (nested) field of `v`, the returned value is
+// invalid if the field is part of a nil embedded struct pointer
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v
+}
+
+// fieldByIndexAlloc is like fieldByIndex, except that nil embedded struct
+// pointers are allocated along the way
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v
+}
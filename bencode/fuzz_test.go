@@ -0,0 +1,195 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// seeds are extension (BEP 9/10) messages and tracker responses, the torrent
+// files in `testdata` are added as well
+var seeds = []string{
+	"d1:md11:ut_metadatai3ee13:metadata_sizei31235e1:v6:uTorrente",
+	"d1:md11:ut_metadatai3e6:ut_pexi1ee1:pi6881e4:reqqi250ee",
+	"d8:msg_typei0e5:piecei0ee",
+	"d8:msg_typei1e5:piecei0e10:total_sizei34256eed6:lengthi42e4:name5:helloe",
+	"d8:msg_typei2e5:piecei1ee",
+	"d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e",
+	"d8:intervali1800e5:peersld2:ip9:127.0.0.14:porti6881eeee",
+	"d14:failure reason12:unregisterede",
+	"i-9223372036854775808e",
+	"i123456789012345678901234567890e",
+	"l0:le0:dee",
+}
+
+func addSeeds(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.torrent"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+}
+
+// scanAll returns the first error from scanning all tokens of `data`, like
+// Decode it returns io.EOF when there is no value
+func scanAll(data []byte, opts ...Option) error {
+	s := NewScanner(data, opts...)
+
+	for tokens := 0; ; tokens++ {
+		if _, err := s.Next(); err != nil {
+			if err == io.EOF && tokens > 0 {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	addSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, rest, err := Decode(data)
+
+		if (err == nil) != (scanAll(data) == nil) {
+			t.Fatalf("Decode and the Scanner disagree on '%q' (%v)", data, err)
+		}
+
+		if err != nil {
+			return
+		}
+
+		encoded, err := Marshal(value)
+		if err != nil {
+			t.Fatalf("Unable to marshal decoded value %#v with reason '%v'", value, err)
+		}
+
+		decoded, _, err := Decode(encoded, Strict())
+		if err != nil {
+			t.Fatalf("Unable to decode re-encoded '%q' with reason '%v'", encoded, err)
+		}
+
+		if !reflect.DeepEqual(value, decoded) {
+			t.Fatalf("Value %#v changed to %#v after a round trip", value, decoded)
+		}
+
+		// Canonical data has to be encoded back to the exact same bytes
+		if _, _, err := Decode(data, Strict()); err == nil && !bytes.Equal(encoded, data[:len(data)-len(rest)]) {
+			t.Fatalf("Canonical '%q' was re-encoded as '%q'", data, encoded)
+		}
+	})
+}
+
+// fuzzInfo and fuzzMetaInfo resembles the structure of a torrent
+type fuzzInfo struct {
+	Files []struct {
+		Length int64    `bencode:"length,required"`
+		Path   []string `bencode:"path,required"`
+	} `bencode:"files,omitempty"`
+	Length      int64  `bencode:"length,omitempty"`
+	Name        string `bencode:"name,required"`
+	PieceLength int    `bencode:"piece length,required"`
+	Pieces      []byte `bencode:"pieces,required"`
+	Private     bool   `bencode:"private,omitempty"`
+}
+
+type fuzzMetaInfo struct {
+	AnnounceList [][]string     `bencode:"announce-list,omitempty"`
+	Announce     string         `bencode:"announce,omitempty"`
+	CreationDate int64          `bencode:"creation date,omitempty"`
+	Info         fuzzInfo       `bencode:"info,required"`
+	RawInfo      RawMessage     `bencode:"-"`
+	Extra        map[string]any `bencode:"extra,omitempty"`
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	addSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var (
+			metainfo fuzzMetaInfo
+			raw      RawMessage
+			generic  any
+		)
+
+		if err := Unmarshal(data, &metainfo); err == nil {
+			if _, err := Marshal(metainfo); err != nil {
+				t.Fatalf("Unable to marshal unmarshaled %#v with reason '%v'", metainfo, err)
+			}
+		}
+
+		if err := Unmarshal(data, &raw, Strict()); err == nil && !bytes.Equal(raw, data) {
+			t.Fatalf("RawMessage '%q' differs from the input '%q'", raw, data)
+		}
+
+		if err := Unmarshal(data, &generic, NetworkLimits()); err == nil {
+			if _, err := Marshal(generic); err != nil {
+				t.Fatalf("Unable to marshal unmarshaled %#v with reason '%v'", generic, err)
+			}
+		}
+	})
+}
+
+type fuzzValue struct {
+	Str     string           `bencode:"str"`
+	Bytes   []byte           `bencode:"bytes"`
+	Int     int64            `bencode:"int"`
+	Uint    uint64           `bencode:"uint"`
+	Bool    bool             `bencode:"bool"`
+	List    []string         `bencode:"list"`
+	Dict    map[string]int64 `bencode:"dict"`
+	Omitted string           `bencode:"omitted,omitempty"`
+}
+
+func FuzzMarshal(f *testing.F) {
+	f.Add("hello", []byte("world"), int64(42), uint64(1<<63), true, "key")
+	f.Add("", []byte{}, int64(-1<<63), uint64(0), false, "")
+	f.Add("4:spam", []byte("d1:ai1ee"), int64(0), uint64(1<<64-1), false, "\x00")
+
+	f.Fuzz(func(t *testing.T, str string, data []byte, i int64, u uint64, b bool, key string) {
+		value := fuzzValue{
+			Str:   str,
+			Bytes: data,
+			Int:   i,
+			Uint:  u,
+			Bool:  b,
+			List:  []string{str, key},
+			Dict:  map[string]int64{key: i, str: -i},
+		}
+
+		// NOTE: an empty string is always unmarshaled as an empty (non-nil) slice
+		if value.Bytes == nil {
+			value.Bytes = []byte{}
+		}
+
+		encoded, err := Marshal(value, Strict())
+		if err != nil {
+			t.Fatalf("Unable to marshal %#v with reason '%v'", value, err)
+		}
+
+		decoded := fuzzValue{}
+		if err := Unmarshal(encoded, &decoded, Strict()); err != nil {
+			t.Fatalf("Unable to unmarshal '%q' with reason '%v'", encoded, err)
+		}
+
+		if !reflect.DeepEqual(value, decoded) {
+			t.Fatalf("Value %#v changed to %#v after a round trip", value, decoded)
+		}
+	})
+}
@@ -1,67 +1,52 @@
 package bencode
 
 import (
+	"bytes"
 	"errors"
 	"reflect"
 )
 
-func unpackValue(v reflect.Value) any {
-	// TODO: add support for types
-	switch v.Kind() {
-	case reflect.String:
-		return v.Interface()
-	case reflect.Int:
-		return v.Interface()
-	case reflect.Struct:
-		fieldsByBencodeTag := make(map[string]interface{})
-
-		// NOTE: might wanna start from 1?
-		for i := 0; i < v.NumField(); i++ {
-			field := v.Type().Field(i)
-			fieldValue := v.Field(i)
-			key := field.Tag.Get("bencode")
+// Marshaler is implemented by types which can marshal themselves into valid
+// bencoded data
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
 
-			// Skip unintialized values
-			if fieldValue.IsZero() {
-				continue
-			}
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
 
-			fieldsByBencodeTag[key] = unpackValue(fieldValue)
-		}
+// asMarshaler returns `v` as a Marshaler, if it (or a pointer to it) implements
+// the interface
+func asMarshaler(v reflect.Value) (Marshaler, bool) {
+	if !v.IsValid() || v.Kind() == reflect.Interface {
+		return nil, false
+	}
 
-		return fieldsByBencodeTag
-	case reflect.Slice:
-		s := make([]any, v.Len())
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil, false
+	}
 
-		for i := 0; i < v.Len(); i++ {
-			value := v.Index(i)
-			s[i] = unpackValue(value)
-		}
+	if v.Type().Implements(marshalerType) {
+		return v.Interface().(Marshaler), true
+	}
 
-		return s
-	default:
-		return v.Interface()
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
 	}
+
+	return nil, false
 }
 
 // Marshal takes any value and returns the bencoded data as byte slice
-func Marshal(v any) ([]byte, error) {
-	value := reflect.ValueOf(v)
-
-	if !value.IsValid() {
+func Marshal(v any, opts ...Option) ([]byte, error) {
+	if !reflect.ValueOf(v).IsValid() {
 		return nil, errors.New("marshal: invalid value")
 	}
 
-	// Unpack
-	if value.Kind() == reflect.Pointer {
-		value = value.Elem()
-	}
+	buf := &bytes.Buffer{}
 
-	if value.Kind() != reflect.Struct {
-		bencode, _ := Encode(v)
-		return bencode, nil
+	if err := NewEncoder(buf, opts...).Encode(v); err != nil {
+		return nil, err
 	}
 
-	unpacked := unpackValue(value)
-	return Encode(unpacked)
+	return buf.Bytes(), nil
 }
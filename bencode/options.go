@@ -0,0 +1,87 @@
+package bencode
+
+import "errors"
+
+// These are returned when one of the limits set by the options is exceeded
+var (
+	ErrMaxSize         = errors.New("bencode: maximum size exceeded")
+	ErrMaxStringLength = errors.New("bencode: maximum string length exceeded")
+	ErrMaxDepth        = errors.New("bencode: maximum nesting depth exceeded")
+	ErrMaxElements     = errors.New("bencode: maximum number of elements exceeded")
+)
+
+// config holds the settings shared by the Encoder and Decoder
+type config struct {
+	strict          bool
+	maxSize         int64
+	maxStringLength int
+	maxDepth        int
+	maxElements     int
+}
+
+// Option is used to configure how values are encoded and decoded
+type Option func(*config)
+
+// Strict enforces the canonical form of bencoded data. When encoding it makes
+// sure that dictionary keys are written in strictly ascending order (i.e.
+// sorted and without any duplicates). When decoding it rejects unsorted or
+// duplicate keys, integers (and string lengths) with leading zeros or signs,
+// and any trailing data after the value.
+func Strict() Option {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// MaxSize limits the number of bytes written by each call to Encode (or
+// Marshal), and the size of each value when decoding. Zero means no limit.
+func MaxSize(n int64) Option {
+	return func(c *config) {
+		c.maxSize = n
+	}
+}
+
+// MaxStringLength limits the length of each string when decoding, zero means
+// no limit
+func MaxStringLength(n int) Option {
+	return func(c *config) {
+		c.maxStringLength = n
+	}
+}
+
+// MaxDepth limits how deeply lists and dictionaries can be nested when
+// decoding, zero means no limit
+func MaxDepth(n int) Option {
+	return func(c *config) {
+		c.maxDepth = n
+	}
+}
+
+// MaxElements limits the total number of values (including dictionary keys)
+// within each decoded value, zero means no limit
+func MaxElements(n int) Option {
+	return func(c *config) {
+		c.maxElements = n
+	}
+}
+
+// NetworkLimits sets safe limits for decoding data received from the network
+// (e.g. from peers or trackers), where the input can't be trusted
+func NetworkLimits() Option {
+	return func(c *config) {
+		c.maxSize = 16 << 20
+		c.maxStringLength = 16 << 20
+		c.maxDepth = 32
+		c.maxElements = 1 << 20
+	}
+}
+
+func newConfig(opts []Option) config {
+	c := config{}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
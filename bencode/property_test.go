@@ -0,0 +1,120 @@
+package bencode
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// randomValue generates a value as it would be returned by Decode, i.e. built
+// from strings, ints (or *big.Int), lists and dictionaries
+func randomValue(r *rand.Rand, depth int) any {
+	kind := r.Intn(5)
+
+	// Keep the values from growing too deep
+	if depth > 4 {
+		kind = r.Intn(3)
+	}
+
+	switch kind {
+	case 0:
+		buf := make([]byte, r.Intn(32))
+		r.Read(buf)
+		return string(buf)
+	case 1:
+		return int(int32(r.Uint32()))
+	case 2:
+		i := new(big.Int).Lsh(big.NewInt(r.Int63()+1), 64)
+		if r.Intn(2) == 0 {
+			i.Neg(i)
+		}
+
+		return i
+	case 3:
+		var list []any
+		for i := r.Intn(5); i > 0; i-- {
+			list = append(list, randomValue(r, depth+1))
+		}
+
+		return list
+	default:
+		dict := make(map[string]any)
+		for i := r.Intn(5); i > 0; i-- {
+			key := make([]byte, r.Intn(8))
+			r.Read(key)
+			dict[string(key)] = randomValue(r, depth+1)
+		}
+
+		return dict
+	}
+}
+
+func TestDecodeEncodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+		value := randomValue(r, 0)
+
+		encoded, err := Marshal(value, Strict())
+		if err != nil {
+			t.Fatalf("Unable to marshal %#v with reason '%v'", value, err)
+		}
+
+		decoded, rest, err := Decode(encoded, Strict())
+		if err != nil || len(rest) > 0 {
+			t.Fatalf("Unable to decode '%q' with reason '%v'", encoded, err)
+		}
+
+		if !reflect.DeepEqual(value, decoded) {
+			t.Fatalf("Value %#v changed to %#v after a round trip", value, decoded)
+		}
+
+		// Canonical data is always re-encoded into the same bytes
+		if again, err := Marshal(decoded); err != nil || string(again) != string(encoded) {
+			t.Fatalf("Re-encoding '%q' resulted in '%q' (%v)", encoded, again, err)
+		}
+	}
+}
+
+type propertyFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Hash   [20]byte `bencode:"hash"`
+}
+
+type propertyValue struct {
+	Name     string           `bencode:"name"`
+	Data     []byte           `bencode:"data"`
+	Int8     int8             `bencode:"int8"`
+	Int64    int64            `bencode:"int64"`
+	Uint16   uint16           `bencode:"uint16"`
+	Uint64   uint64           `bencode:"uint64"`
+	Private  bool             `bencode:"private"`
+	Files    []propertyFile   `bencode:"files"`
+	Counters map[string]int   `bencode:"counters"`
+	Nested   map[string][]int `bencode:"nested"`
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	roundTrip := func(value propertyValue) bool {
+		encoded, err := Marshal(value, Strict())
+		if err != nil {
+			t.Logf("Unable to marshal %#v with reason '%v'", value, err)
+			return false
+		}
+
+		decoded := propertyValue{}
+		if err := Unmarshal(encoded, &decoded, Strict()); err != nil {
+			t.Logf("Unable to unmarshal '%q' with reason '%v'", encoded, err)
+			return false
+		}
+
+		return reflect.DeepEqual(value, decoded)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(1))}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,27 @@
+package bencode
+
+import "errors"
+
+// RawMessage is a raw bencoded value. It keeps the exact bytes of a value as
+// found in the input, and can be used to delay decoding or to write already
+// bencoded data as is.
+type RawMessage []byte
+
+// MarshalBencode returns `m` as the bencoding of `m`
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("bencode: unable to marshal an empty RawMessage")
+	}
+
+	return m, nil
+}
+
+// UnmarshalBencode sets `*m` to a copy of `data`
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	if m == nil {
+		return errors.New("bencode: UnmarshalBencode on nil pointer")
+	}
+
+	*m = append((*m)[0:0], data...)
+	return nil
+}
@@ -0,0 +1,540 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// TokenKind represents the different kinds of tokens yielded by the Scanner
+type TokenKind uint8
+
+const (
+	TokenInteger TokenKind = iota + 1
+	TokenString
+	TokenKey
+	TokenListStart
+	TokenDictStart
+	TokenEnd
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenInteger:
+		return "integer"
+	case TokenString:
+		return "string"
+	case TokenKey:
+		return "key"
+	case TokenListStart:
+		return "list"
+	case TokenDictStart:
+		return "dictionary"
+	case TokenEnd:
+		return "end"
+	default:
+		return "invalid"
+	}
+}
+
+// Token represents one part of a bencoded value. Value points into the data
+// given to the Scanner (no copies are made), for strings and keys it is the
+// actual string and for integers it is the digits (and sign).
+type Token struct {
+	Kind   TokenKind
+	Value  []byte
+	Offset int
+}
+
+// errIntegerRange is returned when an integer doesn't fit in the given type
+var errIntegerRange = errors.New("scanner: integer out of range")
+
+// parseUnsigned parses digits (with an optional sign) into their absolute value
+// without allocating
+func parseUnsigned(digits []byte) (value uint64, negative bool, err error) {
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	if len(digits) == 0 {
+		return 0, false, errors.New("scanner: invalid integer")
+	}
+
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false, errors.New("scanner: invalid integer")
+		}
+
+		if value > (1<<64-1)/10 {
+			return 0, false, errIntegerRange
+		}
+
+		next := value*10 + uint64(c-'0')
+		if next < value {
+			return 0, false, errIntegerRange
+		}
+
+		value = next
+	}
+
+	return value, negative, nil
+}
+
+// parseInteger parses the digits of an integer without allocating
+func parseInteger(digits []byte) (int64, error) {
+	value, negative, err := parseUnsigned(digits)
+	if err != nil {
+		return 0, err
+	}
+
+	if negative {
+		if value > 1<<63 {
+			return 0, errIntegerRange
+		}
+
+		return -int64(value), nil
+	}
+
+	if value > 1<<63-1 {
+		return 0, errIntegerRange
+	}
+
+	return int64(value), nil
+}
+
+func (t Token) checkInteger() error {
+	if t.Kind != TokenInteger {
+		return fmt.Errorf("scanner: unable to use %s token as an integer", t.Kind)
+	}
+
+	return nil
+}
+
+// Int returns the value of an integer token, as long as it fits in an int
+func (t Token) Int() (int, error) {
+	i, err := t.Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	if int64(int(i)) != i {
+		return 0, errIntegerRange
+	}
+
+	return int(i), nil
+}
+
+// Int64 returns the value of an integer token, as long as it fits in an int64
+func (t Token) Int64() (int64, error) {
+	if err := t.checkInteger(); err != nil {
+		return 0, err
+	}
+
+	return parseInteger(t.Value)
+}
+
+// Uint64 returns the value of a non-negative integer token, as long as it fits
+// in an uint64
+func (t Token) Uint64() (uint64, error) {
+	if err := t.checkInteger(); err != nil {
+		return 0, err
+	}
+
+	value, negative, err := parseUnsigned(t.Value)
+	if err != nil {
+		return 0, err
+	}
+
+	if negative && value != 0 {
+		return 0, errIntegerRange
+	}
+
+	return value, nil
+}
+
+// BigInt returns the value of an integer token of any size
+func (t Token) BigInt() (*big.Int, error) {
+	if err := t.checkInteger(); err != nil {
+		return nil, err
+	}
+
+	i, ok := new(big.Int).SetString(string(t.Value), 10)
+	if !ok {
+		return nil, errors.New("scanner: invalid integer")
+	}
+
+	return i, nil
+}
+
+// scanFrame represents an open list or dictionary
+type scanFrame struct {
+	dict bool
+	// count is the number of values (or keys) read so far
+	count int
+	// key is the most recent key of a dictionary, and pending is true until
+	// its value has started
+	key     []byte
+	pending bool
+}
+
+// Scanner is a low-level tokenizer of bencoded data held in memory. It yields
+// the tokens of one value without allocating, and validates the data along
+// the way (according to the options, e.g. `Strict` and the limits).
+type Scanner struct {
+	data   []byte
+	off    int
+	config config
+	// base is the offset of `data` within the input (e.g. a stream)
+	base     int64
+	stack    []scanFrame
+	elements int
+	// inKey is true while a dictionary key is being read
+	inKey   bool
+	started bool
+	done    bool
+}
+
+func (s *Scanner) pathString() string {
+	var parts []string
+
+	for i, frame := range s.stack {
+		if frame.dict {
+			if frame.count == 0 || (s.inKey && i == len(s.stack)-1) {
+				break
+			}
+
+			parts = append(parts, string(frame.key))
+		} else {
+			if frame.count == 0 {
+				break
+			}
+
+			parts = append(parts, strconv.Itoa(frame.count-1))
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func (s *Scanner) syntaxError(off int, msg string) error {
+	return &SyntaxError{msg: msg, Offset: s.base + int64(off), Path: s.pathString()}
+}
+
+func (s *Scanner) limitError(off int, err error) error {
+	return fmt.Errorf("%w at offset %d", err, s.base+int64(off))
+}
+
+// count is called for each value (and key), to enforce the element limit
+func (s *Scanner) count(off int) error {
+	s.elements++
+
+	if s.config.maxElements > 0 && s.elements > s.config.maxElements {
+		return s.limitError(off, ErrMaxElements)
+	}
+
+	return nil
+}
+
+// isCanonicalInteger returns true if `digits` has no sign (except for a minus
+// on non-zero values) or leading zeros
+func isCanonicalInteger(digits []byte) bool {
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+
+		if len(digits) == 1 && digits[0] == '0' {
+			return false
+		}
+	}
+
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Scanner) scanString() ([]byte, error) {
+	start := s.off
+
+	colon := bytes.IndexByte(s.data[s.off:], ':')
+	if colon < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	digits := s.data[s.off : s.off+colon]
+
+	size, err := parseInteger(digits)
+	if err != nil || int64(int(size)) != size {
+		return nil, s.syntaxError(start, "invalid string length")
+	}
+
+	if size < 0 {
+		return nil, s.syntaxError(start, "negative string length not allowed")
+	}
+
+	if s.config.strict && !isCanonicalInteger(digits) {
+		return nil, s.syntaxError(start, "non-canonical string length")
+	}
+
+	if s.config.maxStringLength > 0 && size > int64(s.config.maxStringLength) {
+		return nil, s.limitError(start, ErrMaxStringLength)
+	}
+
+	s.off += colon + 1
+
+	if size > int64(len(s.data)-s.off) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	value := s.data[s.off : s.off+int(size)]
+	s.off += int(size)
+	return value, nil
+}
+
+func (s *Scanner) scanInteger() ([]byte, error) {
+	start := s.off
+
+	end := bytes.IndexByte(s.data[s.off:], 'e')
+	if end < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	digits := s.data[s.off+1 : s.off+end]
+
+	if len(digits) == 0 {
+		return nil, s.syntaxError(start, "integer string is too short")
+	}
+
+	if len(digits) > 1 {
+		if digits[0] == '-' && digits[1] == '0' {
+			return nil, s.syntaxError(start, "integers cannot start with -0")
+		}
+
+		if digits[0] == '0' {
+			return nil, s.syntaxError(start, "integers cannot start with 0")
+		}
+	}
+
+	unsigned := digits
+	if digits[0] == '-' || digits[0] == '+' {
+		unsigned = digits[1:]
+	}
+
+	if len(unsigned) == 0 {
+		return nil, s.syntaxError(start, "invalid integer")
+	}
+
+	for _, c := range unsigned {
+		if c < '0' || c > '9' {
+			return nil, s.syntaxError(start, "invalid integer")
+		}
+	}
+
+	if s.config.strict && !isCanonicalInteger(digits) {
+		return nil, s.syntaxError(start, "non-canonical integer")
+	}
+
+	s.off += end + 1
+	return digits, nil
+}
+
+func (s *Scanner) scanKey(top *scanFrame) (Token, error) {
+	start := s.off
+	s.inKey = true
+
+	if c := s.data[s.off]; c < '0' || c > '9' {
+		return Token{}, s.syntaxError(start, "dictionary keys must be strings")
+	}
+
+	if err := s.count(start); err != nil {
+		return Token{}, err
+	}
+
+	key, err := s.scanString()
+	if err != nil {
+		return Token{}, err
+	}
+
+	if s.config.strict && top.count > 0 {
+		switch bytes.Compare(key, top.key) {
+		case 0:
+			return Token{}, s.syntaxError(start, fmt.Sprintf("duplicate dictionary key '%s'", key))
+		case -1:
+			return Token{}, s.syntaxError(start, fmt.Sprintf("unsorted dictionary key '%s'", key))
+		}
+	}
+
+	top.key = key
+	top.pending = true
+	top.count++
+	s.inKey = false
+	return Token{Kind: TokenKey, Value: key, Offset: start}, nil
+}
+
+// finish marks the top-level value as done once it's complete
+func (s *Scanner) finish() {
+	if len(s.stack) == 0 {
+		s.done = true
+	}
+}
+
+// Next returns the next token, io.EOF is returned once the (top-level) value
+// is complete
+func (s *Scanner) Next() (Token, error) {
+	if s.done {
+		return Token{}, io.EOF
+	}
+
+	if !s.started {
+		s.started = true
+
+		if len(s.data) == 0 {
+			s.done = true
+			return Token{}, io.EOF
+		}
+
+		if s.config.maxSize > 0 && int64(len(s.data)) > s.config.maxSize {
+			return Token{}, s.limitError(0, ErrMaxSize)
+		}
+	}
+
+	if s.off >= len(s.data) {
+		return Token{}, io.ErrUnexpectedEOF
+	}
+
+	var (
+		start = s.off
+		char  = s.data[s.off]
+		top   *scanFrame
+	)
+
+	if len(s.stack) > 0 {
+		top = &s.stack[len(s.stack)-1]
+	}
+
+	if char == 'e' {
+		if top == nil {
+			return Token{}, s.syntaxError(start, "unexpected end of list or dictionary")
+		}
+
+		if top.pending {
+			return Token{}, s.syntaxError(start, "missing dictionary value")
+		}
+
+		s.off++
+		s.stack = s.stack[:len(s.stack)-1]
+		s.finish()
+		return Token{Kind: TokenEnd, Offset: start}, nil
+	}
+
+	if top != nil && top.dict && !top.pending {
+		return s.scanKey(top)
+	}
+
+	if err := s.count(start); err != nil {
+		return Token{}, err
+	}
+
+	if top != nil {
+		if top.dict {
+			top.pending = false
+		} else {
+			top.count++
+		}
+	}
+
+	switch char {
+	case 'i':
+		digits, err := s.scanInteger()
+		if err != nil {
+			return Token{}, err
+		}
+
+		s.finish()
+		return Token{Kind: TokenInteger, Value: digits, Offset: start}, nil
+	case 'l', 'd':
+		if s.config.maxDepth > 0 && len(s.stack) >= s.config.maxDepth {
+			return Token{}, s.limitError(start, ErrMaxDepth)
+		}
+
+		s.off++
+		s.stack = append(s.stack, scanFrame{dict: char == 'd'})
+
+		if char == 'd' {
+			return Token{Kind: TokenDictStart, Offset: start}, nil
+		}
+
+		return Token{Kind: TokenListStart, Offset: start}, nil
+	default:
+		if char < '0' || char > '9' {
+			return Token{}, s.syntaxError(start, fmt.Sprintf("invalid character '%c'", char))
+		}
+
+		str, err := s.scanString()
+		if err != nil {
+			return Token{}, err
+		}
+
+		s.finish()
+		return Token{Kind: TokenString, Value: str, Offset: start}, nil
+	}
+}
+
+// skipRest skips the rest of a list or dictionary, if `tok` is the start of
+// one
+func (s *Scanner) skipRest(tok Token) error {
+	if tok.Kind != TokenListStart && tok.Kind != TokenDictStart {
+		return nil
+	}
+
+	depth := len(s.stack)
+
+	for len(s.stack) >= depth {
+		if _, err := s.Next(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Skip skips the next value (e.g. the value of an unknown key)
+func (s *Scanner) Skip() error {
+	tok, err := s.Next()
+	if err != nil {
+		return err
+	}
+
+	return s.skipRest(tok)
+}
+
+// Offset returns the offset directly after the most recent token
+func (s *Scanner) Offset() int {
+	return s.off
+}
+
+// Depth returns the number of currently open lists and dictionaries
+func (s *Scanner) Depth() int {
+	return len(s.stack)
+}
+
+// Reset makes the Scanner start over with `data`, while keeping its options
+func (s *Scanner) Reset(data []byte) {
+	*s = Scanner{data: data, config: s.config, stack: s.stack[:0]}
+}
+
+// NewScanner returns a Scanner which tokenizes the (first) value in `data`
+func NewScanner(data []byte, opts ...Option) *Scanner {
+	return &Scanner{data: data, config: newConfig(opts)}
+}
@@ -0,0 +1,131 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestScannerTokens(t *testing.T) {
+	data := []byte("d4:infold1:ai42eee4:name5:helloe")
+	expected := []struct {
+		kind   TokenKind
+		value  string
+		offset int
+	}{
+		{TokenDictStart, "", 0},
+		{TokenKey, "info", 1},
+		{TokenListStart, "", 7},
+		{TokenDictStart, "", 8},
+		{TokenKey, "a", 9},
+		{TokenInteger, "42", 12},
+		{TokenEnd, "", 16},
+		{TokenEnd, "", 17},
+		{TokenKey, "name", 18},
+		{TokenString, "hello", 24},
+		{TokenEnd, "", 31},
+	}
+
+	s := NewScanner(data)
+
+	for _, e := range expected {
+		tok, err := s.Next()
+		if err != nil {
+			t.Fatalf("Unable to scan '%v' with reason '%v'", string(data), err)
+		}
+
+		if tok.Kind != e.kind || string(tok.Value) != e.value || tok.Offset != e.offset {
+			t.Fatalf("Unexpected token %v '%s' at %v, expected %v '%s' at %v", tok.Kind, tok.Value, tok.Offset, e.kind, e.value, e.offset)
+		}
+	}
+
+	if _, err := s.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last token, got '%v'", err)
+	}
+
+	if s.Offset() != len(data) || s.Depth() != 0 {
+		t.Fatalf("Invalid offset %v (or depth %v) after the last token", s.Offset(), s.Depth())
+	}
+}
+
+func TestScannerSkip(t *testing.T) {
+	s := NewScanner([]byte("d5:filesld1:ai1eee4:name5:helloe"))
+
+	if tok, _ := s.Next(); tok.Kind != TokenDictStart {
+		t.Fatalf("Expected the start of a dictionary, got %v", tok.Kind)
+	}
+
+	if tok, _ := s.Next(); string(tok.Value) != "files" {
+		t.Fatalf("Expected the key 'files', got '%s'", tok.Value)
+	}
+
+	if err := s.Skip(); err != nil {
+		t.Fatalf("Unable to skip value with reason '%v'", err)
+	}
+
+	if tok, _ := s.Next(); string(tok.Value) != "name" {
+		t.Fatalf("Expected the key 'name' after skipping, got '%s'", tok.Value)
+	}
+}
+
+func TestScannerPointsIntoInput(t *testing.T) {
+	data := []byte("5:hello")
+
+	tok, err := NewScanner(data).Next()
+	if err != nil {
+		t.Fatalf("Unable to scan '%v' with reason '%v'", string(data), err)
+	}
+
+	data[2] = 'j'
+
+	if string(tok.Value) != "jello" {
+		t.Fatalf("Expected the token to point into the input, got '%s'", tok.Value)
+	}
+}
+
+func TestScannerDoesNotAllocate(t *testing.T) {
+	data := []byte("d8:announce3:url4:infod5:filesll1:ae1:bee6:lengthi42e4:name5:helloee")
+	s := NewScanner(data, Strict())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Reset(data)
+
+		for {
+			if _, err := s.Next(); err != nil {
+				break
+			}
+		}
+	})
+
+	if allocs != 0 {
+		t.Fatalf("Expected no allocations when scanning, got %v", allocs)
+	}
+}
+
+func TestScannerErrors(t *testing.T) {
+	invalid := []struct {
+		data   string
+		offset int64
+		path   string
+	}{
+		{"li1ei-ee", 4, "1"},
+		{"d1:ai1ei2ei3ee", 7, ""},
+		{"d4:infod1:ax1:bi1eee", 11, "info.a"},
+		{"d1:ae", 4, "a"},
+		{"e", 0, ""},
+	}
+
+	for _, tc := range invalid {
+		s := NewScanner([]byte(tc.data))
+
+		var err error
+		for err == nil {
+			_, err = s.Next()
+		}
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Offset != tc.offset || syntaxErr.Path != tc.path {
+			t.Fatalf("Unexpected error '%v' when scanning '%v'", err, tc.data)
+		}
+	}
+}
@@ -2,118 +2,365 @@ package bencode
 
 import (
 	"errors"
+	"fmt"
+	"math/big"
 	"reflect"
+	"strconv"
 )
 
-func unmarshalSlice(t reflect.Type, v reflect.Value) reflect.Value {
-	slice := reflect.ValueOf(v.Interface())
-	sliceT := reflect.MakeSlice(t, slice.Len(), slice.Cap())
-	itemT := sliceT.Type().Elem()
+// UnmarshalTypeError describes a bencoded value which can't be stored in a Go
+// value of a specific type
+type UnmarshalTypeError struct {
+	// Value describes the bencoded value, e.g. "string" or "integer 300"
+	Value string
+	Type  reflect.Type
+	// Field is the path (dictionary keys and list indexes) to the value
+	Field string
+}
 
-	for i := 0; i < slice.Len(); i++ {
-		value := slice.Index(i)
-		valueT := unmarshalByType(itemT, value)
-		sliceT.Index(i).Set(valueT)
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("unmarshal: cannot unmarshal %s into field '%s' of type %s", e.Value, e.Field, e.Type)
 	}
 
-	return sliceT
+	return fmt.Sprintf("unmarshal: cannot unmarshal %s into value of type %s", e.Value, e.Type)
+}
+
+func typeError(value string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: value, Type: t}
+}
+
+// MissingFieldError describes a required field which was missing
+type MissingFieldError struct {
+	// Field is the path (dictionary keys and list indexes) to the field
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("unmarshal: missing required field '%s'", e.Field)
+}
+
+func prefixField(field *string, key string) {
+	if *field == "" {
+		*field = key
+	} else {
+		*field = key + "." + *field
+	}
 }
 
-func unmarshalMap(t reflect.Type, v reflect.Value) reflect.Value {
-	mapT := reflect.MakeMap(t)
-	itemT := mapT.Type().Elem()
-	iter := reflect.ValueOf(v.Interface()).MapRange()
+// withField prefixes the field path of a type (or missing field) error with
+// `key`
+func withField(err error, key string) error {
+	var (
+		typeErr    *UnmarshalTypeError
+		missingErr *MissingFieldError
+	)
 
-	for iter.Next() {
-		key := iter.Key()
-		value := iter.Value()
-		valueT := unmarshalByType(itemT, value)
-		mapT.SetMapIndex(key, valueT)
+	if errors.As(err, &typeErr) {
+		prefixField(&typeErr.Field, key)
+	} else if errors.As(err, &missingErr) {
+		prefixField(&missingErr.Field, key)
 	}
 
-	return mapT
+	return err
 }
 
-func unmarshalStruct(t reflect.Type, v reflect.Value) reflect.Value {
-	structT := reflect.New(t).Elem()
-	iter := reflect.ValueOf(v.Interface()).MapRange()
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// unmarshalInteger stores the integer token `tok` in `dst`, integers which
+// don't fit in `dst` results in an error (instead of being truncated)
+func unmarshalInteger(dst reflect.Value, tok Token) error {
+	overflow := &UnmarshalTypeError{Value: "integer " + string(tok.Value), Type: dst.Type()}
+
+	if dst.Type() == bigIntType {
+		i, err := tok.BigInt()
+		if err != nil {
+			return err
+		}
+
+		dst.Addr().Interface().(*big.Int).Set(i)
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		i, err := tok.Int64()
+		if err != nil || (i != 0 && i != 1) {
+			return overflow
+		}
+
+		dst.SetBool(i == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := tok.Int64()
+		if err != nil || dst.OverflowInt(i) {
+			return overflow
+		}
+
+		dst.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := tok.Uint64()
+		if err != nil || dst.OverflowUint(i) {
+			return overflow
+		}
+
+		dst.SetUint(i)
+	default:
+		return typeError("integer", dst.Type())
+	}
+
+	return nil
+}
+
+func unmarshalString(dst reflect.Value, str string) error {
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(str)
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() != reflect.Uint8 {
+			return typeError("string", dst.Type())
+		}
+
+		slice := reflect.MakeSlice(dst.Type(), len(str), len(str))
+		reflect.Copy(slice, reflect.ValueOf(str))
+		dst.Set(slice)
+	case reflect.Array:
+		if dst.Type().Elem().Kind() != reflect.Uint8 {
+			return typeError("string", dst.Type())
+		}
+
+		if dst.Len() != len(str) {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(str)), Type: dst.Type()}
+		}
+
+		reflect.Copy(dst, reflect.ValueOf(str))
+	default:
+		return typeError("string", dst.Type())
+	}
+
+	return nil
+}
 
-	for iter.Next() {
-		tag := iter.Key().String()
+// Unmarshaler is implemented by types which can unmarshal a bencoded value of
+// themselves. The data must be copied if it is to be retained after returning.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
 
-		fieldT := structT.FieldByNameFunc(func(name string) bool {
-			if field, ok := structT.Type().FieldByName(name); ok {
-				return field.Tag.Get("bencode") == tag
-			} else {
-				return false
+// indirect walks down `v`, allocating pointers as needed, until it reaches a
+// non-pointer value or a value implementing Unmarshaler
+func indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
+	for {
+		if v.Kind() != reflect.Pointer && v.CanAddr() {
+			if u, ok := v.Addr().Interface().(Unmarshaler); ok {
+				return u, reflect.Value{}
+			}
+		}
+
+		if v.Kind() != reflect.Pointer {
+			return nil, v
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		if u, ok := v.Interface().(Unmarshaler); ok {
+			return u, reflect.Value{}
+		}
+
+		v = v.Elem()
+	}
+}
+
+func (d *decodeState) unmarshalList(dst reflect.Value) error {
+	switch dst.Kind() {
+	case reflect.Slice:
+		dst.Set(reflect.MakeSlice(dst.Type(), 0, 0))
+	case reflect.Array:
+	default:
+		return typeError("list", dst.Type())
+	}
+
+	var i int
+
+	for ; ; i++ {
+		tok, err := d.scanner.Next()
+		if err != nil {
+			return err
+		}
+
+		if tok.Kind == TokenEnd {
+			break
+		}
+
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.Append(dst, reflect.Zero(dst.Type().Elem())))
+		}
+
+		// Keep counting the items of lists which are too long
+		if i >= dst.Len() {
+			if err := d.scanner.skipRest(tok); err != nil {
+				return err
 			}
-		})
 
-		// Silently skip invalid or private fields
-		if !fieldT.IsValid() || !fieldT.CanSet() {
 			continue
 		}
 
-		value := iter.Value()
-		valueT := unmarshalByType(fieldT.Type(), value)
-		fieldT.Set(valueT)
+		if err := d.unmarshalToken(tok, dst.Index(i)); err != nil {
+			return withField(err, strconv.Itoa(i))
+		}
+	}
+
+	if dst.Kind() == reflect.Array && i != dst.Len() {
+		return typeError(fmt.Sprintf("list of length %d", i), dst.Type())
 	}
 
-	return structT
+	return nil
 }
 
-func unmarshalByType(t reflect.Type, v reflect.Value) reflect.Value {
-	// TODO: add support for more types
-	switch t.Kind() {
-	case reflect.Slice:
-		return unmarshalSlice(t, v)
+func (d *decodeState) unmarshalDictionary(dst reflect.Value) error {
+	var (
+		fields structFields
+		seen   map[string]bool
+	)
+
+	switch dst.Kind() {
 	case reflect.Map:
-		return unmarshalMap(t, v)
+		if dst.Type().Key().Kind() != reflect.String {
+			return typeError("dictionary", dst.Type())
+		}
+
+		dst.Set(reflect.MakeMap(dst.Type()))
 	case reflect.Struct:
-		return unmarshalStruct(t, v)
-	case reflect.String:
-		return reflect.ValueOf(v.Interface())
-	case reflect.Int:
-		return reflect.ValueOf(v.Interface())
+		fields = typeFields(dst.Type())
+
+		if fields.required {
+			seen = make(map[string]bool)
+		}
 	default:
-		// FIXME: this naively ignores the type and just takes the value
-		return reflect.ValueOf(v.Interface())
+		return typeError("dictionary", dst.Type())
 	}
-}
 
-// Unmarshal takes a bencoded byte slice and unpacks it unto a struct
-func Unmarshal(data []byte, v any) error {
-	values, _, err := Decode(data)
-	if err != nil {
-		return err
-	}
+	for {
+		tok, err := d.scanner.Next()
+		if err != nil {
+			return err
+		}
+
+		if tok.Kind == TokenEnd {
+			break
+		}
+
+		if dst.Kind() == reflect.Map {
+			key := string(tok.Value)
+			valueT := reflect.New(dst.Type().Elem()).Elem()
 
-	bencodeV := reflect.ValueOf(values)
+			if err := d.unmarshal(valueT); err != nil {
+				return withField(err, key)
+			}
 
-	if !bencodeV.IsValid() {
-		return errors.New("unmarshal: data is not valid")
+			dst.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), valueT)
+			continue
+		}
+
+		f, ok := fields.byKey[string(tok.Value)]
+
+		// Silently skip unknown fields
+		if !ok {
+			if err := d.scanner.Skip(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := d.unmarshal(fieldByIndexAlloc(dst, f.index)); err != nil {
+			return withField(err, f.key)
+		}
+
+		if seen != nil {
+			seen[f.key] = true
+		}
 	}
 
-	if bencodeV.Kind() != reflect.Map {
-		return errors.New("unmarshal: unable to decode the bencoded data into a map")
+	for _, f := range fields.list {
+		if f.required && !seen[f.key] {
+			return &MissingFieldError{Field: f.key}
+		}
 	}
 
-	structV := reflect.ValueOf(v)
+	return nil
+}
+
+// unmarshalToken decodes the value starting with `tok` and stores it in `dst`
+func (d *decodeState) unmarshalToken(tok Token, dst reflect.Value) error {
+	u, dst := indirect(dst)
+	if u != nil {
+		if err := d.scanner.skipRest(tok); err != nil {
+			return err
+		}
+
+		return u.UnmarshalBencode(d.scanner.data[tok.Offset:d.scanner.off])
+	}
+
+	if dst.Kind() == reflect.Interface {
+		// Values decoded into an `any` are kept as is
+		if dst.NumMethod() > 0 {
+			return typeError(tok.Kind.String(), dst.Type())
+		}
+
+		value, err := d.consumeValue(tok)
+		if err != nil {
+			return err
+		}
+
+		dst.Set(reflect.ValueOf(value))
+		return nil
+	}
 
-	if !structV.IsValid() {
-		return errors.New("unmarshal: 'v' is not valid")
+	switch tok.Kind {
+	case TokenInteger:
+		return unmarshalInteger(dst, tok)
+	case TokenListStart:
+		return d.unmarshalList(dst)
+	case TokenDictStart:
+		return d.unmarshalDictionary(dst)
+	default:
+		return unmarshalString(dst, string(tok.Value))
 	}
+}
 
-	if structV.Kind() == reflect.Pointer {
-		structV = structV.Elem()
+// unmarshal decodes the next value and stores it in `dst`
+func (d *decodeState) unmarshal(dst reflect.Value) error {
+	tok, err := d.scanner.Next()
+	if err != nil {
+		return err
 	}
 
-	if structV.Kind() != reflect.Struct {
-		return errors.New("unmarshal: 'v' is not a struct")
+	return d.unmarshalToken(tok, dst)
+}
+
+// unmarshalValue decodes the value and stores it in the value pointed to by
+// `v`
+func (d *decodeState) unmarshalValue(v any) error {
+	targetV := reflect.ValueOf(v)
+
+	if !targetV.IsValid() || targetV.Kind() != reflect.Pointer || targetV.IsNil() {
+		return errors.New("unmarshal: 'v' is not a valid pointer")
 	}
 
-	value := unmarshalByType(structV.Type(), bencodeV)
-	structV.Set(value)
+	return d.unmarshal(targetV.Elem())
+}
+
+// Unmarshal takes a bencoded byte slice and stores the result in the value
+// pointed to by `v`. In strict mode (see the `Strict` option) the data has to
+// be in canonical form and there can't be any trailing data.
+func Unmarshal(data []byte, v any, opts ...Option) error {
+	d := newDecodeState(data, newConfig(opts), 0)
 
-	return nil
+	if err := d.unmarshalValue(v); err != nil {
+		return err
+	}
+
+	return d.checkTrailing()
 }
@@ -1,6 +1,11 @@
 package bencode
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -141,3 +146,321 @@ func TestUnmarshalStructWithSliceOfIntAndStr(t *testing.T) {
 // 	fmt.Println(demo.Info.PieceLength)
 // 	fmt.Println(demo.Info.Name)
 // }
+
+func TestMarshalUnmarshalAllTypes(t *testing.T) {
+	type Embedded struct {
+		Inner string `bencode:"inner"`
+	}
+
+	type Container struct {
+		Embedded
+		I8     int8              `bencode:"i8"`
+		I16    int16             `bencode:"i16"`
+		I32    int32             `bencode:"i32"`
+		I64    int64             `bencode:"i64"`
+		U8     uint8             `bencode:"u8"`
+		U16    uint16            `bencode:"u16"`
+		U32    uint32            `bencode:"u32"`
+		U64    uint64            `bencode:"u64"`
+		Bool   bool              `bencode:"bool"`
+		Bytes  []byte            `bencode:"bytes"`
+		Hash   [4]byte           `bencode:"hash"`
+		Pair   [2]int            `bencode:"pair"`
+		Ptr    *string           `bencode:"ptr"`
+		Any    any               `bencode:"any"`
+		Ints   map[string]int    `bencode:"ints"`
+		Nested map[string][]uint `bencode:"nested"`
+	}
+
+	str := "pointer"
+	input := Container{
+		Embedded: Embedded{Inner: "promoted"},
+		I8:       -8,
+		I16:      -16,
+		I32:      -32,
+		I64:      -64,
+		U8:       8,
+		U16:      16,
+		U32:      32,
+		U64:      64,
+		Bool:     true,
+		Bytes:    []byte{0, 1, 255},
+		Hash:     [4]byte{1, 2, 3, 4},
+		Pair:     [2]int{41, 42},
+		Ptr:      &str,
+		Any:      "anything",
+		Ints:     map[string]int{"a": 1, "b": 2},
+		Nested:   map[string][]uint{"c": {3, 4}},
+	}
+
+	data, err := Marshal(input)
+	if err != nil {
+		t.Fatalf("Unable to marshal %v with reason '%v'", input, err)
+	}
+
+	output := Container{}
+	if err := Unmarshal(data, &output); err != nil {
+		t.Fatalf("Unable to unmarshal %s with reason '%v'", data, err)
+	}
+
+	if !reflect.DeepEqual(input, output) {
+		t.Fatalf("Round trip mismatch, got %+v, expected %+v", output, input)
+	}
+}
+
+func TestUnmarshalIntoAny(t *testing.T) {
+	var v any
+	if err := Unmarshal([]byte("l5:helloi42ee"), &v); err != nil {
+		t.Fatalf("Unable to unmarshal into any with reason '%v'", err)
+	}
+
+	list, ok := v.([]any)
+	if !ok || len(list) != 2 || list[0] != "hello" || list[1] != 42 {
+		t.Fatalf("Unable to unmarshal list into any, got %v", v)
+	}
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	type Inner struct {
+		Length int `bencode:"length"`
+	}
+
+	type Container struct {
+		Files []Inner `bencode:"files"`
+	}
+
+	err := Unmarshal([]byte("d5:filesld6:lengthi1eed6:length3:fooeee"), &Container{})
+
+	typeErr, ok := err.(*UnmarshalTypeError)
+	if !ok {
+		t.Fatalf("Expected an *UnmarshalTypeError, got '%v'", err)
+	}
+
+	if typeErr.Field != "files.1.length" || typeErr.Value != "string" {
+		t.Fatalf("Unexpected type error '%v'", err)
+	}
+}
+
+func TestUnmarshalIntegerOverflow(t *testing.T) {
+	var (
+		i8 int8
+		u  uint
+		b  bool
+	)
+
+	if err := Unmarshal([]byte("i128e"), &i8); err == nil {
+		t.Fatal("Should not be able to unmarshal 128 into an int8")
+	}
+
+	if err := Unmarshal([]byte("i-1e"), &u); err == nil {
+		t.Fatal("Should not be able to unmarshal -1 into an uint")
+	}
+
+	if err := Unmarshal([]byte("i2e"), &b); err == nil {
+		t.Fatal("Should not be able to unmarshal 2 into a bool")
+	}
+}
+
+func TestUnmarshalLargeIntegers(t *testing.T) {
+	type file struct {
+		Length int64   `bencode:"length"`
+		Size   uint64  `bencode:"size"`
+		Huge   big.Int `bencode:"huge"`
+	}
+
+	data := []byte("d4:hugei123456789012345678901234567890e6:lengthi5497558138880e4:sizei18446744073709551615ee")
+	f := file{}
+
+	if err := Unmarshal(data, &f); err != nil {
+		t.Fatalf("Unable to unmarshal large integers with reason '%v'", err)
+	}
+
+	if f.Length != 5497558138880 || f.Size != 18446744073709551615 || f.Huge.String() != "123456789012345678901234567890" {
+		t.Fatalf("Unexpected large integers %+v", f)
+	}
+
+	encoded, err := Marshal(f)
+	if err != nil || string(encoded) != string(data) {
+		t.Fatalf("Unable to marshal large integers (got '%s') with reason '%v'", encoded, err)
+	}
+
+	var i32 int32
+	err = Unmarshal([]byte("i5497558138880e"), &i32)
+
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Value != "integer 5497558138880" {
+		t.Fatalf("Expected a type error when overflowing an int32, got '%v'", err)
+	}
+}
+
+func TestDecodeLargeIntegers(t *testing.T) {
+	value, _, err := Decode([]byte("i123456789012345678901234567890e"))
+	if err != nil {
+		t.Fatalf("Unable to decode a big integer with reason '%v'", err)
+	}
+
+	if i, ok := value.(*big.Int); !ok || i.String() != "123456789012345678901234567890" {
+		t.Fatalf("Expected a *big.Int, got %T (%v)", value, value)
+	}
+
+	value, _, err = Decode([]byte("i-9223372036854775808e"))
+	if err != nil {
+		t.Fatalf("Unable to decode the smallest int64 with reason '%v'", err)
+	}
+
+	// NOTE: this is an int64 on platforms where int is 32 bits
+	if fmt.Sprint(value) != "-9223372036854775808" {
+		t.Fatalf("Unexpected value %T (%v)", value, value)
+	}
+}
+
+func TestUnmarshalArrayLength(t *testing.T) {
+	var hash [20]byte
+
+	if err := Unmarshal([]byte("3:abc"), &hash); err == nil {
+		t.Fatal("Should not be able to unmarshal a string of length 3 into [20]byte")
+	}
+}
+
+// hashes is a list of SHA-1 hashes bencoded as one concatenated string
+type hashes [][20]byte
+
+func (h *hashes) UnmarshalBencode(data []byte) error {
+	var str string
+	if err := Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	if len(str)%20 != 0 {
+		return errors.New("hashes: invalid length")
+	}
+
+	*h = make(hashes, len(str)/20)
+	for i := range *h {
+		copy((*h)[i][:], str[i*20:])
+	}
+
+	return nil
+}
+
+func (h hashes) MarshalBencode() ([]byte, error) {
+	buf := make([]byte, 0, len(h)*20)
+	for _, hash := range h {
+		buf = append(buf, hash[:]...)
+	}
+
+	return Marshal(string(buf))
+}
+
+func TestMarshalerAndUnmarshaler(t *testing.T) {
+	type Container struct {
+		Pieces hashes `bencode:"pieces"`
+		Name   string `bencode:"name"`
+	}
+
+	input := Container{Pieces: hashes{{1}, {2}}, Name: "demo"}
+
+	data, err := Marshal(input)
+	if err != nil {
+		t.Fatalf("Unable to marshal %v with reason '%v'", input, err)
+	}
+
+	expected := "d4:name4:demo6:pieces40:" + "\x01" + strings.Repeat("\x00", 19) + "\x02" + strings.Repeat("\x00", 19) + "e"
+	if string(data) != expected {
+		t.Fatalf("Marshaled %q, expected %q", data, expected)
+	}
+
+	output := Container{}
+	if err := Unmarshal(data, &output); err != nil {
+		t.Fatalf("Unable to unmarshal %q with reason '%v'", data, err)
+	}
+
+	if !reflect.DeepEqual(input, output) {
+		t.Fatalf("Round trip mismatch, got %+v, expected %+v", output, input)
+	}
+
+	if err := Unmarshal([]byte("d6:pieces3:abce"), &output); err == nil {
+		t.Fatal("Expected the error from UnmarshalBencode to be returned")
+	}
+}
+
+type invalidMarshaler struct{}
+
+func (invalidMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte("i42"), nil
+}
+
+func TestMarshalerInvalidOutput(t *testing.T) {
+	if _, err := Marshal(invalidMarshaler{}); err == nil {
+		t.Fatal("Should not be able to marshal invalid output from a Marshaler")
+	}
+}
+
+func TestRawMessageKeepsExactBytes(t *testing.T) {
+	type Container struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+
+	// NOTE: the keys of the info dictionary are unsorted and it contains an
+	// 		 integer with the value zero, both of which a re-encode would change
+	info := "d6:sourcei0e4:name4:demo7:privatei0ee"
+	data := []byte("d4:info" + info + "4:name4:demoe")
+
+	c := &Container{}
+	if err := Unmarshal(data, c); err != nil {
+		t.Fatalf("Unable to unmarshal %s with reason '%v'", data, err)
+	}
+
+	if string(c.Info) != info {
+		t.Fatalf("RawMessage %s does not match %s", c.Info, info)
+	}
+
+	// The decoded value should not refer to the input
+	data[7] = 'l'
+	if string(c.Info) != info {
+		t.Fatalf("RawMessage %s was modified along with the input", c.Info)
+	}
+
+	output, err := Marshal(c)
+	if err != nil {
+		t.Fatalf("Unable to marshal %v with reason '%v'", c, err)
+	}
+
+	expected := "d4:info" + info + "4:name4:demoe"
+	if string(output) != expected {
+		t.Fatalf("Marshaled %s, expected %s", output, expected)
+	}
+}
+
+func TestUnmarshalTagOptions(t *testing.T) {
+	type Inner struct {
+		Length int `bencode:"length,required"`
+	}
+
+	type Container struct {
+		Name    string `bencode:"name,required"`
+		Ignored string `bencode:"-"`
+		Plain   string
+		Files   []Inner `bencode:"files,omitempty"`
+	}
+
+	c := &Container{}
+	if err := Unmarshal([]byte("d1:-3:foo7:Ignored3:bar5:Plain3:baz4:name4:demoe"), c); err != nil {
+		t.Fatalf("Unable to unmarshal with reason '%v'", err)
+	}
+
+	if c.Name != "demo" || c.Plain != "baz" || c.Ignored != "" {
+		t.Fatalf("Unexpected result %+v", c)
+	}
+
+	err := Unmarshal([]byte("d5:plain3:baze"), &Container{})
+	if missingErr, ok := err.(*MissingFieldError); !ok || missingErr.Field != "name" {
+		t.Fatalf("Expected a missing 'name' error, got '%v'", err)
+	}
+
+	err = Unmarshal([]byte("d5:filesldee4:name4:demoe"), &Container{})
+	if missingErr, ok := err.(*MissingFieldError); !ok || missingErr.Field != "files.0.length" {
+		t.Fatalf("Expected a missing 'files.0.length' error, got '%v'", err)
+	}
+}
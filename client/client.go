@@ -12,6 +12,7 @@ import (
 	"trumtorrent/message"
 	"trumtorrent/metadata"
 	"trumtorrent/peer"
+	"trumtorrent/picker"
 	"trumtorrent/piece"
 	"trumtorrent/torrent"
 )
@@ -32,18 +33,25 @@ type Client struct {
 	conn    net.Conn
 	torrent *torrent.Torrent
 	Peer    *peer.Peer
-	piece   *piece.Piece
+	// requests holds the blocks which we've requested but not yet received,
+	// and when they were requested
+	requests map[picker.Request]time.Time
+	pipeline pipeline
+	// downloaded is where verified pieces are sent
+	downloaded chan<- *piece.Piece
 	// haveBuf is used to buffer received HAVE messages, so we can insert
 	// them into our bitfield later on when we've got a complete torrent
-	haveBuf    []int
+	haveBuf []int
+	// peers is where peers found through peer exchange are sent
+	peers chan<- *peer.Peer
+	// pex is true if we've advertised peer exchange to the peer, which is
+	// only done once we know that the torrent isn't private
+	pex        bool
 	State      state
 	choked     bool
 	interested bool
 }
 
-// BlockSize is the default size for requests (i.e. block length)
-const BlockSize = 16384
-
 func (c Client) send(m *message.Message) error {
 	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	defer c.conn.SetWriteDeadline(time.Time{})
@@ -55,8 +63,12 @@ func (c Client) send(m *message.Message) error {
 	return nil
 }
 
-func (c Client) sendRequest(index, begin, length int) error {
-	return c.send(message.NewRequest(index, begin, length))
+func (c Client) sendRequest(r picker.Request) error {
+	return c.send(message.NewRequest(r.Index, r.Begin, r.Length))
+}
+
+func (c Client) sendCancel(r picker.Request) error {
+	return c.send(message.NewCancel(r.Index, r.Begin, r.Length))
 }
 
 func (c Client) sendInterested() error {
@@ -67,13 +79,60 @@ func (c Client) sendUnchoke() error {
 	return c.send(message.NewUnchoke())
 }
 
+func (c Client) sendKeepAlive() error {
+	return c.send(nil)
+}
+
+func (c *Client) sendExtensionHandshake() error {
+	pex := c.torrent.AllowsPeerExchange()
+
+	payload, err := extension.NewLocalHandshake(pex).Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := c.send(message.NewExtensionHandshake(payload)); err != nil {
+		return err
+	}
+
+	c.pex = pex
+	return nil
+}
+
 func (c Client) sendMetadataRequest(piece int) error {
 	return c.send(message.NewMetadataRequest(c.Peer.MetadataMessageId(), piece))
 }
 
+// setBitfield replaces the bitfield of the peer, the picker stops counting the
+// pieces of the previous bitfield
+func (c *Client) setBitfield(data []byte) {
+	c.torrent.Picker.RemoveBitfield(c.Peer.Bitfield())
+	c.Peer.SetBitfield(data)
+	c.torrent.Picker.AddBitfield(c.Peer.Bitfield())
+}
+
+// setPiece marks a piece as one the peer has, each piece is only counted once
+// by the picker
+func (c *Client) setPiece(piece int) {
+	if c.Peer.HasPiece(piece) {
+		return
+	}
+
+	c.Peer.SetPiece(piece)
+
+	if c.Peer.HasPiece(piece) {
+		c.torrent.Picker.Have(piece)
+	}
+}
+
 func (c *Client) flushHaveBuffer() {
+	if !c.Peer.HasBitfield() {
+		size := int(math.Ceil(float64(c.torrent.PieceCount()) / 8))
+		c.setBitfield(make([]byte, size))
+	}
+
 	for _, p := range c.haveBuf {
-		c.Peer.SetPiece(p)
+		c.setPiece(p)
 	}
 
 	c.haveBuf = nil
@@ -94,22 +153,74 @@ func (c *Client) handleHaveMessage(msg *message.Message) error {
 	// If we've received HAVE messages but not a bitfield we'll make a empty
 	// bitfield in order to store HAVE messages
 	if !c.Peer.HasBitfield() && !c.torrent.MetaInfo.Incomplete() {
-		size := int(math.Ceil(float64(cap(c.torrent.Pieces)) / 8))
-		c.Peer.SetBitfield(make([]byte, size))
+		size := int(math.Ceil(float64(c.torrent.PieceCount()) / 8))
+		c.setBitfield(make([]byte, size))
 	}
 
-	c.Peer.SetPiece(piece)
+	c.setPiece(piece)
 	return nil
 }
 
-func (c Client) handlePieceMessage(msg *message.Message) error {
+func (c *Client) handlePieceMessage(msg *message.Message) error {
 	block, err := message.ParsePieceBlock(msg)
 	if err != nil {
 		return err
 	}
 
-	c.piece.Received += copy(c.piece.Data[block.Begin:], block.Data)
-	c.piece.QueuedRequests--
+	r := picker.Request{Index: int(block.Index), Begin: int(block.Begin), Length: len(block.Data)}
+
+	// NOTE: blocks we haven't requested (e.g. cancelled blocks) are dropped,
+	// 		 since they might arrive after the cancel
+	requested, ok := c.requests[r]
+	if !ok {
+		return nil
+	}
+
+	delete(c.requests, r)
+	c.pipeline.receive(r.Length, requested, time.Now())
+
+	p, _ := c.torrent.Picker.Receive(block)
+	if p == nil {
+		return nil
+	}
+
+	// NOTE: The blocks of a piece might come from several peers, so we can't
+	// 		 tell which of them sent bad data
+	if !c.torrent.IsValidPieceHash(p) {
+		p.Reset()
+		c.torrent.Picker.Requeue(p)
+		return nil
+	}
+
+	c.downloaded <- p
+	return nil
+}
+
+// handlePEXMessage passes on the peers we've been given by the peer, messages
+// are dropped unless we've advertised peer exchange to the peer
+func (c Client) handlePEXMessage(msg *message.Message) error {
+	if !c.pex {
+		return nil
+	}
+
+	pex, err := message.ParsePEX(msg)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := peer.ParseCompactAddrs(pex.Added)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range addrs.Peers(peer.SourcePEX) {
+		// NOTE: We'd rather drop peers than block the connection
+		select {
+		case c.peers <- p:
+		default:
+		}
+	}
+
 	return nil
 }
 
@@ -123,12 +234,21 @@ func (c Client) handleExtendedMessage(msg *message.Message) error {
 		c.Peer.SetExtensionHandshake(hs)
 
 		if c.torrent.MetaInfo.Incomplete() && c.Peer.SupportsMetadataExtension() && c.torrent.Metadata == nil {
-			c.torrent.Metadata = metadata.New(c.Peer.MetadataSize())
+			size := c.Peer.MetadataSize()
+			if size <= 0 || size > metadata.MaxSize {
+				return errors.New("client: peer sent an invalid metadata size")
+			}
+
+			c.torrent.Metadata = metadata.New(size)
 		}
 
 		return nil
 	}
 
+	if message.Is(msg, extension.PEX{}) {
+		return c.handlePEXMessage(msg)
+	}
+
 	m, err := message.ParseExtensionMessage(msg)
 	if err != nil {
 		return err
@@ -176,14 +296,16 @@ func (c *Client) receive() (err error) {
 
 	switch msg.Id {
 	case message.Choke:
+		// NOTE: the peer drops our requests once it chokes us
 		c.choked = true
+		c.releaseRequests()
 	case message.Unchoke:
 		c.choked = false
 	case message.Bitfield:
 		// NOTE: this will overwrite the HAVE's we've gotten so far (hopefully
 		// 		 it will contain those anyway, we could merge them in the
 		// 		 future)
-		c.Peer.SetBitfield(msg.Payload)
+		c.setBitfield(msg.Payload)
 	case message.Have:
 		err = c.handleHaveMessage(msg)
 	case message.Piece:
@@ -195,70 +317,111 @@ func (c *Client) receive() (err error) {
 	return err
 }
 
-func (c *Client) requestPiece(p *piece.Piece) error {
-	fmt.Println("client: requesting piece", p.Index)
+// queueRequests requests blocks until the queue towards the peer is full, see
+// `pipeline` (the peer might limit it through `reqq`)
+func (c *Client) queueRequests() error {
+	var (
+		depth = c.pipeline.depth(c.Peer.RequestQueueSize())
+		has   = func(index int) bool { return c.Peer.HasPiece(index) }
+	)
 
-	c.piece = p
-	defer func() { c.piece = nil }()
+	requested := func(r picker.Request) bool {
+		_, ok := c.requests[r]
+		return ok
+	}
 
-	// NOTE: We'll initialise the buffer here to save memory
-	p.Data = make([]byte, p.Length)
+	for len(c.requests) < depth {
+		r, ok := c.torrent.Picker.Next(has, requested)
+		if !ok {
+			return nil
+		}
 
-	for p.Incomplete() {
-		if !c.choked {
-			for p.CanQueueRequest() {
-				length := BlockSize
+		if err := c.sendRequest(r); err != nil {
+			c.torrent.Picker.Release(r)
+			return err
+		}
 
-				// last block might be truncated
-				if p.Requested+length > p.Length {
-					length = p.Length % length
-				}
+		now := time.Now()
+		if len(c.requests) == 0 {
+			c.pipeline.resume(now)
+		}
 
-				if err := c.sendRequest(p.Index, p.Requested, length); err != nil {
-					return err
-				}
+		c.requests[r] = now
+	}
 
-				p.Requested += length
-				p.QueuedRequests++
-			}
+	return nil
+}
+
+// cancelRequests cancels the requests of blocks which are no longer wanted, e.g.
+// once they've been received from another peer in endgame
+func (c *Client) cancelRequests() error {
+	for r := range c.requests {
+		if c.torrent.Picker.Wanted(r) {
+			continue
 		}
 
-		if err := c.receive(); err != nil {
+		if err := c.sendCancel(r); err != nil {
 			return err
 		}
+
+		delete(c.requests, r)
+		c.torrent.Picker.Release(r)
 	}
 
 	return nil
 }
 
-func (c Client) requestPieces(downloaded chan *piece.Piece) error {
+// releaseRequests puts back the blocks we've requested, so that they can be
+// requested from other peers
+func (c *Client) releaseRequests() {
+	for r := range c.requests {
+		c.torrent.Picker.Release(r)
+	}
+
+	c.requests = make(map[picker.Request]time.Time)
+}
+
+// requestPieces requests blocks (of any of the pieces in flight) from the peer
+// and receives them, verified pieces are sent to `downloaded`. The peer is kept
+// until `done` is closed, even if it hasn't got any blocks we need.
+func (c *Client) requestPieces(downloaded chan *piece.Piece, done <-chan struct{}) error {
+	c.downloaded = downloaded
+	defer c.releaseRequests()
+
 	for {
+		if err := c.cancelRequests(); err != nil {
+			return err
+		}
+
+		// NOTE: this is checked once the peer has sent a message (or once
+		// 		 we've sent a keep-alive), after our requests are cancelled
 		select {
-		case p := <-c.torrent.Pieces:
-			// FIXME: This could end up as an infinite loop unless we start
-			// 		  receiving more HAVE messages. Maybe we should continously
-			// 		  check if we are interested in our peer.
-			if !c.Peer.HasPiece(p.Index) {
-				fmt.Println("client: peer doesnt have", p.Index)
-				c.torrent.Pieces <- p
-				break
-			}
+		case <-done:
+			return nil
+		default:
+		}
 
-			if err := c.requestPiece(p); err != nil {
-				p.Reset()
-				c.torrent.Pieces <- p
+		if !c.choked {
+			if err := c.queueRequests(); err != nil {
 				return err
 			}
+		}
 
-			if !c.torrent.IsValidPieceHash(p) {
-				p.Reset()
-				c.torrent.Pieces <- p
-				break
+		// NOTE: a peer which hasn't got any blocks we need might get more
+		// 		 later on (through HAVE messages) or unchoke us, and pieces
+		// 		 might be requeued (e.g. once they fail the hash check), so
+		// 		 we keep the connection alive rather than dropping the peer
+		err := c.receive()
+		if err, ok := err.(net.Error); ok && err.Timeout() && len(c.requests) == 0 {
+			if err := c.sendKeepAlive(); err != nil {
+				return err
 			}
 
-			downloaded <- p
-		default:
-			return nil
+			continue
+		}
+
+		if err != nil {
+			return err
 		}
 	}
 }
@@ -327,12 +490,22 @@ func (c *Client) close(err error) {
 		c.conn.Close()
 	}
 
+	// The pieces of the peer are no longer available
+	c.setBitfield(nil)
 	c.State = Disconnected
 }
 
+// errPeerNotAllowed is returned for peers of private torrents which were not
+// given by a tracker (see `torrent.AllowsPeer`)
+var errPeerNotAllowed = errors.New("client: peer is not allowed for a private torrent")
+
 func (c *Client) Connect() (err error) {
 	c.State = Connecting
-	defer c.close(err)
+	defer func() { c.close(err) }()
+
+	if !c.torrent.AllowsPeer(c.Peer.Source) {
+		return errPeerNotAllowed
+	}
 
 	var (
 		conn    net.Conn
@@ -364,6 +537,12 @@ func (c *Client) Connect() (err error) {
 		return err
 	}
 
+	if c.Peer.SupportsExtensionProtocol() {
+		if err = c.sendExtensionHandshake(); err != nil {
+			return err
+		}
+	}
+
 	c.State = Connected
 	return nil
 }
@@ -389,20 +568,34 @@ func (c Client) downloadMetadata() error {
 
 		// Wait for all metadata to be downloaded
 		<-c.torrent.Metadata.Wait
+
+		if err := c.torrent.Metadata.Err; err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *Client) Download(downloaded chan *piece.Piece) (err error) {
+// Download downloads the metadata (if needed) and then pieces from the peer,
+// until `done` is closed
+func (c *Client) Download(downloaded chan *piece.Piece, done <-chan struct{}) (err error) {
 	c.State = Downloading
-	defer c.close(err)
+	defer func() { c.close(err) }()
 
 	fmt.Println("client: starting download")
 
 	// If our torrent is incomplete we need to download the metadata first
 	if c.torrent.MetaInfo.Incomplete() {
-		c.downloadMetadata()
+		if err = c.downloadMetadata(); err != nil {
+			return err
+		}
+	}
+
+	// NOTE: the peer might have been given by a magnet link, before we knew
+	// 		 that the torrent is private
+	if !c.torrent.AllowsPeer(c.Peer.Source) {
+		return errPeerNotAllowed
 	}
 
 	if len(c.haveBuf) > 0 {
@@ -435,20 +628,24 @@ func (c *Client) Download(downloaded chan *piece.Piece) (err error) {
 	}
 
 	fmt.Println("client: requesting pieces")
-	if err = c.requestPieces(downloaded); err != nil {
+	if err = c.requestPieces(downloaded, done); err != nil {
 		return err
 	}
 
 	c.conn.Close()
+	c.setBitfield(nil)
 	c.State = Done
 	return nil
 }
 
-func New(peer *peer.Peer, t *torrent.Torrent) *Client {
+// New creates a client for `p`, peers found through `p` are sent to `peers`
+func New(p *peer.Peer, t *torrent.Torrent, peers chan<- *peer.Peer) *Client {
 	return &Client{
 		State:      Idle,
-		Peer:       peer,
+		Peer:       p,
 		torrent:    t,
+		peers:      peers,
+		requests:   make(map[picker.Request]time.Time),
 		choked:     true,
 		interested: false,
 	}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"trumtorrent/bencode"
+	"trumtorrent/extension"
+	"trumtorrent/message"
+	"trumtorrent/peer"
+	"trumtorrent/picker"
+	"trumtorrent/piece"
+	"trumtorrent/torrent"
+)
+
+// TestDisconnectRemovesAvailability makes sure that the pieces of a peer are no
+// longer counted once it disconnects with an error
+func TestDisconnectRemovesAvailability(t *testing.T) {
+	tr := &torrent.Torrent{
+		MetaInfo: torrent.MetaInfo{Info: torrent.Info{
+			Name:        "a",
+			Length:      32,
+			PieceLength: 16,
+			Pieces:      string(make([]byte, 40)),
+		}},
+		Picker: picker.New(),
+	}
+
+	conn, remote := net.Pipe()
+	remote.Close()
+
+	c := New(peer.New(net.IPv4(127, 0, 0, 1), 6881, peer.SourceLocal), tr, nil)
+	c.conn = conn
+	c.setBitfield([]byte{0xc0})
+
+	if tr.Picker.Availability(0) != 1 || tr.Picker.Availability(1) != 1 {
+		t.Fatal("expected the pieces of the peer to be available")
+	}
+
+	// The peer is gone, so sending INTERESTED fails
+	if err := c.Download(make(chan *piece.Piece), nil); err == nil {
+		t.Fatal("expected the download to fail")
+	}
+
+	if c.State != Disconnected {
+		t.Fatalf("expected the client to be disconnected, got %v", c.State)
+	}
+
+	if tr.Picker.Availability(0) != 0 || tr.Picker.Availability(1) != 0 {
+		t.Fatal("expected the pieces of the peer to no longer be available")
+	}
+}
+
+// newTorrent creates a (complete) torrent of two pieces
+func newTorrent(private bool) *torrent.Torrent {
+	tr := &torrent.Torrent{
+		MetaInfo: torrent.MetaInfo{Info: torrent.Info{
+			Name:        "a",
+			Length:      32,
+			PieceLength: 16,
+			Pieces:      string(make([]byte, 40)),
+		}},
+		Picker: picker.New(),
+	}
+
+	if private {
+		tr.MetaInfo.Info.Private = 1
+	}
+
+	return tr
+}
+
+// TestIdlePeerIsKept makes sure that a peer which hasn't got any pieces we need
+// is kept until the download is done, since it might get them later on
+func TestIdlePeerIsKept(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	tr := newTorrent(false)
+	tr.SetPriorities(nil)
+
+	c := New(peer.New(net.IPv4(127, 0, 0, 1), 6881, peer.SourceTracker), tr, nil)
+	c.conn = conn
+
+	var (
+		done       = make(chan struct{})
+		downloaded = make(chan error)
+		received   = make(chan *message.Message, 8)
+	)
+
+	go func() { downloaded <- c.Download(make(chan *piece.Piece), done) }()
+
+	go func() {
+		defer close(received)
+
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				return
+			}
+
+			if msg != nil {
+				received <- msg
+			}
+		}
+	}()
+
+	write := func(m *message.Message) {
+		if _, err := remote.Write(m.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The peer has none of the pieces, and unchokes us
+	write(&message.Message{Id: message.Bitfield, Payload: []byte{0x00}})
+
+	if msg := <-received; msg == nil || msg.Id != message.Interested {
+		t.Fatalf("expected INTERESTED, got %v", msg)
+	}
+
+	write(message.NewUnchoke())
+
+	have := make([]byte, 4)
+	binary.BigEndian.PutUint32(have, 1)
+	write(&message.Message{Id: message.Have, Payload: have})
+
+	msg := <-received
+	if msg == nil || msg.Id != message.Request || binary.BigEndian.Uint32(msg.Payload[0:4]) != 1 {
+		t.Fatalf("expected a REQUEST of piece 1, got %v", msg)
+	}
+
+	// The client stops once the peer sends its next message
+	close(done)
+	write(nil)
+
+	if err := <-downloaded; err != nil {
+		t.Fatal(err)
+	}
+
+	if c.State != Done {
+		t.Fatalf("expected the client to be done, got %v", c.State)
+	}
+}
+
+// newPipeClient creates a client of a peer found through `source`, which is
+// connected to one end of a pipe (everything sent by the client is discarded)
+func newPipeClient(tr *torrent.Torrent, source peer.Source, peers chan<- *peer.Peer) *Client {
+	conn, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+
+	c := New(peer.New(net.IPv4(127, 0, 0, 1), 6881, source), tr, peers)
+	c.conn = conn
+	return c
+}
+
+// TestExtensionHandshakePEX makes sure that peer exchange is only advertised
+// once we know that the torrent isn't private
+func TestExtensionHandshakePEX(t *testing.T) {
+	tests := []struct {
+		name    string
+		torrent *torrent.Torrent
+		pex     bool
+	}{
+		{"public", newTorrent(false), true},
+		{"private", newTorrent(true), false},
+		{"magnet", &torrent.Torrent{Picker: picker.New()}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, remote := net.Pipe()
+			defer remote.Close()
+
+			c := New(peer.New(net.IPv4(127, 0, 0, 1), 6881, peer.SourceTracker), test.torrent, nil)
+			c.conn = conn
+
+			sent := make(chan error)
+			go func() { sent <- c.sendExtensionHandshake() }()
+
+			msg, err := message.Read(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+
+			hs, err := message.ParseExtensionHandshake(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hs.SupportsPEX() != test.pex {
+				t.Fatalf("expected ut_pex to be advertised: %v, got %v", test.pex, hs.SupportsPEX())
+			}
+
+			if c.pex != test.pex {
+				t.Fatalf("expected the client to accept peer exchange: %v, got %v", test.pex, c.pex)
+			}
+		})
+	}
+}
+
+// TestPEXMessage makes sure that peers are only taken from peer exchange
+// messages if we've advertised peer exchange to the peer
+func TestPEXMessage(t *testing.T) {
+	payload, err := bencode.Marshal(extension.PEX{Added: []byte{10, 0, 0, 1, 0x1a, 0xe1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &message.Message{
+		Id:      message.Extended,
+		Payload: append([]byte{byte(extension.LocalPEXId)}, payload...),
+	}
+
+	tests := []struct {
+		name       string
+		private    bool
+		advertised bool
+		peers      int
+	}{
+		{name: "public", advertised: true, peers: 1},
+		{name: "not advertised", peers: 0},
+		{name: "private", private: true, advertised: true, peers: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := make(chan *peer.Peer, 1)
+			c := newPipeClient(newTorrent(test.private), peer.SourceTracker, peers)
+			defer c.conn.Close()
+
+			if test.advertised {
+				if err := c.sendExtensionHandshake(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := c.handleExtendedMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(peers) != test.peers {
+				t.Fatalf("expected %d peers, got %d", test.peers, len(peers))
+			}
+
+			if test.peers > 0 {
+				if p := <-peers; p.Source != peer.SourcePEX || p.String() != "10.0.0.1:6881" {
+					t.Fatalf("expected the peer 10.0.0.1:6881 from pex, got %v from %v", p, p.Source)
+				}
+			}
+		})
+	}
+}
+
+// TestPrivateTorrentRejectsPeers makes sure that only peers from trackers are
+// connected to for private torrents, including peers which were added before
+// we knew that the torrent is private (e.g. from a magnet link)
+func TestPrivateTorrentRejectsPeers(t *testing.T) {
+	for _, source := range []peer.Source{peer.SourceMagnet, peer.SourcePEX} {
+		t.Run(source.String(), func(t *testing.T) {
+			tr := newTorrent(true)
+
+			c := New(peer.New(net.IPv4(127, 0, 0, 1), 6881, source), tr, nil)
+			if err := c.Connect(); !errors.Is(err, errPeerNotAllowed) {
+				t.Fatalf("expected the peer to be rejected, got %v", err)
+			}
+
+			if c.conn != nil {
+				t.Fatal("expected the peer to not be connected to")
+			}
+
+			// The peer was connected to before we got the metadata
+			c = newPipeClient(tr, source, nil)
+			if err := c.Download(make(chan *piece.Piece), nil); !errors.Is(err, errPeerNotAllowed) {
+				t.Fatalf("expected the peer to be disconnected, got %v", err)
+			}
+
+			if c.State != Disconnected {
+				t.Fatalf("expected the client to be disconnected, got %v", c.State)
+			}
+		})
+	}
+
+	if !newTorrent(true).AllowsPeer(peer.SourceTracker) {
+		t.Fatal("expected peers from trackers to be allowed")
+	}
+}
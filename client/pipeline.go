@@ -0,0 +1,90 @@
+package client
+
+import (
+	"math"
+	"time"
+	"trumtorrent/piece"
+)
+
+// These bound the number of outstanding requests towards a peer, unless the
+// peer allows fewer (i.e. `reqq`)
+const (
+	MinQueueDepth = 2
+	MaxQueueDepth = 256
+	// DefaultQueueDepth is used until we've measured the bandwidth of a peer
+	DefaultQueueDepth = 5
+)
+
+// sampleInterval is how often the bandwidth of a peer is measured
+const sampleInterval = 250 * time.Millisecond
+
+// pipeline measures the bandwidth and latency of a peer, in order to keep
+// enough requests outstanding to cover its bandwidth-delay product
+type pipeline struct {
+	// rtt is the lowest latency of a block we've seen, i.e. without the time
+	// the request was queued by the peer
+	rtt time.Duration
+	// rate is the bandwidth in bytes per second (a moving average)
+	rate float64
+	// start and received make up the current sample of the bandwidth
+	start    time.Time
+	received int
+}
+
+// resume starts a new sample, i.e. when we start requesting blocks after being
+// idle (e.g. choked), since the idle time isn't a part of the bandwidth
+func (p *pipeline) resume(now time.Time) {
+	p.start = now
+	p.received = 0
+}
+
+// receive measures a block of `length` bytes which was requested at `requested`
+func (p *pipeline) receive(length int, requested, now time.Time) {
+	if latency := now.Sub(requested); p.rtt == 0 || latency < p.rtt {
+		p.rtt = latency
+	}
+
+	p.received += length
+
+	elapsed := now.Sub(p.start)
+	if elapsed < sampleInterval {
+		return
+	}
+
+	rate := float64(p.received) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = rate
+	} else {
+		p.rate = (p.rate + rate) / 2
+	}
+
+	p.resume(now)
+}
+
+// depth returns the number of requests to keep outstanding, which is at most
+// `limit` (unless it's zero)
+func (p pipeline) depth(limit int) int {
+	depth := DefaultQueueDepth
+
+	// NOTE: Twice the bandwidth-delay product is kept outstanding, so the
+	// 		 peer has blocks to send while our next requests are on their
+	// 		 way, which also lets the depth grow until we're limited by the
+	// 		 bandwidth (rather than by the depth itself)
+	if p.rate > 0 {
+		depth = int(math.Ceil(2 * p.rate * p.rtt.Seconds() / piece.BlockSize))
+	}
+
+	if depth < MinQueueDepth {
+		depth = MinQueueDepth
+	}
+
+	if depth > MaxQueueDepth {
+		depth = MaxQueueDepth
+	}
+
+	if limit > 0 && depth > limit {
+		depth = limit
+	}
+
+	return depth
+}
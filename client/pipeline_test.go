@@ -0,0 +1,88 @@
+package client
+
+import (
+	"testing"
+	"time"
+	"trumtorrent/piece"
+)
+
+// simulate receives blocks from a peer with the given bandwidth (in bytes per
+// second) and latency for two seconds, with up to `depth` blocks outstanding
+func simulate(p *pipeline, rate int, latency time.Duration, depth int) {
+	var (
+		start    = time.Unix(0, 0)
+		interval = time.Duration(float64(time.Second) * piece.BlockSize / float64(rate))
+	)
+
+	p.resume(start)
+
+	for i, now := 0, start.Add(latency); now.Before(start.Add(2 * time.Second)); i++ {
+		// NOTE: the pipeline starts out empty, after that a request has to
+		// 		 wait for the blocks queued before it
+		queued := i
+		if queued > depth {
+			queued = depth
+		}
+
+		p.receive(piece.BlockSize, now.Add(-latency-time.Duration(queued)*interval), now)
+		now = now.Add(interval)
+	}
+}
+
+// bdp returns twice the bandwidth-delay product in blocks, i.e. the expected
+// depth
+func bdp(rate int, latency time.Duration) float64 {
+	return 2 * float64(rate) * latency.Seconds() / piece.BlockSize
+}
+
+func TestPipelineDepth(t *testing.T) {
+	var p pipeline
+
+	if depth := p.depth(0); depth != DefaultQueueDepth {
+		t.Fatalf("expected the default depth before any blocks, got %d", depth)
+	}
+
+	tests := []struct {
+		rate    int
+		latency time.Duration
+	}{
+		{rate: 1 << 20, latency: 100 * time.Millisecond},
+		{rate: 1 << 20, latency: 500 * time.Millisecond},
+		{rate: 4 << 20, latency: 50 * time.Millisecond},
+		{rate: 512 << 10, latency: 300 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		var p pipeline
+
+		// NOTE: the latency is measured without the time requests are
+		// 		 queued by the peer, so the depth doesn't grow on its own
+		simulate(&p, test.rate, test.latency, 100)
+
+		want := bdp(test.rate, test.latency)
+		if depth := float64(p.depth(0)); depth < 0.9*want || depth > 1.1*want+1 {
+			t.Fatalf("%d B/s and %v: expected a depth of about %.1f, got %v", test.rate, test.latency, want, depth)
+		}
+	}
+}
+
+func TestPipelineDepthLimits(t *testing.T) {
+	var p pipeline
+	simulate(&p, 100<<20, time.Second, 20)
+
+	if depth := p.depth(0); depth != MaxQueueDepth {
+		t.Fatalf("expected the depth to be at most %d, got %d", MaxQueueDepth, depth)
+	}
+
+	// The peer allows fewer outstanding requests (i.e. `reqq`)
+	if depth := p.depth(100); depth != 100 {
+		t.Fatalf("expected the depth to be limited by the peer, got %d", depth)
+	}
+
+	var idle pipeline
+	simulate(&idle, piece.BlockSize, time.Millisecond, 1)
+
+	if depth := idle.depth(0); depth != MinQueueDepth {
+		t.Fatalf("expected the depth to be at least %d, got %d", MinQueueDepth, depth)
+	}
+}
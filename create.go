@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"trumtorrent/torrent"
+)
+
+// tiers is a flag which can be given multiple times, each one adds a tier of
+// (comma separated) trackers
+type tiers [][]string
+
+func (t *tiers) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tiers) Set(value string) error {
+	var tier []string
+
+	for _, tracker := range strings.Split(value, ",") {
+		if tracker = strings.TrimSpace(tracker); tracker != "" {
+			tier = append(tier, tracker)
+		}
+	}
+
+	if len(tier) == 0 {
+		return errors.New("empty tracker tier")
+	}
+
+	*t = append(*t, tier)
+	return nil
+}
+
+// create implements the `create` subcommand, which writes a new .torrent file
+func create(args []string) error {
+	var (
+		flags    = flag.NewFlagSet("create", flag.ExitOnError)
+		trackers tiers
+		output   = flags.String("o", "", "where to write the .torrent file (defaults to <name>.torrent)")
+		comment  = flags.String("comment", "", "comment of the torrent")
+		private  = flags.Bool("private", false, "mark the torrent as private")
+		length   = flags.Int("piece-length", 0, "piece length in bytes (picked based on the size by default)")
+	)
+
+	flags.Var(&trackers, "tracker", "tracker URL, repeat for each tier (comma separate trackers within a tier)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: trumtorrent create [flags] <file or directory>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("create: expected exactly one path")
+	}
+
+	path := flags.Arg(0)
+
+	metainfo, err := torrent.Create(path, torrent.CreateOptions{
+		AnnounceList: trackers,
+		Comment:      *comment,
+		Private:      *private,
+		PieceLength:  *length,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	if err := metainfo.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created '%s' (%d pieces)\n", *output, len(metainfo.Info.Pieces)/20)
+	return nil
+}
@@ -0,0 +1,261 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"trumtorrent/client"
+	"trumtorrent/handshake"
+	"trumtorrent/message"
+	"trumtorrent/peer"
+	"trumtorrent/piece"
+	"trumtorrent/torrent"
+)
+
+const (
+	pieceLength    = 64 << 10
+	pieceCount     = 8
+	blocksPerPiece = pieceLength / piece.BlockSize
+)
+
+// seeder is a peer which has all pieces, it answers requests one at a time
+// after `delay` (unless they've been cancelled)
+type seeder struct {
+	listener net.Listener
+	data     []byte
+	infoHash []byte
+	delay    time.Duration
+	// unchoke is how long the seeder waits before it unchokes us
+	unchoke time.Duration
+
+	mu        sync.Mutex
+	cancelled map[[2]int]bool
+}
+
+func newSeeder(t *testing.T, data, infoHash []byte, delay, unchoke time.Duration) *seeder {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &seeder{
+		listener:  listener,
+		data:      data,
+		infoHash:  infoHash,
+		delay:     delay,
+		unchoke:   unchoke,
+		cancelled: make(map[[2]int]bool),
+	}
+
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *seeder) peer() *peer.Peer {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return peer.New(addr.IP.To4(), uint16(addr.Port), peer.SourceLocal)
+}
+
+func (s *seeder) cancels() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.cancelled)
+}
+
+func (s *seeder) isCancelled(index, begin int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cancelled[[2]int{index, begin}]
+}
+
+func (s *seeder) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *seeder) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(m *message.Message) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		conn.Write(m.Bytes())
+	}
+
+	if _, err := handshake.Read(conn); err != nil {
+		return
+	}
+
+	conn.Write(handshake.New(s.infoHash, make([]byte, 20)).Bytes())
+	write(&message.Message{Id: message.Bitfield, Payload: []byte{0xff}})
+
+	go func() {
+		time.Sleep(s.unchoke)
+		write(message.NewUnchoke())
+	}()
+
+	requests := make(chan [3]int, 64)
+	defer close(requests)
+
+	go func() {
+		for r := range requests {
+			time.Sleep(s.delay)
+
+			if s.isCancelled(r[0], r[1]) {
+				continue
+			}
+
+			payload := make([]byte, 8+r[2])
+			binary.BigEndian.PutUint32(payload[0:4], uint32(r[0]))
+			binary.BigEndian.PutUint32(payload[4:8], uint32(r[1]))
+			copy(payload[8:], s.data[r[0]*pieceLength+r[1]:])
+			write(&message.Message{Id: message.Piece, Payload: payload})
+		}
+	}()
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+
+		if msg == nil || len(msg.Payload) != 12 {
+			continue
+		}
+
+		r := [3]int{
+			int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+			int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+			int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+		}
+
+		switch msg.Id {
+		case message.Request:
+			requests <- r
+		case message.Cancel:
+			s.mu.Lock()
+			s.cancelled[[2]int{r[0], r[1]}] = true
+			s.mu.Unlock()
+		}
+	}
+}
+
+// newTorrent creates (and opens) a single file torrent of random data
+func newTorrent(t *testing.T) (*torrent.Torrent, []byte) {
+	dir := t.TempDir()
+
+	data := make([]byte, pieceLength*pieceCount)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	name := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return createTorrent(t, name), data
+}
+
+// createTorrent creates (and opens) a torrent of the file or directory at
+// `name`
+func createTorrent(t *testing.T, name string) *torrent.Torrent {
+	t.Helper()
+
+	metainfo, err := torrent.Create(name, torrent.CreateOptions{PieceLength: pieceLength})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "data.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if err := metainfo.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := torrent.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tr
+}
+
+// TestEndgameSlowPeer makes sure that a slow peer holding the last blocks doesn't
+// stall the download, the blocks are requested from the other peers as well and
+// the requests towards the slow peer are cancelled
+func TestEndgameSlowPeer(t *testing.T) {
+	const slowDelay = time.Second
+
+	tr, data := newTorrent(t)
+	root := t.TempDir()
+	m := NewManager(tr, root)
+
+	// NOTE: the fast peers unchoke us a bit later, so that the slow peer
+	// 		 surely gets some blocks
+	slow := newSeeder(t, data, tr.InfoHash, slowDelay, 0)
+	seeders := []*seeder{
+		slow,
+		newSeeder(t, data, tr.InfoHash, 0, 200*time.Millisecond),
+		newSeeder(t, data, tr.InfoHash, 0, 200*time.Millisecond),
+	}
+
+	for _, s := range seeders {
+		p := s.peer()
+		m.clients[p.String()] = client.New(p, tr, m.peers)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Download()
+		close(done)
+	}()
+
+	// Without endgame the download takes at least as long as it takes the
+	// slow peer to send every block requested from it
+	select {
+	case <-done:
+	case <-time.After(slowDelay * blocksPerPiece / 2):
+		t.Fatal("the download was stalled by the slow peer")
+	}
+
+	got, err := os.ReadFile(filepath.Join(root, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("the downloaded data doesn't match")
+	}
+
+	// The slow peer is told to skip its remaining blocks once it sends the
+	// next one
+	deadline := time.Now().Add(2 * slowDelay)
+	for slow.cancels() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the requests towards the slow peer to be cancelled")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
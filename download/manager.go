@@ -4,10 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 	"trumtorrent/client"
 	"trumtorrent/peer"
+	"trumtorrent/picker"
 	"trumtorrent/piece"
 	"trumtorrent/progress"
 	"trumtorrent/torrent"
@@ -16,35 +20,96 @@ import (
 
 const ConnectionLimit int = 30
 
+// WriteAttempts is the number of times a piece is written before the download
+// fails, i.e. an error which persists (e.g. a full disk) stops the download
+const WriteAttempts int = 3
+
 type Manager struct {
-	torrent     *torrent.Torrent
-	progress    *progress.Progress
-	clients     map[string]*client.Client
-	peers       chan *peer.Peer
-	downloaded  chan *piece.Piece
-	connWait    chan struct{}
-	trackers    []tracker.Tracker
-	connections int
+	torrent *torrent.Torrent
+	// root is the directory where the files of the torrent are written
+	root     string
+	progress *progress.Progress
+	// mu guards the clients, which are added and connected to by different
+	// goroutines
+	mu      sync.Mutex
+	clients map[string]*client.Client
+	// connected holds the peers which have been connected to
+	connected  map[string]bool
+	peers      chan *peer.Peer
+	downloaded chan *piece.Piece
+	// slots holds one value per open connection, i.e. it limits the number
+	// of connections to `ConnectionLimit`
+	slots    chan struct{}
+	trackers *tracker.Tiers
+	// done is closed once the download has finished (or failed)
+	done chan struct{}
+	// failed is where errors which stop the download are sent
+	failed chan error
+}
+
+// fail stops the download with `err`, unless it has already been stopped
+func (m *Manager) fail(err error) {
+	select {
+	case m.failed <- err:
+	default:
+	}
 }
 
-func (m *Manager) wait() {
-	// FIXME: Write something that does batch writes instead, and also handles
-	// 		  i/o errors
+func (m *Manager) wait() error {
+	// failures holds the number of failed writes of each piece
+	failures := make(map[int]int)
+
+	// FIXME: Write something that does batch writes instead
 	for !m.progress.Complete() {
 		select {
+		case err := <-m.failed:
+			close(m.done)
+			return err
 		case p := <-m.downloaded:
-			if err := p.Write(); err != nil {
+			if err := p.Write(m.root); err != nil {
 				fmt.Println(err)
+
+				failures[p.Index]++
+				if failures[p.Index] >= WriteAttempts {
+					close(m.done)
+					return fmt.Errorf("download: unable to write piece %d: %w", p.Index, err)
+				}
+
+				p.Reset()
+				m.torrent.Picker.Requeue(p)
+				continue
 			}
 
+			delete(failures, p.Index)
+
+			// NOTE: readers (see `Reader`) are waiting for pieces to be written
+			m.torrent.Picker.Done(p)
 			m.progress.CalculateProgress(p)
+		case <-time.After(time.Second):
+			// NOTE: the download might be complete without any pieces, e.g.
+			// 		 once we've got metadata of which nothing is wanted
 		}
 	}
 
+	// NOTE: the files of magnet links are only known once we've got the
+	// 		 metadata (see `main`)
+	if _, wanted := m.torrent.Picker.Progress(); wanted == 0 {
+		close(m.done)
+		return errors.New("download: no files selected for download")
+	}
+
+	if err := m.torrent.ApplyAttributes(m.root); err != nil {
+		fmt.Println(err)
+	}
+
+	close(m.done)
 	m.progress.Done()
+	return nil
 }
 
 func (m *Manager) connectToPeer(c *client.Client) {
+	defer func() { <-m.slots }()
+
 	log.Printf("Connecting to peer '%v'", c.Peer.String())
 
 	// TODO: we could most likely do this in a better way
@@ -61,11 +126,16 @@ func (m *Manager) connectToPeer(c *client.Client) {
 	}
 
 	for retries := 0; retries <= 5; retries++ {
-		if err := c.Download(m.downloaded); err != nil {
+		if err := c.Download(m.downloaded, m.done); err != nil {
 			if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
 				continue
 			}
 
+			// NOTE: no peer can give us metadata which works
+			if errors.Is(err, torrent.ErrInvalidMetadata) {
+				m.fail(err)
+			}
+
 			return
 		}
 
@@ -73,101 +143,166 @@ func (m *Manager) connectToPeer(c *client.Client) {
 	}
 
 	log.Printf("Disconnecting from peer '%v'", c.Peer.String())
+}
 
-	m.connections--
-	if m.connections < ConnectionLimit {
-		m.connWait <- struct{}{}
+// idleClients returns the clients which haven't been connected to
+func (m *Manager) idleClients() []*client.Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var idle []*client.Client
+
+	// NOTE: We currently only connect to each peer once, even if it
+	// 		 disconnects for some reason.
+	for addr, c := range m.clients {
+		if !m.connected[addr] {
+			idle = append(idle, c)
+		}
 	}
+
+	return idle
 }
 
 func (m *Manager) connectToPeers() {
-	for _, c := range m.clients {
-		// NOTE: We currently only connect to each peer once, even if it
-		// 		 disconnects for some reason.
-		if c.State != client.Idle {
-			continue
-		}
+	for !m.progress.Complete() {
+		for _, c := range m.idleClients() {
+			// NOTE: this waits for a connection to close if we're at the
+			// 		 limit
+			select {
+			case m.slots <- struct{}{}:
+			case <-m.done:
+				return
+			}
 
-		if m.connections >= ConnectionLimit {
-			<-m.connWait
-			continue
+			m.mu.Lock()
+			m.connected[c.Peer.String()] = true
+			m.mu.Unlock()
+
+			go m.connectToPeer(c)
 		}
 
-		m.connections++
-		go m.connectToPeer(c)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-m.done:
+			return
+		}
 	}
+}
 
-	if m.progress.Complete() {
-		return
-	}
+// addClient adds a client for a peer, unless there's one already
+func (m *Manager) addClient(p *peer.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	time.Sleep(2 * time.Second)
-	m.connectToPeers()
+	// Only allow a unique set of peers
+	if _, exists := m.clients[p.String()]; !exists {
+		m.clients[p.String()] = client.New(p, m.torrent, m.peers)
+	}
 }
 
 func (m *Manager) waitForPeers() {
 	for {
 		select {
 		case p := <-m.peers:
-			// Only allow a unique set of peers
-			if _, exists := m.clients[p.String()]; !exists {
-				m.clients[p.String()] = client.New(p, m.torrent)
+			if !m.torrent.AllowsPeer(p.Source) {
+				log.Printf("Rejecting peer '%v' from %v (private torrent)", p.String(), p.Source)
+				continue
 			}
+
+			m.addClient(p)
 		case <-time.After(5 * time.Second):
 			if m.progress.Complete() {
 				return
 			}
+		case <-m.done:
+			return
 		}
 	}
 }
 
-func (m *Manager) announceToTracker(tr tracker.Tracker) {
-	log.Printf("Announcing to tracker '%v'", tr.String())
+// announceToTrackers announces to one tracker at a time (see `tracker.Tiers`)
+func (m *Manager) announceToTrackers() {
+	if m.trackers.Len() == 0 {
+		return
+	}
 
-	if err := tr.Announce(); err != nil {
+	// NOTE: We only announce once, we might want to announce again (after the
+	// 		 interval) if we haven't got enough peers.
+	peers, err := m.trackers.Announce()
+	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	for _, p := range tr.Peers() {
+	for _, p := range peers {
 		m.peers <- p
 	}
 }
 
-func (m *Manager) announceToTrackers() {
-	// NOTE: We connect to all trackers at once (and only once), we might want
-	// 		 to wait if we've currently got enough peers.
-	for _, tr := range m.trackers {
-		go m.announceToTracker(tr)
+// addPeerHints adds the peers given by a magnet link (i.e. `x.pe`)
+func (m *Manager) addPeerHints() {
+	// NOTE: magnet links don't tell if a torrent is private, so the clients
+	// 		 of these peers are disconnected once we've got the metadata (see
+	// 		 `torrent.AllowsPeer`)
+	if !m.torrent.AllowsPeer(peer.SourceMagnet) {
+		return
 	}
-}
 
-func (m *Manager) setupTrackers() {
-	for _, addr := range m.torrent.Trackers() {
-		t, err := tracker.New(addr, m.torrent)
+	for _, hint := range m.torrent.PeerHints {
+		host, portStr, err := net.SplitHostPort(hint)
+		if err != nil {
+			continue
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
 		if err != nil {
 			continue
 		}
 
-		m.trackers = append(m.trackers, t)
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			log.Printf("Unable to resolve peer '%v'", hint)
+			continue
+		}
+
+		ip := ips[0]
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		m.peers <- peer.New(ip, uint16(port), peer.SourceMagnet)
 	}
 }
 
-func (m *Manager) Download() {
-	m.setupTrackers()
+// SetMode changes the order in which pieces are downloaded, see `OpenFile` for
+// streaming
+func (m *Manager) SetMode(mode picker.Mode) {
+	m.torrent.Picker.SetMode(mode)
+}
+
+// Download downloads the torrent until it's complete, or until the download
+// fails
+func (m *Manager) Download() error {
+	m.trackers = tracker.NewTiers(m.torrent)
+	go m.addPeerHints()
 	go m.announceToTrackers()
 	go m.waitForPeers()
 	go m.connectToPeers()
-	m.wait()
+	return m.wait()
 }
 
-func NewManager(t *torrent.Torrent) *Manager {
+// NewManager creates a manager which downloads `t` into the directory `root`
+func NewManager(t *torrent.Torrent, root string) *Manager {
 	return &Manager{
 		torrent:    t,
+		root:       root,
 		progress:   progress.New(t),
 		peers:      make(chan *peer.Peer, 64),
 		downloaded: make(chan *piece.Piece, 128),
 		clients:    make(map[string]*client.Client),
-		connWait:   make(chan struct{}),
+		connected:  make(map[string]bool),
+		slots:      make(chan struct{}, ConnectionLimit),
+		done:       make(chan struct{}),
+		failed:     make(chan error, 1),
 	}
 }
@@ -0,0 +1,72 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"trumtorrent/torrent"
+)
+
+// TestWaitNothingWanted makes sure that a download of which nothing is wanted
+// (e.g. once we've got the metadata of a magnet link) stops
+func TestWaitNothingWanted(t *testing.T) {
+	tr, _ := newFilesTorrent(t)
+	tr.SetPriorities(map[int]torrent.Priority{0: torrent.PrioritySkip, 1: torrent.PrioritySkip, 2: torrent.PrioritySkip})
+
+	m := NewManager(tr, t.TempDir())
+
+	stopped := make(chan error)
+	go func() { stopped <- m.wait() }()
+
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatal("expected the download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download didn't stop")
+	}
+}
+
+// TestWaitWriteFailures makes sure that a piece which can't be written stops the
+// download, rather than being downloaded over and over again
+func TestWaitWriteFailures(t *testing.T) {
+	tr, data := newFilesTorrent(t)
+
+	// NOTE: the files can't be created within a file
+	root := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(root, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(tr, root)
+
+	stopped := make(chan error)
+	go func() { stopped <- m.wait() }()
+
+	var (
+		first    = func(index int) bool { return index == 0 }
+		deadline = time.Now().Add(5 * time.Second)
+	)
+
+	// NOTE: the piece can only be picked again once it has been requeued
+	for attempt := 0; attempt < WriteAttempts; attempt++ {
+		for fetch(m, data, first) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected piece 0 to be picked again after %d attempts", attempt)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatal("expected the download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download didn't stop")
+	}
+}
@@ -0,0 +1,159 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"trumtorrent/picker"
+	"trumtorrent/torrent"
+)
+
+// Reader reads a file of a torrent while it's being downloaded, a read blocks
+// until its piece has been downloaded, verified and written. Reads (and seeks)
+// move the cursor of the picker, so the pieces ahead of it are picked first.
+type Reader struct {
+	manager     *Manager
+	file        torrent.LayoutFile
+	pieceLength int64
+	// mu guards f, which is opened by the first read and might be closed while
+	// a read is waiting
+	mu     sync.Mutex
+	f      *os.File
+	offset int64
+	// closed is closed by `Close`, i.e. it stops reads which are waiting
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Read reads at most until the end of the current piece
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.offset >= r.file.Length {
+		return 0, io.EOF
+	}
+
+	var (
+		t     = r.manager.torrent
+		index = int((r.file.Offset + r.offset) / r.pieceLength)
+		end   = (int64(index)+1)*r.pieceLength - r.file.Offset
+	)
+
+	if end > r.file.Length {
+		end = r.file.Length
+	}
+
+	if int64(len(b)) > end-r.offset {
+		b = b[:end-r.offset]
+	}
+
+	t.Picker.SetCursor(index)
+
+	select {
+	case <-t.Picker.Wait(index):
+	case <-r.manager.done:
+	case <-r.closed:
+		return 0, os.ErrClosed
+	}
+
+	// NOTE: the piece is no longer wanted if the file was skipped after it was
+	// 		 opened (see `torrent.SetPriorities`), and it'll never be written if
+	// 		 the download has stopped
+	if !t.Picker.IsDone(index) {
+		select {
+		case <-r.manager.done:
+			return 0, errors.New("download: the download has stopped")
+		default:
+			return 0, errors.New("download: the file is skipped")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	if r.f == nil {
+		f, err := os.Open(filepath.Join(r.manager.root, filepath.FromSlash(r.file.Path)))
+		if err != nil {
+			return 0, err
+		}
+
+		r.f = f
+	}
+
+	n, err := r.f.ReadAt(b, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, errors.New("download: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("download: negative position")
+	}
+
+	r.offset = offset
+
+	if offset < r.file.Length {
+		r.manager.torrent.Picker.SetCursor(int((r.file.Offset + offset) / r.pieceLength))
+	}
+
+	return offset, nil
+}
+
+// Close closes the file, reads which are waiting for their piece return
+// `os.ErrClosed`
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	f := r.f
+	r.f = nil
+	return f.Close()
+}
+
+// OpenFile returns a Reader of the file at `index` (in the order of the
+// metadata) and switches to streaming, the file can't be skipped (see
+// `torrent.SelectFiles`)
+func (m *Manager) OpenFile(index int) (*Reader, error) {
+	if m.torrent.MetaInfo.Incomplete() {
+		return nil, errors.New("download: the metadata has not been downloaded yet")
+	}
+
+	files := m.torrent.Layout().Files()
+	if index < 0 || index >= len(files) {
+		return nil, errors.New("download: invalid file index")
+	}
+
+	if m.torrent.FilePriority(index) == torrent.PrioritySkip {
+		return nil, errors.New("download: the file is skipped (or has no data)")
+	}
+
+	m.SetMode(picker.Streaming)
+	return &Reader{
+		manager:     m,
+		file:        files[index],
+		pieceLength: int64(m.torrent.PieceLength()),
+		closed:      make(chan struct{}),
+	}, nil
+}
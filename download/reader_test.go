@@ -0,0 +1,353 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"trumtorrent/picker"
+	"trumtorrent/piece"
+	"trumtorrent/torrent"
+)
+
+// newFilesTorrent creates (and opens) a torrent of three files of random data,
+// which aren't aligned to the pieces:
+//
+//	a	pieces 0 and 1
+//	b	pieces 1 to 3
+//	c	pieces 3 to 6
+func newFilesTorrent(t *testing.T) (*torrent.Torrent, []byte) {
+	dir := filepath.Join(t.TempDir(), "files")
+	if err := os.Mkdir(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		random = rand.New(rand.NewSource(1))
+		data   []byte
+	)
+
+	for _, file := range []struct {
+		name   string
+		length int
+	}{
+		{"a", pieceLength + 100},
+		{"b", 2*pieceLength + 200},
+		{"c", 3 * pieceLength},
+	} {
+		b := make([]byte, file.length)
+		random.Read(b)
+		data = append(data, b...)
+
+		if err := os.WriteFile(filepath.Join(dir, file.name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return createTorrent(t, dir), data
+}
+
+// fetch downloads the next piece which is picked among the pieces for which
+// `has` returns true (as a peer would), it returns the index of the piece or
+// -1 if there's nothing left to download
+func fetch(m *Manager, data []byte, has func(int) bool) int {
+	var (
+		p         = m.torrent.Picker
+		requested = func(picker.Request) bool { return false }
+	)
+
+	r, ok := p.Next(has, requested)
+	if !ok {
+		return -1
+	}
+
+	index := r.Index
+	for ok {
+		begin := index*pieceLength + r.Begin
+		block := piece.Block{Index: uint32(index), Begin: uint32(r.Begin), Data: data[begin : begin+r.Length]}
+
+		if pc, _ := p.Receive(block); pc != nil {
+			m.downloaded <- pc
+			return index
+		}
+
+		r, ok = p.Next(func(i int) bool { return i == index }, requested)
+	}
+
+	return -1
+}
+
+func all(int) bool {
+	return true
+}
+
+// finish downloads the remaining pieces and waits for the download to finish
+func finish(t *testing.T, m *Manager, data []byte) {
+	t.Helper()
+
+	for fetch(m, data, all) >= 0 {
+	}
+
+	select {
+	case <-m.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download didn't finish")
+	}
+}
+
+func TestReaderReadAndSeek(t *testing.T) {
+	tr, data := newFilesTorrent(t)
+	m := NewManager(tr, t.TempDir())
+	go m.wait()
+
+	r, err := m.OpenFile(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	go func() {
+		for fetch(m, data, all) >= 0 {
+		}
+	}()
+
+	var (
+		file = tr.Layout().Files()[1]
+		want = data[file.Offset : file.Offset+file.Length]
+	)
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatal("the data of the file doesn't match")
+	}
+
+	// NOTE: the second piece of the file starts at `pieceLength - 100`
+	tests := []struct {
+		name   string
+		offset int64
+		whence int
+		pos    int64
+		length int
+		err    bool
+	}{
+		{name: "start", offset: 0, whence: io.SeekStart, pos: 0, length: 10},
+		{name: "across pieces", offset: pieceLength - 150, whence: io.SeekStart, pos: pieceLength - 150, length: 100},
+		{name: "current", offset: -100, whence: io.SeekCurrent, pos: pieceLength - 150, length: pieceLength + 100},
+		{name: "end", offset: -10, whence: io.SeekEnd, pos: file.Length - 10, length: 10},
+		{name: "past the end", offset: 10, whence: io.SeekEnd, pos: file.Length + 10},
+		{name: "negative", offset: -1, whence: io.SeekStart, err: true},
+		{name: "invalid whence", offset: 0, whence: 3, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pos, err := r.Seek(test.offset, test.whence)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected the seek to fail")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pos != test.pos {
+				t.Fatalf("expected position %d, got %d", test.pos, pos)
+			}
+
+			b := make([]byte, test.length)
+			if _, err := io.ReadFull(r, b); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(b, want[pos:pos+int64(test.length)]) {
+				t.Fatalf("the data at %d doesn't match", pos)
+			}
+
+			if pos+int64(test.length) >= file.Length {
+				if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+					t.Fatalf("expected EOF, got %d bytes (%v)", n, err)
+				}
+			}
+		})
+	}
+}
+
+// TestReaderFollowsCursor makes sure that the pieces are picked from where the
+// file is read
+func TestReaderFollowsCursor(t *testing.T) {
+	tr, data := newFilesTorrent(t)
+	m := NewManager(tr, t.TempDir())
+	go m.wait()
+
+	// c starts 300 bytes into piece 3
+	r, err := m.OpenFile(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	file := tr.Layout().Files()[2]
+
+	if _, err := r.Seek(pieceLength, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{4, 5} {
+		if got := fetch(m, data, all); got != want {
+			t.Fatalf("expected piece %d to be picked, got %d", want, got)
+		}
+	}
+
+	b := make([]byte, 2*pieceLength)
+	n, err := io.ReadFull(r, b[:pieceLength])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b[:n], data[file.Offset+pieceLength:file.Offset+pieceLength+int64(n)]) {
+		t.Fatal("the data doesn't match")
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fetch(m, data, all); got != 3 {
+		t.Fatalf("expected piece 3 to be picked, got %d", got)
+	}
+
+	// A read stops at the end of the piece
+	n, err = r.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != pieceLength-300 {
+		t.Fatalf("expected %d bytes, got %d", pieceLength-300, n)
+	}
+
+	if !bytes.Equal(b[:n], data[file.Offset:file.Offset+int64(n)]) {
+		t.Fatal("the data doesn't match")
+	}
+
+	// A read waits for its piece
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error)
+	go func() {
+		_, err := io.ReadFull(r, b[:10])
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		t.Fatalf("expected the read to wait for the piece, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := fetch(m, data, all); got != 6 {
+		t.Fatalf("expected piece 6 to be picked, got %d", got)
+	}
+
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b[:10], data[len(data)-10:]) {
+		t.Fatal("the data doesn't match")
+	}
+
+	finish(t, m, data)
+}
+
+// TestReaderStops makes sure that a read which waits for a piece which will
+// never be written returns
+func TestReaderStops(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(m *Manager, r *Reader)
+		err  error
+	}{
+		{
+			name: "skipped",
+			stop: func(m *Manager, r *Reader) {
+				m.torrent.SetPriorities(map[int]torrent.Priority{1: torrent.PrioritySkip})
+			},
+		},
+		{
+			name: "closed",
+			stop: func(m *Manager, r *Reader) {
+				r.Close()
+			},
+			err: os.ErrClosed,
+		},
+		{
+			name: "stopped",
+			stop: func(m *Manager, r *Reader) {
+				close(m.done)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, _ := newFilesTorrent(t)
+			m := NewManager(tr, t.TempDir())
+
+			r, err := m.OpenFile(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer r.Close()
+
+			// The second piece of b isn't shared with another file
+			if _, err := r.Seek(pieceLength, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+
+			read := make(chan error)
+			go func() {
+				_, err := r.Read(make([]byte, 10))
+				read <- err
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			test.stop(m, r)
+
+			select {
+			case err := <-read:
+				if err == nil {
+					t.Fatal("expected the read to fail")
+				}
+
+				if test.err != nil && !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the read is still waiting")
+			}
+
+			// Reads of the piece keep failing
+			if _, err := r.Read(make([]byte, 10)); err == nil {
+				t.Fatal("expected the read to fail")
+			}
+		})
+	}
+}
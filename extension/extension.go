@@ -1,19 +1,31 @@
 package extension
 
 import (
+	"bytes"
 	"trumtorrent/bencode"
 )
 
 // m represents the different extension ids used by the current connection,
-// however; we currently only care about the metadata ID
+// however; we currently only care about the metadata and peer exchange IDs
 type m struct {
-	Metadata int `bencode:"ut_metadata"`
+	Metadata int `bencode:"ut_metadata,omitempty"`
+	PEX      int `bencode:"ut_pex,omitempty"`
 }
 
+// These are the extension IDs we use for our own connections, i.e. the IDs
+// peers should send their extension messages with
+const (
+	LocalMetadataId MessageId = 1
+	LocalPEXId      MessageId = 2
+)
+
 // Handshake represents the extension handshake between a client and peer
 type Handshake struct {
 	Ids          m   `bencode:"m"`
-	MetadataSize int `bencode:"metadata_size"`
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+	// Reqq is the number of outstanding requests the peer allows, requests
+	// beyond it might be dropped
+	Reqq int `bencode:"reqq,omitempty"`
 }
 
 // SupportsMetadataExtension returns true if the `ut_metadata` field is set
@@ -26,9 +38,31 @@ func (hs Handshake) MetadataMessageId() int {
 	return hs.Ids.Metadata
 }
 
+// SupportsPEX returns true if the `ut_pex` field is set
+func (hs Handshake) SupportsPEX() bool {
+	return hs.Ids.PEX > 0
+}
+
+// Bytes bencodes the handshake
+func (hs Handshake) Bytes() ([]byte, error) {
+	return bencode.Marshal(hs)
+}
+
+// NewLocalHandshake creates our own extension handshake, peer exchange is only
+// advertised if `pex` is set (it must never be for private torrents)
+func NewLocalHandshake(pex bool) Handshake {
+	hs := Handshake{Ids: m{Metadata: int(LocalMetadataId)}}
+
+	if pex {
+		hs.Ids.PEX = int(LocalPEXId)
+	}
+
+	return hs
+}
+
 func NewHandshake(data []byte) (Handshake, error) {
 	hs := Handshake{}
-	if err := bencode.Unmarshal(data, &hs); err != nil {
+	if err := bencode.Unmarshal(data, &hs, bencode.NetworkLimits()); err != nil {
 		return Handshake{}, err
 	}
 
@@ -52,26 +86,42 @@ const (
 
 // Message represents the extension protocol message
 type Message struct {
-	Id        MessageId
-	Type      int `bencode:"msg_type"`
-	Piece     int `bencode:"piece"`
-	TotalSize int `bencode:"total_size"`
-	Metadata  []byte
+	Id        MessageId `bencode:"-"`
+	Type      int       `bencode:"msg_type,required"`
+	Piece     int       `bencode:"piece,required"`
+	TotalSize int       `bencode:"total_size,omitempty"`
+	Metadata  []byte    `bencode:"-"`
 }
 
 func NewMessage(id MessageId, data []byte) (Message, error) {
 	msg := Message{}
-	if err := bencode.Unmarshal(data, &msg); err != nil {
+	d := bencode.NewDecoder(bytes.NewReader(data), bencode.NetworkLimits())
+	if err := d.Decode(&msg); err != nil {
 		return Message{}, err
 	}
 
-	_, rest, err := bencode.Decode(data)
-	if err != nil {
-		return Message{}, err
-	}
+	// The metadata (if any) follows directly after the bencoded dictionary
+	rest := data[d.InputOffset():]
 
 	msg.Id = id
 	msg.Metadata = make([]byte, len(rest))
 	copy(msg.Metadata, rest)
 	return msg, nil
 }
+
+// PEX represents a peer exchange message (see BEP 11), the peers are in the
+// compact format
+type PEX struct {
+	Added   []byte `bencode:"added,omitempty"`
+	Added6  []byte `bencode:"added6,omitempty"`
+	Dropped []byte `bencode:"dropped,omitempty"`
+}
+
+func NewPEX(data []byte) (PEX, error) {
+	msg := PEX{}
+	if err := bencode.Unmarshal(data, &msg, bencode.NetworkLimits()); err != nil {
+		return PEX{}, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"trumtorrent/torrent"
+)
+
+// formatSize formats a number of bytes using binary prefixes (e.g. 1.5 MiB)
+func formatSize(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// infoFiles returns the path and length of each file of the torrent, padding
+// files are left out
+func infoFiles(i torrent.Info) ([]string, []int64) {
+	var (
+		paths   []string
+		lengths []int64
+	)
+
+	switch {
+	case len(i.Files) > 0:
+		for _, file := range i.Files {
+			if file.Attr.IsPadding() {
+				continue
+			}
+
+			paths = append(paths, strings.Join(file.Path, "/"))
+			lengths = append(lengths, file.Length)
+		}
+	case i.Length > 0:
+		paths = append(paths, i.Name)
+		lengths = append(lengths, i.Length)
+	default:
+		for _, file := range i.FileTree.Files() {
+			paths = append(paths, strings.Join(file.Path, "/"))
+			lengths = append(lengths, file.Length)
+		}
+	}
+
+	return paths, lengths
+}
+
+// info implements the `info` subcommand, which prints the contents of a
+// .torrent file and any problems found when validating it
+func info(args []string) error {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: trumtorrent info <torrent file>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("info: expected exactly one torrent file")
+	}
+
+	var verr *torrent.ValidationError
+
+	metainfo, err := torrent.Load(flags.Arg(0))
+	if errors.As(err, &verr) {
+		return printProblems(verr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	i := metainfo.Info
+
+	hash, hashV2, err := i.Hashes()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:         %s\n", i.Name)
+
+	if i.IsV1() {
+		fmt.Printf("Info hash:    %x\n", hash)
+	}
+
+	if hashV2 != nil {
+		fmt.Printf("Info hash v2: %x\n", hashV2)
+	}
+
+	fmt.Printf("Piece length: %s\n", formatSize(int64(i.PieceLength)))
+	fmt.Printf("Private:      %t\n", i.Private == 1)
+
+	if metainfo.Comment != "" {
+		fmt.Printf("Comment:      %s\n", metainfo.Comment)
+	}
+
+	if metainfo.CreatedBy != "" {
+		fmt.Printf("Created by:   %s\n", metainfo.CreatedBy)
+	}
+
+	paths, lengths := infoFiles(i)
+
+	var total int64
+	for _, length := range lengths {
+		total += length
+	}
+
+	fmt.Printf("Size:         %s (%d bytes)\n", formatSize(total), total)
+	fmt.Printf("\nFiles (%d):\n", len(paths))
+
+	for n, path := range paths {
+		fmt.Printf("  %10s  %s\n", formatSize(lengths[n]), path)
+	}
+
+	tiers := (&torrent.Torrent{MetaInfo: *metainfo}).Tiers()
+	if len(tiers) > 0 {
+		fmt.Println("\nTrackers:")
+
+		for n, tier := range tiers {
+			for _, tracker := range tier {
+				fmt.Printf("  %d  %s\n", n+1, tracker)
+			}
+		}
+	}
+
+	if err := torrent.Validate(metainfo); errors.As(err, &verr) {
+		return printProblems(verr)
+	}
+
+	return nil
+}
+
+// printProblems prints the problems found when loading or validating a torrent
+func printProblems(verr *torrent.ValidationError) error {
+	fmt.Println("\nProblems:")
+
+	for _, problem := range verr.Problems {
+		fmt.Printf("  %s\n", problem)
+	}
+
+	return errors.New("info: the torrent is invalid")
+}
@@ -1,28 +1,101 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	_ "time"
 	"trumtorrent/download"
+	"trumtorrent/picker"
 	"trumtorrent/torrent"
 )
 
 // TODO: write more tests
 // TODO: write the download.Writer
-// TODO: add support for setting a custom output path
+
+// patterns is a flag which can be given multiple times, each one adds a glob
+// pattern
+type patterns []string
+
+func (p *patterns) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
 
 func main() {
 	// path := "starwars.torrent"
 	// path := "magnet:?xt=urn:btih:dd02dc8713ca6edfc7dd21d0bf5da58834559a7c&dn=bilder&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337&tr=udp%3A%2F%2Fexplodie.org%3A6969&tr=udp%3A%2F%2Ftracker.empire-js.us%3A1337&tr=wss%3A%2F%2Ftracker.btorrent.xyz&tr=wss%3A%2F%2Ftracker.openwebtorrent.com"
-	path := os.Args[1]
+	if len(os.Args) < 2 {
+		fmt.Println("usage: trumtorrent [-o directory] [-sequential] [-only pattern]... [-exclude pattern]... <torrent file or magnet link>")
+		fmt.Println("       trumtorrent create [flags] <file or directory>")
+		fmt.Println("       trumtorrent info <torrent file>")
+		os.Exit(1)
+	}
+
+	if os.Args[1] == "create" {
+		if err := create(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if os.Args[1] == "info" {
+		if err := info(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
 
-	t, err := torrent.Open(path)
+	var (
+		flags      = flag.NewFlagSet("trumtorrent", flag.ExitOnError)
+		output     = flags.String("o", ".", "directory to download into")
+		sequential = flags.Bool("sequential", false, "download pieces in order")
+		only       patterns
+		exclude    patterns
+	)
+
+	flags.Var(&only, "only", "only download files matching the glob pattern (repeatable)")
+	flags.Var(&exclude, "exclude", "skip files matching the glob pattern (repeatable)")
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() != 1 {
+		fmt.Println("usage: trumtorrent [-o directory] [-sequential] [-only pattern]... [-exclude pattern]... <torrent file or magnet link>")
+		os.Exit(1)
+	}
+
+	t, err := torrent.Open(flags.Arg(0))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	manager := download.NewManager(t)
-	manager.Download()
+	if err := t.SelectFiles(only, exclude); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// NOTE: files of magnet links are unknown until we've got the metadata
+	if !t.MetaInfo.Incomplete() && t.WantedLength() == 0 {
+		fmt.Println("no files selected for download")
+		os.Exit(1)
+	}
+
+	manager := download.NewManager(t, *output)
+
+	if *sequential {
+		manager.SetMode(picker.Sequential)
+	}
+
+	if err := manager.Download(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
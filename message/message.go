@@ -37,9 +37,9 @@ type Message struct {
 
 // Bytes returns the serialized message as bytes
 func (m *Message) Bytes() []byte {
-	// keep-alive
+	// keep-alive (i.e. only a length of zero)
 	if m == nil {
-		return []byte{}
+		return make([]byte, 4)
 	}
 
 	// length + id is 5 bytes
@@ -125,6 +125,14 @@ func ParseExtensionMessage(m *Message) (extension.Message, error) {
 	return extension.NewMessage(id, m.Payload[1:])
 }
 
+func ParsePEX(m *Message) (extension.PEX, error) {
+	if !Is(m, extension.PEX{}) {
+		return extension.PEX{}, errors.New("message: message is not a peer exchange message")
+	}
+
+	return extension.NewPEX(m.Payload[1:])
+}
+
 func NewRequest(index, begin, length int) *Message {
 	buf := make([]byte, 12)
 	binary.BigEndian.PutUint32(buf[0:4], uint32(index))
@@ -133,6 +141,14 @@ func NewRequest(index, begin, length int) *Message {
 	return &Message{Id: Request, Payload: buf}
 }
 
+func NewCancel(index, begin, length int) *Message {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(index))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(length))
+	return &Message{Id: Cancel, Payload: buf}
+}
+
 func NewInterested() *Message {
 	return &Message{Id: Interested}
 }
@@ -141,8 +157,10 @@ func NewUnchoke() *Message {
 	return &Message{Id: Unchoke}
 }
 
-func NewExtensionHandshake() *Message {
-	return &Message{Id: Extended}
+func NewExtensionHandshake(payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	copy(buf[1:], payload)
+	return &Message{Id: Extended, Payload: buf}
 }
 
 func NewMetadataRequest(id int, piece int) *Message {
@@ -162,6 +180,14 @@ func isExtensionHandshake(m *Message) bool {
 	return extension.MessageId(m.Payload[0]) == 0
 }
 
+func isPEXMessage(m *Message) bool {
+	if !Is(m, Extended) || len(m.Payload) == 0 {
+		return false
+	}
+
+	return extension.MessageId(m.Payload[0]) == extension.LocalPEXId
+}
+
 func isExtensionMessagePiece(m *Message, piece int) bool {
 	msg, err := ParseExtensionMessage(m)
 	if err != nil {
@@ -180,6 +206,8 @@ func Is(msg *Message, id any) bool {
 		return isExtensionHandshake(msg)
 	case extension.Piece:
 		return isExtensionMessagePiece(msg, id.(int))
+	case extension.PEX:
+		return isPEXMessage(msg)
 	default:
 		return false
 	}
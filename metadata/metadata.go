@@ -2,11 +2,17 @@ package metadata
 
 import (
 	"math"
-	_ "trumtorrent/bencode"
 	"trumtorrent/bitfield"
 	"trumtorrent/extension"
 )
 
+// PieceSize is the size of each metadata piece (except for the last one)
+const PieceSize = 16384
+
+// MaxSize is the largest metadata size we accept from a peer, anything larger
+// is most likely an attempt to make us allocate lots of memory
+const MaxSize = 16 << 20
+
 // Metadata is used to store the downloaded MetaInfo data (which is needed when
 // downloading a torrent via a magnet link)
 type Metadata struct {
@@ -14,12 +20,28 @@ type Metadata struct {
 	written  int
 	received bitfield.Bitfield
 	Pieces   chan int
-	Wait     chan struct{}
+	// Wait is closed once the metadata has been received, or once it has
+	// failed (see `Err`)
+	Wait chan struct{}
+	// Err is set if the metadata can't be used, even though it matches the
+	// info hash
+	Err error
 }
 
 func (m *Metadata) Receive(msg extension.Message) {
-	offset := msg.Piece * 16384
-	m.written += copy(m.Data[offset:], msg.Metadata)
+	offset := msg.Piece * PieceSize
+
+	// Ignore invalid (or duplicate) pieces
+	if offset < 0 || offset >= len(m.Data) || m.received.HasPiece(msg.Piece) {
+		return
+	}
+
+	data := msg.Metadata
+	if len(data) > PieceSize {
+		data = data[:PieceSize]
+	}
+
+	m.written += copy(m.Data[offset:], data)
 	m.received.SetPiece(msg.Piece)
 }
 
@@ -31,20 +53,47 @@ func (m *Metadata) Complete() bool {
 	return m.written == len(m.Data)
 }
 
-func New(size int) *Metadata {
-	n := int(math.Ceil(float64(size) / 16384))
-	pieces := make(chan int, n)
+// Reset drops the received pieces, so that they're requested again (e.g. once
+// the metadata turned out not to match the info hash)
+func (m *Metadata) Reset() {
+	// NOTE: pieces which are still queued would otherwise be queued twice
+	for drained := false; !drained; {
+		select {
+		case <-m.Pieces:
+		default:
+			drained = true
+		}
+	}
 
-	for piece := 0; piece < n; piece++ {
-		pieces <- piece
+	for piece := 0; piece < cap(m.Pieces); piece++ {
+		m.Pieces <- piece
 	}
 
+	for i := range m.received {
+		m.received[i] = 0
+	}
+
+	m.written = 0
+}
+
+// Fail stops the download of the metadata, clients which wait for it are
+// given `err`
+func (m *Metadata) Fail(err error) {
+	m.Err = err
+	close(m.Wait)
+}
+
+func New(size int) *Metadata {
+	n := int(math.Ceil(float64(size) / PieceSize))
 	bs := int(math.Ceil(float64(n) / 8))
 
-	return &Metadata{
-		Data:     make([]byte, n),
+	m := &Metadata{
+		Data:     make([]byte, size),
 		received: make([]byte, bs),
 		Wait:     make(chan struct{}),
-		Pieces:   pieces,
+		Pieces:   make(chan int, n),
 	}
+
+	m.Reset()
+	return m
 }
@@ -1,8 +1,11 @@
 package peer
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
 	"strconv"
+	"trumtorrent/bencode"
 	"trumtorrent/bitfield"
 	"trumtorrent/extension"
 	"trumtorrent/handshake"
@@ -18,18 +21,137 @@ func (a Addr) String() string {
 	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
 }
 
+// CompactAddrs is a list of peer addresses, bencoded in the compact format
+// (i.e. as one string with 4 bytes of IP and 2 bytes of port per peer)
+type CompactAddrs []Addr
+
+// UnmarshalBencode decodes either the compact format or a list of
+// dictionaries with the keys `ip` and `port`
+func (a *CompactAddrs) UnmarshalBencode(data []byte) error {
+	if len(data) > 0 && data[0] == 'l' {
+		var peers []struct {
+			IP   string `bencode:"ip,required"`
+			Port uint16 `bencode:"port,required"`
+		}
+
+		if err := bencode.Unmarshal(data, &peers); err != nil {
+			return err
+		}
+
+		addrs := make(CompactAddrs, 0, len(peers))
+		for _, p := range peers {
+			ip := net.ParseIP(p.IP)
+			if ip == nil {
+				return errors.New("peer: invalid IP address")
+			}
+
+			addrs = append(addrs, Addr{IP: ip, Port: p.Port})
+		}
+
+		*a = addrs
+		return nil
+	}
+
+	var compact []byte
+	if err := bencode.Unmarshal(data, &compact); err != nil {
+		return err
+	}
+
+	addrs, err := ParseCompactAddrs(compact)
+	if err != nil {
+		return err
+	}
+
+	*a = addrs
+	return nil
+}
+
+// MarshalBencode encodes the (IPv4) addresses in the compact format
+func (a CompactAddrs) MarshalBencode() ([]byte, error) {
+	buf := make([]byte, 0, len(a)*6)
+
+	for _, addr := range a {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return nil, errors.New("peer: only IPv4 addresses can be compact")
+		}
+
+		buf = append(buf, ip...)
+		buf = append(buf, byte(addr.Port>>8), byte(addr.Port))
+	}
+
+	return bencode.Marshal(buf)
+}
+
+// ParseCompactAddrs parses peer addresses in the compact format
+func ParseCompactAddrs(data []byte) (CompactAddrs, error) {
+	if len(data)%6 != 0 {
+		return nil, errors.New("peer: invalid compact peers length")
+	}
+
+	addrs := make(CompactAddrs, len(data)/6)
+
+	for i := range addrs {
+		offset := i * 6
+		ip := make(net.IP, 4)
+		copy(ip, data[offset:offset+4])
+		port := binary.BigEndian.Uint16(data[offset+4 : offset+6])
+		addrs[i] = Addr{IP: ip, Port: port}
+	}
+
+	return addrs, nil
+}
+
+// Source is where a peer was found
+type Source int
+
+const (
+	SourceUnknown Source = iota
+	SourceTracker
+	// SourceMagnet is a peer given by a magnet link (i.e. `x.pe`)
+	SourceMagnet
+	// SourcePEX is a peer given by another peer (see BEP 11)
+	SourcePEX
+	SourceDHT
+	SourceLocal
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceMagnet:
+		return "magnet"
+	case SourcePEX:
+		return "pex"
+	case SourceDHT:
+		return "dht"
+	case SourceLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
 // Peer is used in order to store information related to a Peer connection
 type Peer struct {
 	handshake handshake.Handshake
 	bitfield  bitfield.Bitfield
 	Addr      Addr
 	extension extension.Handshake
+	// Source is where the peer was found
+	Source Source
 }
 
 func (p Peer) HasBitfield() bool {
 	return len(p.bitfield) > 0
 }
 
+// Bitfield returns the pieces which the peer has
+func (p Peer) Bitfield() bitfield.Bitfield {
+	return p.bitfield
+}
+
 func (p *Peer) SetBitfield(data []byte) {
 	p.bitfield = data
 }
@@ -66,10 +188,26 @@ func (p Peer) MetadataSize() int {
 	return p.extension.MetadataSize
 }
 
+// RequestQueueSize returns the number of outstanding requests the peer allows
+// (i.e. `reqq`), it's zero if the peer hasn't told us
+func (p Peer) RequestQueueSize() int {
+	return p.extension.Reqq
+}
+
 func (p Peer) String() string {
 	return p.Addr.String()
 }
 
-func New(ip []byte, port uint16) *Peer {
-	return &Peer{Addr: Addr{IP: net.IP(ip), Port: port}}
+// Peers creates a new Peer (found by `source`) for each of the addresses
+func (a CompactAddrs) Peers(source Source) []*Peer {
+	peers := make([]*Peer, len(a))
+	for i, addr := range a {
+		peers[i] = &Peer{Addr: addr, Source: source}
+	}
+
+	return peers
+}
+
+func New(ip []byte, port uint16, source Source) *Peer {
+	return &Peer{Addr: Addr{IP: net.IP(ip), Port: port}, Source: source}
 }
@@ -0,0 +1,665 @@
+package picker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"trumtorrent/bitfield"
+	"trumtorrent/piece"
+)
+
+// Mode decides the order in which pieces (of the same priority) are picked
+type Mode int
+
+const (
+	// RarestFirst picks the pieces which the fewest peers have, ties are
+	// broken at random
+	RarestFirst Mode = iota
+	// Sequential picks pieces in ascending order
+	Sequential
+	// Streaming picks the pieces within a window ahead of a read cursor (see
+	// `SetCursor`) first, and then pieces in ascending order
+	Streaming
+)
+
+// DefaultWindow is the number of pieces ahead of the cursor which are picked
+// first when streaming
+const DefaultWindow = 8
+
+// RandomFirstPieces is the number of pieces which are picked at random (rather
+// than rarest first), since we want a few complete pieces as soon as possible
+// in order to have something to share
+const RandomFirstPieces = 4
+
+type state int
+
+const (
+	pending state = iota
+	inFlight
+	// downloaded means that all blocks of the piece have been received, but
+	// it's not yet verified or written
+	downloaded
+	done
+)
+
+// Request is a block of a piece which is requested from a peer
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// blocks holds the state of the blocks of a piece which is in flight
+type blocks struct {
+	// requests holds the number of peers each block is requested from, which
+	// is more than one in endgame
+	requests []int
+	received []bool
+	missing  int
+}
+
+// free returns the first block which hasn't been requested (nor received), or
+// -1 if there's none
+func (b *blocks) free() int {
+	for n := range b.requests {
+		if b.requests[n] == 0 && !b.received[n] {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// Picker decides which blocks a client should download next, it's safe to use
+// from multiple goroutines
+type Picker struct {
+	mu sync.Mutex
+	// order holds the wanted pieces in the order they're picked (for the
+	// current mode), higher priorities first
+	order  []*piece.Piece
+	pieces map[int]*piece.Piece
+	states map[int]state
+	// blocks holds the blocks of the pieces in flight
+	blocks map[int]*blocks
+	// waiting holds the channels of `Wait`, which are closed once a piece is
+	// done (or is no longer wanted)
+	waiting map[int]chan struct{}
+	// availability holds the number of peers which have each piece
+	availability []int
+	// completed is the number of pieces which are done
+	completed int
+	// writtenTo holds the destinations which have been written of each piece
+	// which is done
+	writtenTo map[int][]piece.Destination
+	// written is the number of bytes written of the wanted pieces which are
+	// done, and wanted is the number of bytes of all wanted pieces
+	written int64
+	wanted  int64
+	// scheduled is true once the pieces have been given (see `Reset`), i.e.
+	// once we've got the metadata
+	scheduled bool
+	mode      Mode
+	cursor    int
+	window    int
+}
+
+// sort orders the pieces by priority and then by the mode
+func (p *Picker) sort() {
+	// NOTE: the random order is what breaks ties between pieces which are
+	// 		 equally rare
+	if p.mode == RarestFirst {
+		rand.Shuffle(len(p.order), func(i, j int) {
+			p.order[i], p.order[j] = p.order[j], p.order[i]
+		})
+	} else {
+		sort.Slice(p.order, func(i, j int) bool {
+			return p.order[i].Index < p.order[j].Index
+		})
+	}
+
+	sort.SliceStable(p.order, func(i, j int) bool {
+		return p.order[i].Priority > p.order[j].Priority
+	})
+}
+
+// containsAll returns true if all destinations of `dsts` are within `written`
+func containsAll(written, dsts []piece.Destination) bool {
+	for _, dst := range dsts {
+		found := false
+
+		for _, w := range written {
+			if w == dst {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reset replaces the pieces to pick from, e.g. once we've got the metadata or
+// when the priorities of files change. Pieces which are in flight or done keep
+// their state (and pieces in flight keep their data), unless a piece which is
+// done has destinations which haven't been written (e.g. a file which was
+// skipped is now wanted).
+func (p *Picker) Reset(pieces []*piece.Piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.pieces
+	p.order = make([]*piece.Piece, len(pieces))
+	p.pieces = make(map[int]*piece.Piece, len(pieces))
+	p.written, p.wanted = 0, 0
+	p.scheduled = true
+
+	for i, pc := range pieces {
+		if old, ok := previous[pc.Index]; ok && p.states[pc.Index] == inFlight {
+			old.Destinations, old.Priority = pc.Destinations, pc.Priority
+			pc = old
+		}
+
+		p.order[i] = pc
+		p.pieces[pc.Index] = pc
+
+		if p.states[pc.Index] == done && !containsAll(p.writtenTo[pc.Index], pc.Destinations) {
+			p.states[pc.Index] = pending
+			p.completed--
+			delete(p.writtenTo, pc.Index)
+		}
+
+		if _, ok := p.states[pc.Index]; !ok {
+			p.states[pc.Index] = pending
+		}
+
+		if p.states[pc.Index] == done {
+			p.written += int64(pc.WrittenLength())
+		}
+
+		p.wanted += int64(pc.WrittenLength())
+	}
+
+	// NOTE: blocks of pieces which are no longer wanted are dropped, the
+	// 		 pieces are downloaded from scratch if they're wanted again
+	for index := range p.blocks {
+		if _, ok := p.pieces[index]; !ok {
+			delete(p.blocks, index)
+			p.states[index] = pending
+		}
+	}
+
+	for index, wait := range p.waiting {
+		if _, ok := p.pieces[index]; !ok {
+			close(wait)
+			delete(p.waiting, index)
+		}
+	}
+
+	p.sort()
+}
+
+// SetMode changes the order in which pieces are picked
+func (p *Picker) SetMode(mode Mode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.mode = mode
+	p.sort()
+}
+
+// SetWindow changes the number of pieces ahead of the cursor which are picked
+// first when streaming
+func (p *Picker) SetWindow(window int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.window = window
+}
+
+// SetCursor moves the read cursor (a piece index) when streaming
+func (p *Picker) SetCursor(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cursor = index
+}
+
+// updateAvailability adds `delta` to the availability of each piece of `b`
+func (p *Picker) updateAvailability(b bitfield.Bitfield, delta int) {
+	for index := 0; index < len(b)*8; index++ {
+		if b.HasPiece(index) {
+			p.updateAvailabilityOf(index, delta)
+		}
+	}
+}
+
+func (p *Picker) updateAvailabilityOf(index int, delta int) {
+	for index >= len(p.availability) {
+		p.availability = append(p.availability, 0)
+	}
+
+	p.availability[index] += delta
+}
+
+// AddBitfield counts the pieces of a peer, i.e. once we've got its bitfield
+func (p *Picker) AddBitfield(b bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.updateAvailability(b, 1)
+}
+
+// RemoveBitfield stops counting the pieces of a peer, e.g. once it disconnects
+func (p *Picker) RemoveBitfield(b bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.updateAvailability(b, -1)
+}
+
+// Have counts a piece which a peer got (i.e. from a HAVE message)
+func (p *Picker) Have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.updateAvailabilityOf(index, 1)
+}
+
+// Availability returns the number of peers which have the piece at `index`
+func (p *Picker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.availabilityOf(index)
+}
+
+func (p *Picker) availabilityOf(index int) int {
+	if index < 0 || index >= len(p.availability) {
+		return 0
+	}
+
+	return p.availability[index]
+}
+
+// rarest returns the rarest of the pieces with the highest priority, which is
+// the first one in the (random) order unless we're still warming up
+func (p *Picker) rarest(has func(int) bool) *piece.Piece {
+	var next *piece.Piece
+
+	for _, pc := range p.order {
+		// NOTE: the pieces are ordered by priority
+		if next != nil && pc.Priority < next.Priority {
+			break
+		}
+
+		if !p.available(pc.Index, has) {
+			continue
+		}
+
+		if p.completed < RandomFirstPieces {
+			return pc
+		}
+
+		if next == nil || p.availabilityOf(pc.Index) < p.availabilityOf(next.Index) {
+			next = pc
+		}
+	}
+
+	return next
+}
+
+// available returns true if a piece can be picked from a peer
+func (p *Picker) available(index int, has func(int) bool) bool {
+	_, wanted := p.pieces[index]
+	return wanted && p.states[index] == pending && has(index)
+}
+
+// urgent returns true if the piece at `index` is within the streaming window
+func (p *Picker) urgent(index int) bool {
+	return p.mode == Streaming && index >= p.cursor && index < p.cursor+p.window
+}
+
+// pick returns the next pending piece to download from a peer
+func (p *Picker) pick(has func(int) bool) *piece.Piece {
+	var next *piece.Piece
+
+	if p.mode == Streaming {
+		for index := p.cursor; index < p.cursor+p.window; index++ {
+			if p.available(index, has) {
+				next = p.pieces[index]
+				break
+			}
+		}
+	}
+
+	if next == nil && p.mode == RarestFirst {
+		next = p.rarest(has)
+	}
+
+	for i := 0; next == nil && i < len(p.order); i++ {
+		if p.available(p.order[i].Index, has) {
+			next = p.order[i]
+		}
+	}
+
+	return next
+}
+
+// partial returns the piece in flight (which the peer has) with a block that
+// hasn't been requested, pieces within the streaming window first
+func (p *Picker) partial(has func(int) bool) *piece.Piece {
+	var next *piece.Piece
+
+	for _, pc := range p.order {
+		b, ok := p.blocks[pc.Index]
+		if !ok || p.states[pc.Index] != inFlight || !has(pc.Index) || b.free() < 0 {
+			continue
+		}
+
+		if p.urgent(pc.Index) {
+			return pc
+		}
+
+		if next == nil {
+			next = pc
+		}
+	}
+
+	return next
+}
+
+// finishFirst returns true if the blocks of the piece in flight should be
+// requested before the blocks of the pending piece
+func (p *Picker) finishFirst(partial, pending *piece.Piece) bool {
+	switch {
+	case partial == nil:
+		return false
+	case pending == nil:
+		return true
+	case p.urgent(partial.Index) != p.urgent(pending.Index):
+		return p.urgent(partial.Index)
+	default:
+		return partial.Priority >= pending.Priority
+	}
+}
+
+// open puts a piece in flight
+func (p *Picker) open(pc *piece.Piece) {
+	// NOTE: We'll initialise the buffer here to save memory
+	if len(pc.Data) != pc.Length {
+		pc.Data = make([]byte, pc.Length)
+	}
+
+	count := pc.BlockCount()
+	p.states[pc.Index] = inFlight
+	p.blocks[pc.Index] = &blocks{
+		requests: make([]int, count),
+		received: make([]bool, count),
+		missing:  count,
+	}
+}
+
+// request requests the block `n` of a piece in flight
+func (p *Picker) request(pc *piece.Piece, n int) Request {
+	p.blocks[pc.Index].requests[n]++
+
+	begin := n * piece.BlockSize
+	return Request{Index: pc.Index, Begin: begin, Length: pc.BlockLength(begin)}
+}
+
+// endgame returns true once none of the wanted pieces are pending, i.e. what's
+// left is in flight (and might be stuck with slow peers)
+func (p *Picker) endgame() bool {
+	for _, pc := range p.order {
+		if p.states[pc.Index] == pending {
+			return false
+		}
+	}
+
+	return true
+}
+
+// duplicate returns the block which has been requested from the fewest (other)
+// peers but not yet received, i.e. the last blocks are requested from several
+// peers
+func (p *Picker) duplicate(has func(int) bool, requested func(Request) bool) (Request, bool) {
+	var (
+		next  Request
+		count = -1
+	)
+
+	for index, b := range p.blocks {
+		pc, ok := p.pieces[index]
+		if !ok || p.states[index] != inFlight || !has(index) {
+			continue
+		}
+
+		for n := range b.requests {
+			begin := n * piece.BlockSize
+			r := Request{Index: index, Begin: begin, Length: pc.BlockLength(begin)}
+
+			if b.received[n] || requested(r) {
+				continue
+			}
+
+			if count < 0 || b.requests[n] < count {
+				next, count = r, b.requests[n]
+			}
+		}
+	}
+
+	if count < 0 {
+		return Request{}, false
+	}
+
+	p.blocks[next.Index].requests[next.Begin/piece.BlockSize]++
+	return next, true
+}
+
+// Next returns the next block to request from a peer, which has the pieces for
+// which `has` returns true (and has been sent the requests for which
+// `requested` returns true). Blocks of pieces in flight are requested first, so
+// that several peers can download the same piece. In endgame (once nothing is
+// pending) it returns blocks which have been requested from other peers.
+// Nothing is returned if there's nothing left to download from the peer.
+func (p *Picker) Next(has func(int) bool, requested func(Request) bool) (Request, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	partial := p.partial(has)
+	next := p.pick(has)
+
+	if p.finishFirst(partial, next) {
+		return p.request(partial, p.blocks[partial.Index].free()), true
+	}
+
+	if next != nil {
+		p.open(next)
+		return p.request(next, 0), true
+	}
+
+	if p.endgame() {
+		return p.duplicate(has, requested)
+	}
+
+	return Request{}, false
+}
+
+// block returns the blocks of the piece in flight which `r` is a part of, and
+// the number of the block
+func (p *Picker) block(r Request) (*blocks, int, bool) {
+	b, ok := p.blocks[r.Index]
+	if !ok || p.states[r.Index] != inFlight || r.Begin < 0 || r.Begin%piece.BlockSize != 0 {
+		return nil, 0, false
+	}
+
+	n := r.Begin / piece.BlockSize
+	if n >= len(b.requests) || r.Length != p.pieces[r.Index].BlockLength(r.Begin) {
+		return nil, 0, false
+	}
+
+	return b, n, true
+}
+
+// Release puts back a block which won't be received from a peer (e.g. once it
+// chokes us or disconnects), so that it's requested from another peer
+func (p *Picker) Release(r Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if b, n, ok := p.block(r); ok && b.requests[n] > 0 {
+		b.requests[n]--
+	}
+}
+
+// Wanted returns false once a block has been received (e.g. from another peer
+// in endgame), or if its piece is no longer wanted
+func (p *Picker) Wanted(r Request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, n, ok := p.block(r)
+	return ok && !b.received[n]
+}
+
+// Receive stores a block of a piece in flight. It returns the piece once all of
+// its blocks have been received (i.e. it should be verified), and false if the
+// block isn't wanted (e.g. if it has already been received from another peer).
+func (p *Picker) Receive(block piece.Block) (*piece.Piece, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := Request{Index: int(block.Index), Begin: int(block.Begin), Length: len(block.Data)}
+
+	b, n, ok := p.block(r)
+	if !ok || b.received[n] {
+		return nil, false
+	}
+
+	pc := p.pieces[r.Index]
+	copy(pc.Data[r.Begin:], block.Data)
+
+	b.received[n] = true
+	b.missing--
+
+	if b.requests[n] > 0 {
+		b.requests[n]--
+	}
+
+	if b.missing > 0 {
+		return nil, true
+	}
+
+	p.states[r.Index] = downloaded
+	delete(p.blocks, r.Index)
+	return pc, true
+}
+
+// Requeue puts back a piece which failed to verify (or couldn't be written),
+// all of its blocks are downloaded again
+func (p *Picker) Requeue(pc *piece.Piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.states[pc.Index] == downloaded {
+		p.states[pc.Index] = pending
+	}
+}
+
+// Done marks a piece as downloaded, verified and written, its buffer is
+// released since the data is on disk. The piece is downloaded again if the
+// priorities changed while it was written, so that it has destinations which
+// haven't been written.
+func (p *Picker) Done(pc *piece.Piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.Reset()
+
+	if p.states[pc.Index] == done {
+		return
+	}
+
+	p.writtenTo[pc.Index] = append(p.writtenTo[pc.Index], pc.Destinations...)
+
+	if current, wanted := p.pieces[pc.Index]; wanted {
+		if !containsAll(p.writtenTo[pc.Index], current.Destinations) {
+			p.states[pc.Index] = pending
+			delete(p.writtenTo, pc.Index)
+			return
+		}
+
+		p.written += int64(current.WrittenLength())
+	}
+
+	p.completed++
+	p.states[pc.Index] = done
+
+	if wait, ok := p.waiting[pc.Index]; ok {
+		close(wait)
+		delete(p.waiting, pc.Index)
+	}
+}
+
+// Progress returns the number of bytes which have been written of the wanted
+// pieces, and the number of bytes of all wanted pieces. Both are recounted when
+// the priorities of files change.
+func (p *Picker) Progress() (written, wanted int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.written, p.wanted
+}
+
+// Scheduled returns true once the pieces have been given, before that nothing
+// is wanted since the pieces are unknown (e.g. of a magnet link)
+func (p *Picker) Scheduled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.scheduled
+}
+
+// Wait returns a channel which is closed once the piece at `index` is done, or
+// once it's no longer wanted (see `IsDone`)
+func (p *Picker) Wait(index int) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wait, ok := p.waiting[index]
+	if !ok {
+		wait = make(chan struct{})
+
+		if _, wanted := p.pieces[index]; !wanted || p.states[index] == done {
+			close(wait)
+			return wait
+		}
+
+		p.waiting[index] = wait
+	}
+
+	return wait
+}
+
+// IsDone returns true if the piece at `index` has been written
+func (p *Picker) IsDone(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.states[index] == done
+}
+
+func New() *Picker {
+	return &Picker{
+		pieces:    make(map[int]*piece.Piece),
+		states:    make(map[int]state),
+		blocks:    make(map[int]*blocks),
+		waiting:   make(map[int]chan struct{}),
+		writtenTo: make(map[int][]piece.Destination),
+		window:    DefaultWindow,
+	}
+}
@@ -0,0 +1,449 @@
+package picker
+
+import (
+	"testing"
+	"trumtorrent/bitfield"
+	"trumtorrent/piece"
+)
+
+// newPicker creates a sequential picker of `count` pieces of two blocks each
+func newPicker(count int) *Picker {
+	pieces := make([]*piece.Piece, count)
+	for i := range pieces {
+		pieces[i] = &piece.Piece{Index: i, Length: 2 * piece.BlockSize}
+	}
+
+	p := New()
+	p.SetMode(Sequential)
+	p.Reset(pieces)
+	return p
+}
+
+func hasAll(int) bool {
+	return true
+}
+
+// peer keeps track of the requests of one peer
+type peer map[Request]bool
+
+func (r peer) requested(req Request) bool {
+	return r[req]
+}
+
+// next requests the next block, it fails the test if there's none
+func (r peer) next(t *testing.T, p *Picker) Request {
+	t.Helper()
+
+	req, ok := p.Next(hasAll, r.requested)
+	if !ok {
+		t.Fatal("expected a block to request")
+	}
+
+	r[req] = true
+	return req
+}
+
+// receive receives a requested block
+func receive(p *Picker, r Request) (*piece.Piece, bool) {
+	return p.Receive(piece.Block{Index: uint32(r.Index), Begin: uint32(r.Begin), Data: make([]byte, r.Length)})
+}
+
+func TestPeersShareAPiece(t *testing.T) {
+	p := newPicker(2)
+	a, b := peer{}, peer{}
+
+	first := a.next(t, p)
+	second := b.next(t, p)
+
+	// The piece in flight is finished before the next piece is started
+	if first.Index != 0 || second.Index != 0 || first.Begin == second.Begin {
+		t.Fatalf("expected both blocks of the first piece, got %+v and %+v", first, second)
+	}
+
+	if pc, ok := receive(p, first); pc != nil || !ok {
+		t.Fatal("expected the piece to be incomplete")
+	}
+
+	pc, ok := receive(p, second)
+	if pc == nil || !ok || pc.Index != 0 {
+		t.Fatalf("expected the piece once all blocks are received, got %+v", pc)
+	}
+
+	if third := a.next(t, p); third.Index != 1 {
+		t.Fatalf("expected a block of the next piece, got %+v", third)
+	}
+}
+
+func TestLastBlockIsTruncated(t *testing.T) {
+	p := New()
+	p.Reset([]*piece.Piece{{Index: 0, Length: piece.BlockSize + 10}})
+
+	a := peer{}
+	a.next(t, p)
+
+	if r := a.next(t, p); r.Begin != piece.BlockSize || r.Length != 10 {
+		t.Fatalf("expected a truncated last block, got %+v", r)
+	}
+}
+
+func TestReleaseBlock(t *testing.T) {
+	p := newPicker(1)
+	a, b := peer{}, peer{}
+
+	first := a.next(t, p)
+	b.next(t, p)
+
+	// e.g. the peer choked us, so the block is requested from another peer
+	p.Release(first)
+
+	if r := b.next(t, p); r != first {
+		t.Fatalf("expected the released block, got %+v", r)
+	}
+}
+
+func TestEndgameDuplicates(t *testing.T) {
+	p := newPicker(1)
+	slow, fast := peer{}, peer{}
+
+	first := slow.next(t, p)
+	second := slow.next(t, p)
+
+	// Nothing is pending, so the blocks of the slow peer are requested from
+	// the fast peer as well
+	dup := fast.next(t, p)
+	if dup != first && dup != second {
+		t.Fatalf("expected a block of the slow peer, got %+v", dup)
+	}
+
+	other := fast.next(t, p)
+	if other == dup || (other != first && other != second) {
+		t.Fatalf("expected the other block of the slow peer, got %+v", other)
+	}
+
+	// Every block has been requested from the fast peer
+	if r, ok := p.Next(hasAll, fast.requested); ok {
+		t.Fatalf("expected no block, got %+v", r)
+	}
+
+	receive(p, dup)
+
+	if p.Wanted(dup) {
+		t.Fatal("expected a received block to no longer be wanted")
+	}
+
+	if pc, ok := receive(p, dup); pc != nil || ok {
+		t.Fatal("expected a duplicate block to be dropped")
+	}
+
+	if pc, _ := receive(p, other); pc == nil {
+		t.Fatal("expected the piece once all blocks are received")
+	}
+
+	if p.Wanted(first) || p.Wanted(second) {
+		t.Fatal("expected the blocks of a downloaded piece to not be wanted")
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	p := newPicker(1)
+	a := peer{}
+
+	receive(p, a.next(t, p))
+	pc, _ := receive(p, a.next(t, p))
+
+	// e.g. the piece couldn't be verified
+	pc.Reset()
+	p.Requeue(pc)
+
+	r, ok := p.Next(hasAll, peer{}.requested)
+	if !ok || r.Index != pc.Index || r.Begin != 0 {
+		t.Fatalf("expected the piece to be downloaded again, got %+v", r)
+	}
+
+	if len(pc.Data) != pc.Length {
+		t.Fatal("expected the piece to have a buffer")
+	}
+
+	p.Release(r)
+
+	// The released block is requested again
+	a = peer{}
+	receive(p, a.next(t, p))
+	pc, _ = receive(p, a.next(t, p))
+	p.Done(pc)
+
+	if r, ok := p.Next(hasAll, peer{}.requested); ok {
+		t.Fatalf("expected no block once everything is done, got %+v", r)
+	}
+}
+
+func TestDoneReleasesBuffer(t *testing.T) {
+	p := newPicker(1)
+	a := peer{}
+
+	receive(p, a.next(t, p))
+	pc, _ := receive(p, a.next(t, p))
+
+	if len(pc.Data) != pc.Length {
+		t.Fatal("expected the piece to have a buffer while it's downloaded")
+	}
+
+	p.Done(pc)
+
+	if pc.Data != nil {
+		t.Fatal("expected the buffer to be released once the piece is done")
+	}
+
+	if pc := p.pieces[0]; pc.Data != nil {
+		t.Fatal("expected the picker to not keep the buffer")
+	}
+}
+
+// newRarestPicker creates a rarest first picker of `count` pieces, `done` of
+// them are already done (i.e. it's warmed up if there's enough of them)
+func newRarestPicker(count, done int) *Picker {
+	pieces := make([]*piece.Piece, count)
+	for i := range pieces {
+		pieces[i] = &piece.Piece{Index: i, Length: 2 * piece.BlockSize}
+	}
+
+	p := New()
+	p.Reset(pieces)
+
+	for i := 0; i < done; i++ {
+		p.Done(pieces[i])
+	}
+
+	return p
+}
+
+// pickFrom returns the index of the piece which is picked from a peer having
+// the pieces of `has`
+func pickFrom(t *testing.T, p *Picker, has func(int) bool) int {
+	t.Helper()
+
+	r, ok := p.Next(has, peer{}.requested)
+	if !ok {
+		t.Fatal("expected a block to request")
+	}
+
+	return r.Index
+}
+
+func TestAvailability(t *testing.T) {
+	p := New()
+
+	// The peers have the pieces {0, 1} and {1, 9}
+	a := bitfield.Bitfield{0xc0, 0x00}
+	b := bitfield.Bitfield{0x40, 0x40}
+
+	p.AddBitfield(a)
+	p.AddBitfield(b)
+
+	// e.g. the first peer got piece 9 as well
+	p.Have(9)
+
+	for index, want := range map[int]int{0: 1, 1: 2, 2: 0, 9: 2, 100: 0} {
+		if got := p.Availability(index); got != want {
+			t.Errorf("expected piece %d to be available from %d peers, got %d", index, want, got)
+		}
+	}
+
+	// e.g. the second peer disconnected
+	p.RemoveBitfield(b)
+
+	for index, want := range map[int]int{0: 1, 1: 1, 9: 1} {
+		if got := p.Availability(index); got != want {
+			t.Errorf("expected piece %d to be available from %d peers once a peer is gone, got %d", index, want, got)
+		}
+	}
+}
+
+func TestRarestFirst(t *testing.T) {
+	p := newRarestPicker(8, RandomFirstPieces)
+
+	for index, count := range map[int]int{4: 3, 5: 2, 6: 4, 7: 1} {
+		for i := 0; i < count; i++ {
+			p.Have(index)
+		}
+	}
+
+	// The rarest piece (7) isn't one the peer has
+	has := func(index int) bool { return index != 7 }
+
+	if index := pickFrom(t, p, has); index != 5 {
+		t.Fatalf("expected the rarest piece which the peer has, got %d", index)
+	}
+
+	// The pieces in flight are finished first, then the next rarest
+	p.Next(has, peer{}.requested)
+
+	if index := pickFrom(t, p, has); index != 4 {
+		t.Fatalf("expected the next rarest piece, got %d", index)
+	}
+}
+
+func TestRarestFirstBreaksTiesRandomly(t *testing.T) {
+	picked := make(map[int]int)
+
+	for i := 0; i < 100; i++ {
+		p := newRarestPicker(8, RandomFirstPieces)
+
+		// Pieces 5 and 6 are equally rare
+		for index, count := range map[int]int{4: 2, 5: 1, 6: 1, 7: 2} {
+			for n := 0; n < count; n++ {
+				p.Have(index)
+			}
+		}
+
+		picked[pickFrom(t, p, hasAll)]++
+	}
+
+	if len(picked) != 2 || picked[5] == 0 || picked[6] == 0 {
+		t.Fatalf("expected both of the rarest pieces to be picked, got %v", picked)
+	}
+}
+
+func TestRandomFirstPieces(t *testing.T) {
+	picked := make(map[int]int)
+
+	for i := 0; i < 100; i++ {
+		p := newRarestPicker(8, RandomFirstPieces-1)
+
+		// The last piece is the rarest, but we're still warming up
+		for index := 0; index < 7; index++ {
+			p.Have(index)
+			p.Have(index)
+		}
+
+		p.Have(7)
+		picked[pickFrom(t, p, hasAll)]++
+	}
+
+	if picked[7] == 100 || len(picked) < 3 {
+		t.Fatalf("expected random pieces while warming up, got %v", picked)
+	}
+
+	for index := range picked {
+		if index < RandomFirstPieces-1 {
+			t.Fatalf("expected a piece which isn't done, got %d", index)
+		}
+	}
+}
+
+// download downloads (and writes) the next piece, it fails the test if there's
+// nothing to download
+func download(t *testing.T, p *Picker) *piece.Piece {
+	t.Helper()
+
+	a := peer{}
+
+	for {
+		pc, _ := receive(p, a.next(t, p))
+		if pc != nil {
+			p.Done(pc)
+			return pc
+		}
+	}
+}
+
+// TestWrittenIsRecounted makes sure that the written bytes only count the wanted
+// pieces, and that pieces which are done are downloaded again if they've got
+// destinations which haven't been written
+func TestWrittenIsRecounted(t *testing.T) {
+	// Each piece is shared by the files a and b
+	newPieces := func(a, b bool) []*piece.Piece {
+		var pieces []*piece.Piece
+
+		for i := 0; i < 2; i++ {
+			pc := &piece.Piece{Index: i, Length: 2 * piece.BlockSize}
+
+			if a {
+				pc.Destinations = append(pc.Destinations, piece.Destination{Path: "a", Offset: int64(i) * piece.BlockSize, Start: 0, End: piece.BlockSize})
+			}
+
+			if b {
+				pc.Destinations = append(pc.Destinations, piece.Destination{Path: "b", Offset: int64(i) * piece.BlockSize, Start: piece.BlockSize, End: 2 * piece.BlockSize})
+			}
+
+			pieces = append(pieces, pc)
+		}
+
+		return pieces
+	}
+
+	p := New()
+	p.SetMode(Sequential)
+	p.Reset(newPieces(true, false))
+
+	if _, wanted := p.Progress(); wanted != 2*piece.BlockSize {
+		t.Fatalf("expected two blocks to be wanted, got %d", wanted)
+	}
+
+	download(t, p)
+
+	if got, _ := p.Progress(); got != piece.BlockSize {
+		t.Fatalf("expected one block to be written, got %d", got)
+	}
+
+	// The first piece is done, so only the second is downloaded for file a
+	p.Reset(newPieces(true, false))
+
+	if r, _ := p.Next(hasAll, peer{}.requested); r.Index != 1 {
+		t.Fatalf("expected the second piece, got %+v", r)
+	}
+
+	// b is now wanted as well, which hasn't been written for the first piece
+	p.Reset(newPieces(true, true))
+
+	if got, _ := p.Progress(); got != 0 {
+		t.Fatalf("expected nothing to be written of the wanted pieces, got %d", got)
+	}
+
+	download(t, p)
+	download(t, p)
+
+	if got, _ := p.Progress(); got != 4*piece.BlockSize {
+		t.Fatalf("expected every block to be written, got %d", got)
+	}
+
+	// a is skipped, so the bytes written to it no longer count
+	p.Reset(newPieces(false, true))
+
+	if got, _ := p.Progress(); got != 2*piece.BlockSize {
+		t.Fatalf("expected the blocks of b to be written, got %d", got)
+	}
+
+	if r, ok := p.Next(hasAll, peer{}.requested); ok {
+		t.Fatalf("expected nothing to download, got %+v", r)
+	}
+}
+
+// TestDoneWithStaleDestinations makes sure that a piece which was written before
+// its file became wanted is downloaded again
+func TestDoneWithStaleDestinations(t *testing.T) {
+	dst := piece.Destination{Path: "a", Offset: 0, Start: 0, End: 2 * piece.BlockSize}
+
+	p := New()
+	p.Reset([]*piece.Piece{{Index: 0, Length: 2 * piece.BlockSize}})
+
+	a := peer{}
+	receive(p, a.next(t, p))
+	pc, _ := receive(p, a.next(t, p))
+
+	// The file of the piece became wanted while the piece was written
+	p.Reset([]*piece.Piece{{Index: 0, Length: 2 * piece.BlockSize, Destinations: []piece.Destination{dst}}})
+	p.Done(pc)
+
+	if got, _ := p.Progress(); got != 0 {
+		t.Fatalf("expected nothing to be written, got %d", got)
+	}
+
+	if pc := download(t, p); pc.Index != 0 {
+		t.Fatalf("expected the piece to be downloaded again, got %d", pc.Index)
+	}
+
+	if got, _ := p.Progress(); got != 2*piece.BlockSize {
+		t.Fatalf("expected the piece to be written, got %d", got)
+	}
+}
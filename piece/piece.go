@@ -2,20 +2,27 @@ package piece
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 )
 
 // Destination represents where data from a `Piece` should be written, since
 // some times data will be split across multiple files
 type Destination struct {
+	// Path is relative to the output directory (and slash separated)
 	Path   string
-	Offset int
+	Offset int64
 	Start  int
 	End    int
 }
 
+// BlockSize is the length of the blocks we request, the last block of a piece
+// might be shorter
+const BlockSize = 16384
+
 // Block represents one part of a `Piece`
 type Block struct {
 	Data  []byte
@@ -25,44 +32,75 @@ type Block struct {
 
 // Piece represents one (full) part of the torrent data
 type Piece struct {
-	Index          int
-	Length         int
-	Offset         int
-	Data           []byte
-	Received       int
-	Requested      int
-	QueuedRequests int
-	Destinations   []Destination
+	Index        int
+	Length       int
+	Offset       int64
+	Data         []byte
+	Destinations []Destination
+	// Priority is the highest priority of the files of the piece, pieces with
+	// higher priorities are downloaded first
+	Priority int
 }
 
-func (p Piece) Incomplete() bool {
-	return p.Received < p.Length
+// WrittenLength returns the number of bytes which are written to the
+// destinations of the piece (i.e. without padding or skipped files)
+func (p Piece) WrittenLength() int {
+	var length int
+	for _, dst := range p.Destinations {
+		length += dst.End - dst.Start
+	}
+
+	return length
 }
 
-// CanQueueRequest is used when we request the blocks of a piece, we queue up to
-// 5 requests at a time
-func (p Piece) CanQueueRequest() bool {
-	return p.Requested < p.Length && p.QueuedRequests < 5
+// BlockCount returns the number of blocks of the piece
+func (p Piece) BlockCount() int {
+	return (p.Length + BlockSize - 1) / BlockSize
+}
+
+// BlockLength returns the length of the block which starts at `begin`
+func (p Piece) BlockLength(begin int) int {
+	if begin+BlockSize > p.Length {
+		return p.Length - begin
+	}
+
+	return BlockSize
 }
 
 // Reset is used when something unexpected (e.g. an error) happens and we need
 // to put back the Piece in order for someone else (i.e. a Client) to take it
 func (p *Piece) Reset() {
-	p.Data = make([]byte, p.Length)
-	p.Received = 0
-	p.Requested = 0
-	p.QueuedRequests = 0
+	p.Data = nil
 }
 
-func (p Piece) Write() error {
+// resolve returns the path of a destination within `root`, the path is never
+// allowed to end up outside of `root`
+func resolve(root string, dst Destination) (string, error) {
+	name := filepath.Join(root, filepath.FromSlash(dst.Path))
+
+	rel, err := filepath.Rel(root, name)
+	if err != nil || filepath.IsAbs(dst.Path) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("piece: destination '%s' is outside of the output directory", dst.Path)
+	}
+
+	return name, nil
+}
+
+// Write writes the data of the piece to its destinations within `root`
+func (p Piece) Write(root string) error {
 	// TODO: This will most likely be moved, so we can do batch writes instead
 	for _, dst := range p.Destinations {
-		err := os.MkdirAll(path.Dir(dst.Path), 0750)
+		name, err := resolve(root, dst)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(filepath.Dir(name), 0750)
 		if err != nil && !errors.Is(err, fs.ErrExist) {
 			return err
 		}
 
-		f, err := os.OpenFile(dst.Path, os.O_CREATE|os.O_WRONLY, 0644)
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			return err
 		}
@@ -70,7 +108,7 @@ func (p Piece) Write() error {
 		defer f.Close()
 
 		data := p.Data[dst.Start:dst.End]
-		if _, err := f.WriteAt(data, int64(dst.Offset)); err != nil {
+		if _, err := f.WriteAt(data, dst.Offset); err != nil {
 			return err
 		}
 	}
@@ -9,23 +9,28 @@ import (
 )
 
 type Progress struct {
-	start      time.Time
-	torrent    *torrent.Torrent
-	downloaded int
-	percent    string
+	start   time.Time
+	torrent *torrent.Torrent
+	percent string
 }
 
 func (p *Progress) timeElapsed() time.Duration {
 	return time.Now().Sub(p.start)
 }
 
+// Complete returns true once all wanted bytes (i.e. of files which aren't
+// skipped) have been downloaded. The downloaded bytes are counted by the
+// picker, since the pieces which are wanted might change during the download.
+// Nothing is wanted until the pieces are known (i.e. we've got the metadata),
+// after that a download of nothing is complete right away.
 func (p *Progress) Complete() bool {
-	return p.torrent.Length() > 0 && p.torrent.Length() == p.downloaded
+	written, wanted := p.torrent.Picker.Progress()
+	return p.torrent.Picker.Scheduled() && written >= wanted
 }
 
 func (p *Progress) CalculateProgress(piece *piece.Piece) {
-	p.downloaded += piece.Length
-	percent := fmt.Sprintf("%.2f", float64(p.downloaded)/float64(p.torrent.Length())*100)
+	written, wanted := p.torrent.Picker.Progress()
+	percent := fmt.Sprintf("%.2f", float64(written)/float64(wanted)*100)
 
 	if percent != p.percent {
 		log.Printf("%v%% downloaded so far", percent)
@@ -0,0 +1,99 @@
+package progress
+
+import (
+	"strings"
+	"testing"
+	"trumtorrent/picker"
+	"trumtorrent/piece"
+	"trumtorrent/torrent"
+)
+
+// download downloads (and writes) every wanted piece of the torrent which `has`
+// returns true for
+func download(t *testing.T, tr *torrent.Torrent, p *Progress, has func(int) bool) {
+	t.Helper()
+
+	requested := func(picker.Request) bool { return false }
+
+	for {
+		r, ok := tr.Picker.Next(has, requested)
+		if !ok {
+			return
+		}
+
+		pc, _ := tr.Picker.Receive(piece.Block{Index: uint32(r.Index), Begin: uint32(r.Begin), Data: make([]byte, r.Length)})
+		if pc != nil {
+			tr.Picker.Done(pc)
+			p.CalculateProgress(pc)
+		}
+	}
+}
+
+// TestCompleteAfterPriorities makes sure that a download completes once the
+// priorities of files change during the download
+func TestCompleteAfterPriorities(t *testing.T) {
+	// a and b share the second piece
+	tr := &torrent.Torrent{
+		MetaInfo: torrent.MetaInfo{Info: torrent.Info{
+			Name:        "t",
+			PieceLength: piece.BlockSize,
+			Pieces:      strings.Repeat("\x00", 4*20),
+			Files: []torrent.InfoFile{
+				{Path: []string{"a"}, Length: piece.BlockSize + 10},
+				{Path: []string{"b"}, Length: 2*piece.BlockSize + 10},
+			},
+		}},
+		Picker: picker.New(),
+	}
+
+	tr.SetPriorities(nil)
+	tr.Picker.SetMode(picker.Sequential)
+	p := New(tr)
+
+	// Only the first two pieces are downloaded so far
+	download(t, tr, p, func(index int) bool { return index < 2 })
+
+	if p.Complete() {
+		t.Fatal("expected the download to be incomplete")
+	}
+
+	// b is no longer wanted, so the download is complete even though bytes
+	// of it have been downloaded
+	tr.SetPriorities(map[int]torrent.Priority{1: torrent.PrioritySkip})
+
+	if !p.Complete() {
+		t.Fatal("expected the download to be complete")
+	}
+
+	// b is wanted again, but only a is wanted now
+	tr.SetPriorities(map[int]torrent.Priority{0: torrent.PrioritySkip, 1: torrent.PriorityNormal})
+
+	if p.Complete() {
+		t.Fatal("expected the download to be incomplete")
+	}
+
+	// The shared piece has only been written to a, so it's downloaded again
+	download(t, tr, p, func(int) bool { return true })
+
+	if !p.Complete() {
+		t.Fatal("expected the download to be complete")
+	}
+}
+
+// TestCompleteWithoutPieces makes sure that a download is incomplete until the
+// pieces are known (e.g. of a magnet link), and complete right away if none of
+// them are wanted
+func TestCompleteWithoutPieces(t *testing.T) {
+	tr := &torrent.Torrent{Picker: picker.New()}
+	p := New(tr)
+
+	if p.Complete() {
+		t.Fatal("expected the download to be incomplete without the metadata")
+	}
+
+	tr.Picker.Reset(nil)
+
+	if !p.Complete() {
+		t.Fatal("expected the download of nothing to be complete")
+	}
+}
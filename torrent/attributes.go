@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Attributes are the attributes of a file (see BEP 47), each character is one
+// attribute
+type Attributes string
+
+// IsPadding returns true for padding files, which only exist in order to
+// align the following file to a piece boundary and are never written
+func (a Attributes) IsPadding() bool {
+	return strings.ContainsRune(string(a), 'p')
+}
+
+// IsSymlink returns true for symlinks, which have a `symlink path` and no data
+func (a Attributes) IsSymlink() bool {
+	return strings.ContainsRune(string(a), 'l')
+}
+
+func (a Attributes) IsExecutable() bool {
+	return strings.ContainsRune(string(a), 'x')
+}
+
+func (a Attributes) IsHidden() bool {
+	return strings.ContainsRune(string(a), 'h')
+}
+
+// createSymlink creates a (relative) symlink at `file.Path` to `file.Target`,
+// both are sanitised paths within `root`
+func createSymlink(root string, file LayoutFile) error {
+	if file.Target == "" {
+		return fmt.Errorf("torrent: symlink '%s' is missing its target", file.Path)
+	}
+
+	name := filepath.Join(root, filepath.FromSlash(file.Path))
+
+	target, err := filepath.Rel(filepath.Dir(filepath.FromSlash(file.Path)), filepath.FromSlash(file.Target))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	// NOTE: a symlink which already exists is left as is, anything else at
+	// 		 the path of the symlink is an error
+	if info, err := os.Lstat(name); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	return os.Symlink(target, name)
+}
+
+// ApplyAttributes creates the symlinks and sets the executable permissions of
+// the files within `root`, which is done once all pieces have been written.
+// Padding files are never written and hidden files are only hidden by their
+// names (i.e. a leading dot). Skipped files (see `SetPriorities`) are left
+// alone, and a failing file doesn't stop the others (the first error is
+// returned).
+func (t Torrent) ApplyAttributes(root string) error {
+	var (
+		files      = t.Layout().Files()
+		priorities = t.selectedPriorities(files)
+		firstErr   error
+	)
+
+	for i, file := range files {
+		if file.Attr.IsPadding() || priorities[i] == PrioritySkip {
+			continue
+		}
+
+		var err error
+
+		switch {
+		case file.Attr.IsSymlink():
+			err = createSymlink(root, file)
+		case file.Attr.IsExecutable():
+			err = makeExecutable(root, file)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// makeExecutable adds the executable permissions to a file within `root`
+func makeExecutable(root string, file LayoutFile) error {
+	name := filepath.Join(root, filepath.FromSlash(file.Path))
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(name, info.Mode().Perm()|0111)
+}
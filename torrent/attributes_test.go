@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes (empty) files within `root`, as if they've been downloaded
+func writeFiles(t *testing.T, root string, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		name = filepath.Join(root, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// withinRoot returns true if the symlink at `name` points to a path within
+// `root` (the target doesn't have to exist)
+func withinRoot(t *testing.T, root, name string) bool {
+	t.Helper()
+
+	target, err := os.Readlink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.IsAbs(target) {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(name), target))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func TestApplyAttributes(t *testing.T) {
+	tr := newFilesTorrent(16, []InfoFile{
+		{Path: []string{"bin", "run"}, Length: 4, Attr: "x"},
+		{Path: []string{"skipped.sh"}, Length: 4, Attr: "x"},
+		{Path: []string{"data"}, Length: 4},
+		{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"bin", "run"}},
+		{Path: []string{"bin", "up"}, Attr: "l", SymlinkPath: []string{"data"}},
+		{Path: []string{"skipped-link"}, Attr: "l", SymlinkPath: []string{"data"}},
+		{Path: []string{"escape"}, Attr: "l", SymlinkPath: []string{"..", "..", "etc", "passwd"}},
+	})
+
+	if err := tr.SelectFiles(nil, []string{"skipped*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+
+	// NOTE: skipped files are never written
+	writeFiles(t, root, "t/bin/run", "t/data")
+
+	if err := tr.ApplyAttributes(root); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "t", "bin", "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm()&0111 != 0111 {
+		t.Fatalf("expected the file to be executable, got %v", info.Mode())
+	}
+
+	if info, err := os.Stat(filepath.Join(root, "t", "data")); err != nil || info.Mode().Perm()&0111 != 0 {
+		t.Fatalf("expected the file to not be executable (%v)", err)
+	}
+
+	for _, name := range []string{"skipped.sh", "skipped-link"} {
+		if _, err := os.Lstat(filepath.Join(root, "t", name)); !os.IsNotExist(err) {
+			t.Fatalf("expected the skipped file '%s' to not be created, got %v", name, err)
+		}
+	}
+
+	links := map[string]string{"link": "bin/run", "bin/up": "data"}
+	for name, want := range links {
+		got, err := os.Readlink(filepath.Join(root, "t", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rel, _ := filepath.Rel(filepath.Join(root, "t"), filepath.Join(root, "t", filepath.Dir(name), got))
+		if filepath.ToSlash(rel) != want {
+			t.Errorf("expected '%s' to point to '%s', got '%s'", name, want, got)
+		}
+	}
+
+	// The target is sanitised, so the symlink points within the torrent
+	if !withinRoot(t, filepath.Join(root, "t"), filepath.Join(root, "t", "escape")) {
+		t.Fatal("expected the symlink to point within the root")
+	}
+
+	// Applying the attributes again is fine
+	if err := tr.ApplyAttributes(root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestApplyAttributesKeepsGoing makes sure that a failing file doesn't stop the
+// attributes of the other files from being applied
+func TestApplyAttributesKeepsGoing(t *testing.T) {
+	tr := newFilesTorrent(16, []InfoFile{
+		{Path: []string{"missing"}, Length: 4, Attr: "x"},
+		{Path: []string{"run"}, Length: 4, Attr: "x"},
+		{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"run"}},
+	})
+
+	root := t.TempDir()
+	writeFiles(t, root, "t/run")
+
+	if err := tr.ApplyAttributes(root); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the missing file to fail, got %v", err)
+	}
+
+	if info, err := os.Stat(filepath.Join(root, "t", "run")); err != nil || info.Mode().Perm()&0111 != 0111 {
+		t.Fatalf("expected the file to be executable, got %v", err)
+	}
+
+	if _, err := os.Readlink(filepath.Join(root, "t", "link")); err != nil {
+		t.Fatalf("expected the symlink to be created, got %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"trumtorrent/bencode"
+)
+
+// CreateOptions holds the optional settings of a created torrent
+type CreateOptions struct {
+	// AnnounceList is a list of tiers of trackers (see BEP 12), the first
+	// tracker is also used as the announce URL
+	AnnounceList [][]string
+	Comment      string
+	// CreatedBy defaults to "trumtorrent"
+	CreatedBy string
+	// CreationDate defaults to the current time
+	CreationDate time.Time
+	Private      bool
+	// PieceLength is picked based on the total size if it's zero
+	PieceLength int
+	// Workers is the number of pieces hashed in parallel, it defaults to the
+	// number of CPUs
+	Workers int
+}
+
+// createFile is a file found when walking the path of a torrent being created
+type createFile struct {
+	path   string
+	length int64
+}
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+)
+
+// pieceLengthFor picks a power of two piece length which results in roughly
+// 1500 pieces (within the bounds of 16 KiB and 16 MiB)
+func pieceLengthFor(size int64) int {
+	length := minPieceLength
+
+	for length < maxPieceLength && size/int64(length) > 1500 {
+		length *= 2
+	}
+
+	return length
+}
+
+// walkFiles returns all regular files within `root` in lexical order, other
+// kinds of files (e.g. symlinks) are skipped
+func walkFiles(root string) ([]createFile, error) {
+	var files []createFile
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createFile{path: path, length: info.Size()})
+		return nil
+	})
+
+	return files, err
+}
+
+// fileReader reads the files one after another (as if they were concatenated),
+// each file is only opened once
+type fileReader struct {
+	files []createFile
+	f     *os.File
+	// left is the number of bytes left to read of the current file
+	left int64
+}
+
+// readFull fills `buf` with the next bytes of the files
+func (r *fileReader) readFull(buf []byte) error {
+	for len(buf) > 0 {
+		if r.f == nil {
+			if len(r.files) == 0 {
+				return errors.New("torrent: files changed while hashing")
+			}
+
+			f, err := os.Open(r.files[0].path)
+			if err != nil {
+				return err
+			}
+
+			r.f, r.left = f, r.files[0].length
+		}
+
+		n := int64(len(buf))
+		if n > r.left {
+			n = r.left
+		}
+
+		if _, err := io.ReadFull(r.f, buf[:n]); err != nil {
+			return fmt.Errorf("torrent: unable to read '%s' (%w)", r.f.Name(), err)
+		}
+
+		buf = buf[n:]
+		r.left -= n
+
+		if r.left == 0 {
+			r.close()
+			r.files = r.files[1:]
+		}
+	}
+
+	return nil
+}
+
+// close closes the current file (if any)
+func (r *fileReader) close() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of all pieces. The files are
+// read in order (see `fileReader`), while the pieces are hashed in parallel by
+// `workers` goroutines.
+func hashPieces(files []createFile, length int64, pieceLength int, workers int) ([]byte, error) {
+	type job struct {
+		index int
+		data  []byte
+	}
+
+	var (
+		count  = int((length + int64(pieceLength) - 1) / int64(pieceLength))
+		hashes = make([]byte, count*20)
+		jobs   = make(chan job)
+		// free holds the buffers which aren't being hashed, there's one per
+		// worker
+		free = make(chan []byte, workers)
+		wg   sync.WaitGroup
+		err  error
+	)
+
+	for i := 0; i < workers; i++ {
+		free <- make([]byte, pieceLength)
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				hash := sha1.Sum(j.data)
+				copy(hashes[j.index*20:], hash[:])
+				free <- j.data[:cap(j.data)]
+			}
+		}()
+	}
+
+	r := &fileReader{files: files}
+	defer r.close()
+
+	for index := 0; index < count; index++ {
+		offset := int64(index) * int64(pieceLength)
+		data := <-free
+
+		// Last piece might be truncated
+		if offset+int64(pieceLength) > length {
+			data = data[:length-offset]
+		}
+
+		if err = r.readFull(data); err != nil {
+			break
+		}
+
+		jobs <- job{index: index, data: data}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// Create builds the MetaInfo of a new torrent from a file, or from all files
+// within a directory
+func Create(path string, opts CreateOptions) (*MetaInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: the name is taken from the absolute path, since e.g. "." has to
+	// 		 be named after the current directory
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(abs)
+	if !isSafePathComponent(name) {
+		return nil, fmt.Errorf("torrent: unable to name a torrent of '%s'", path)
+	}
+
+	files, err := walkFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := Info{Name: name}
+
+	var length int64
+	for _, file := range files {
+		length += file.length
+
+		if !stat.IsDir() {
+			info.Length = file.length
+			continue
+		}
+
+		rel, err := filepath.Rel(path, file.path)
+		if err != nil {
+			return nil, err
+		}
+
+		info.Files = append(info.Files, InfoFile{
+			Length: file.length,
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+	}
+
+	if length == 0 {
+		return nil, errors.New("torrent: no data to create a torrent from")
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength <= 0 {
+		info.PieceLength = pieceLengthFor(length)
+	}
+
+	if info.PieceLength < minPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("torrent: piece length %d is not a power of two (of at least 16 KiB)", info.PieceLength)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pieces, err := hashPieces(files, length, info.PieceLength, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Pieces = string(pieces)
+
+	if opts.Private {
+		info.Private = 1
+	}
+
+	metainfo := &MetaInfo{
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate.Unix(),
+		Info:         info,
+	}
+
+	if metainfo.CreatedBy == "" {
+		metainfo.CreatedBy = "trumtorrent"
+	}
+
+	if opts.CreationDate.IsZero() {
+		metainfo.CreationDate = time.Now().Unix()
+	}
+
+	var trackers []string
+	for _, tier := range opts.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+
+	if len(trackers) > 0 {
+		metainfo.Announce = trackers[0]
+	}
+
+	// NOTE: the announce list is only needed when there's more than one tracker
+	if len(trackers) > 1 {
+		metainfo.AnnounceList = opts.AnnounceList
+	}
+
+	return metainfo, nil
+}
+
+// Write writes the MetaInfo as a .torrent file to `w`
+func (m MetaInfo) Write(w io.Writer) error {
+	return bencode.NewEncoder(w, bencode.Strict()).Encode(m)
+}
@@ -0,0 +1,248 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"trumtorrent/piece"
+)
+
+// writeCreateFiles writes files of random data within `root`, it returns their
+// data concatenated in the order of the torrent (i.e. lexical)
+func writeCreateFiles(t *testing.T, root string, files map[string]int) []byte {
+	t.Helper()
+
+	var (
+		random = rand.New(rand.NewSource(1))
+		data   = make(map[string][]byte)
+		names  []string
+	)
+
+	for name, length := range files {
+		b := make([]byte, length)
+		random.Read(b)
+		data[name] = b
+		names = append(names, name)
+	}
+
+	writeFiles(t, root, names...)
+
+	sort.Strings(names)
+
+	var all []byte
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), data[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		all = append(all, data[name]...)
+	}
+
+	return all
+}
+
+// TestCreate creates torrents from a temporary directory, and makes sure that
+// they're the same once loaded (including their info hash) and that their
+// pieces match the data
+func TestCreate(t *testing.T) {
+	var (
+		files     = map[string]int{"b": 2*minPieceLength + 5, "a/nested": 100, "empty": 0, "c": minPieceLength}
+		infoFiles = []InfoFile{
+			{Length: 100, Path: []string{"a", "nested"}},
+			{Length: 2*minPieceLength + 5, Path: []string{"b"}},
+			{Length: minPieceLength, Path: []string{"c"}},
+			{Length: 0, Path: []string{"empty"}},
+		}
+	)
+
+	tests := []struct {
+		name    string
+		files   map[string]int
+		path    string
+		workers int
+		want    Info
+	}{
+		{
+			name:    "directory",
+			files:   files,
+			workers: 1,
+			want:    Info{Name: "data", Files: infoFiles},
+		},
+		{
+			name:    "directory in parallel",
+			files:   files,
+			workers: 4,
+			want:    Info{Name: "data", Files: infoFiles},
+		},
+		{
+			name:    "single file",
+			files:   map[string]int{"single": 3 * minPieceLength},
+			path:    "single",
+			workers: 2,
+			want:    Info{Name: "single", Length: 3 * minPieceLength},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "data")
+			data := writeCreateFiles(t, root, test.files)
+
+			created, err := Create(filepath.Join(root, test.path), CreateOptions{
+				AnnounceList: [][]string{{"udp://a:80"}, {"udp://b:80"}},
+				Comment:      "a comment",
+				Private:      true,
+				PieceLength:  minPieceLength,
+				Workers:      test.workers,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			name := filepath.Join(t.TempDir(), "data.torrent")
+
+			f, err := os.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := created.Write(f); err != nil {
+				t.Fatal(err)
+			}
+
+			f.Close()
+
+			loaded, err := Load(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Validate(loaded); err != nil {
+				t.Fatalf("expected the created torrent to be valid, got %v", err)
+			}
+
+			info := loaded.Info
+			if info.Name != test.want.Name || info.Length != test.want.Length || !reflect.DeepEqual(info.Files, test.want.Files) {
+				t.Fatalf("expected the files %+v, got %+v", test.want, info)
+			}
+
+			if info.PieceLength != minPieceLength || info.Private != 1 || loaded.Comment != "a comment" {
+				t.Fatalf("expected the options to be kept, got %+v", loaded)
+			}
+
+			if loaded.Announce != "udp://a:80" || !reflect.DeepEqual(loaded.AnnounceList, [][]string{{"udp://a:80"}, {"udp://b:80"}}) {
+				t.Fatalf("expected the trackers to be kept, got %s and %v", loaded.Announce, loaded.AnnounceList)
+			}
+
+			tr, err := Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// NOTE: the info dictionary is the last key of the file
+			raw, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hash := sha1.Sum(raw[bytes.Index(raw, []byte("4:infod"))+6 : len(raw)-1])
+			if !bytes.Equal(tr.InfoHash, hash[:]) {
+				t.Fatalf("expected the info hash %x, got %x", hash, tr.InfoHash)
+			}
+
+			if tr.PieceCount() != (len(data)+minPieceLength-1)/minPieceLength {
+				t.Fatalf("expected %d bytes of pieces, got %d pieces", len(data), tr.PieceCount())
+			}
+
+			for index := 0; index < tr.PieceCount(); index++ {
+				end := (index + 1) * minPieceLength
+				if end > len(data) {
+					end = len(data)
+				}
+
+				if !tr.IsValidPieceHash(&piece.Piece{Index: index, Data: data[index*minPieceLength : end]}) {
+					t.Fatalf("expected piece %d to match the data", index)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, "empty")
+
+	if _, err := Create(root, CreateOptions{}); err == nil {
+		t.Fatal("expected a torrent without data to fail")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "a"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range []int{1000, minPieceLength + 1} {
+		if _, err := Create(root, CreateOptions{PieceLength: length}); err == nil {
+			t.Fatalf("expected the piece length %d to fail", length)
+		}
+	}
+
+	if _, err := Create(filepath.Join(root, "missing"), CreateOptions{}); err == nil {
+		t.Fatal("expected a missing path to fail")
+	}
+
+	if _, err := Create(string(filepath.Separator), CreateOptions{}); err == nil {
+		t.Fatal("expected the root of the file system to fail")
+	}
+}
+
+// TestCreateCurrentDirectory makes sure that a torrent of "." is named after
+// the current directory, so that it can be opened
+func TestCreateCurrentDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "current")
+	writeCreateFiles(t, root, map[string]int{"a": 100})
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(wd)
+
+	metainfo, err := Create(".", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metainfo.Info.Name != "current" {
+		t.Fatalf("expected the name 'current', got '%s'", metainfo.Info.Name)
+	}
+
+	if err := Validate(metainfo); err != nil {
+		t.Fatalf("expected the torrent to be valid, got %v", err)
+	}
+}
+
+// TestHashPiecesChangedFiles makes sure that files which are shorter than when
+// they were walked fail to hash
+func TestHashPiecesChangedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, "a")
+
+	files := []createFile{{path: filepath.Join(root, "a"), length: 100}}
+	if _, err := hashPieces(files, 100, minPieceLength, 2); err == nil {
+		t.Fatal("expected a truncated file to fail")
+	}
+
+	if _, err := hashPieces(nil, 100, minPieceLength, 2); err == nil {
+		t.Fatal("expected missing files to fail")
+	}
+}
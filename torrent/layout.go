@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"sort"
+	"trumtorrent/piece"
+)
+
+// LayoutFile is a file placed at an offset of the torrent data
+type LayoutFile struct {
+	// Path is the sanitised path of the file (see `pathSanitizer`), it's
+	// empty for padding files
+	Path   string
+	Offset int64
+	Length int64
+	Attr   Attributes
+	// Target is the sanitised path of the file a symlink points to
+	Target string
+}
+
+// hasData returns false for files which never have any data written to them,
+// i.e. padding files and symlinks
+func (f LayoutFile) hasData() bool {
+	return !f.Attr.IsPadding() && !f.Attr.IsSymlink()
+}
+
+func (f LayoutFile) end() int64 {
+	return f.Offset + f.Length
+}
+
+// Layout maps byte ranges of the torrent data (i.e. all files placed after
+// each other) to the files they belong to. The files are sorted by offset and
+// might have gaps between them (e.g. v2 files which start at piece
+// boundaries), data within a gap or a padding file doesn't belong to any file.
+type Layout struct {
+	files  []LayoutFile
+	length int64
+}
+
+// NewLayout creates a layout of files which are sorted by their offsets and
+// don't overlap
+func NewLayout(files []LayoutFile) *Layout {
+	l := &Layout{files: files}
+
+	if len(files) > 0 {
+		l.length = files[len(files)-1].end()
+	}
+
+	return l
+}
+
+// Files returns the files of the layout
+func (l *Layout) Files() []LayoutFile {
+	return l.files
+}
+
+// Segments returns the destinations of the byte range at `offset`, the start
+// and end of each destination are relative to `offset`. Empty files are
+// included in the range which starts at (or contains) their offset, and empty
+// files at the end of the data are included in the last range.
+func (l *Layout) Segments(offset int64, length int) []piece.Destination {
+	var (
+		end          = offset + int64(length)
+		destinations []piece.Destination
+	)
+
+	// NOTE: the ends of the files are sorted as well, so this finds the first
+	// 		 file which isn't entirely before the range
+	i := sort.Search(len(l.files), func(i int) bool {
+		return l.files[i].end() >= offset
+	})
+
+	for ; i < len(l.files); i++ {
+		file := l.files[i]
+
+		if file.Offset >= end && !(file.Length == 0 && file.Offset == end && end == l.length) {
+			break
+		}
+
+		// Skip files without data and a file which ends exactly where the range
+		// starts
+		if !file.hasData() || (file.Length > 0 && file.end() <= offset) {
+			continue
+		}
+
+		begin, stop := offset, end
+		if file.Offset > begin {
+			begin = file.Offset
+		}
+
+		if file.end() < stop {
+			stop = file.end()
+		}
+
+		destinations = append(destinations, piece.Destination{
+			Path:   file.Path,
+			Offset: begin - file.Offset,
+			Start:  int(begin - offset),
+			End:    int(stop - offset),
+		})
+	}
+
+	return destinations
+}
+
+// v1Layout places the files after each other
+func (t Torrent) v1Layout() *Layout {
+	info := t.MetaInfo.Info
+
+	if !t.IsMultipleFileMode() {
+		files := []LayoutFile{{Length: info.Length, Attr: info.Attr}}
+		sanitizePaths(files, [][]string{{info.Name}}, [][]string{nil})
+		return NewLayout(files)
+	}
+
+	var (
+		files   = make([]LayoutFile, len(info.Files))
+		paths   = make([][]string, len(info.Files))
+		targets = make([][]string, len(info.Files))
+		offset  int64
+	)
+
+	for i, file := range info.Files {
+		files[i] = LayoutFile{Offset: offset, Length: file.Length, Attr: file.Attr}
+		paths[i] = append([]string{info.Name}, file.Path...)
+
+		// NOTE: symlinks are relative to the root of the torrent
+		if len(file.SymlinkPath) > 0 {
+			targets[i] = append([]string{info.Name}, file.SymlinkPath...)
+		}
+
+		offset += file.Length
+	}
+
+	sanitizePaths(files, paths, targets)
+	return NewLayout(files)
+}
+
+// v2Layout places each file at a piece boundary (as if each file was padded),
+// a single file in the root of the tree is not placed within a directory
+func (t Torrent) v2Layout() *Layout {
+	var (
+		v2Files     = t.v2Files()
+		pieceLength = int64(t.PieceLength())
+		files       = make([]LayoutFile, len(v2Files))
+		paths       = make([][]string, len(v2Files))
+		targets     = make([][]string, len(v2Files))
+		offset      int64
+	)
+
+	for i, file := range v2Files {
+		files[i] = LayoutFile{Offset: offset, Length: file.Length, Attr: file.Attr}
+		paths[i] = append([]string{t.Name()}, file.Path...)
+
+		if len(v2Files) == 1 && len(file.Path) == 1 {
+			paths[i] = file.Path
+		}
+
+		if len(file.SymlinkPath) > 0 {
+			targets[i] = append([]string{t.Name()}, file.SymlinkPath...)
+		}
+
+		offset += (file.Length + pieceLength - 1) / pieceLength * pieceLength
+	}
+
+	sanitizePaths(files, paths, targets)
+	return NewLayout(files)
+}
+
+// Layout returns the layout of the files which the pieces are mapped onto,
+// i.e. the v1 layout unless the torrent is v2-only
+func (t Torrent) Layout() *Layout {
+	if t.MetaInfo.Info.IsV1() {
+		return t.v1Layout()
+	}
+
+	return t.v2Layout()
+}
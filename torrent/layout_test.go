@@ -0,0 +1,233 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+	"trumtorrent/piece"
+)
+
+// files places files of the given lengths after each other, named a, b, c...
+func files(lengths ...int64) []LayoutFile {
+	var (
+		layout []LayoutFile
+		offset int64
+	)
+
+	for i, length := range lengths {
+		layout = append(layout, LayoutFile{Path: string(rune('a' + i)), Offset: offset, Length: length})
+		offset += length
+	}
+
+	return layout
+}
+
+func TestLayoutSegments(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []LayoutFile
+		offset int64
+		length int
+		want   []piece.Destination
+	}{
+		{
+			name:   "single file",
+			files:  files(100),
+			offset: 32,
+			length: 32,
+			want:   []piece.Destination{{Path: "a", Offset: 32, Start: 0, End: 32}},
+		},
+		{
+			name:   "truncated last piece",
+			files:  files(100),
+			offset: 96,
+			length: 4,
+			want:   []piece.Destination{{Path: "a", Offset: 96, Start: 0, End: 4}},
+		},
+		{
+			name:   "range within the second file",
+			files:  files(10, 100),
+			offset: 20,
+			length: 16,
+			want:   []piece.Destination{{Path: "b", Offset: 10, Start: 0, End: 16}},
+		},
+		{
+			name:   "range spanning two files",
+			files:  files(10, 100),
+			offset: 0,
+			length: 16,
+			want: []piece.Destination{
+				{Path: "a", Offset: 0, Start: 0, End: 10},
+				{Path: "b", Offset: 0, Start: 10, End: 16},
+			},
+		},
+		{
+			name:   "range spanning many small files",
+			files:  files(6, 3, 1, 2, 20),
+			offset: 4,
+			length: 10,
+			want: []piece.Destination{
+				{Path: "a", Offset: 4, Start: 0, End: 2},
+				{Path: "b", Offset: 0, Start: 2, End: 5},
+				{Path: "c", Offset: 0, Start: 5, End: 6},
+				{Path: "d", Offset: 0, Start: 6, End: 8},
+				{Path: "e", Offset: 0, Start: 8, End: 10},
+			},
+		},
+		{
+			name:   "range starting at a file boundary",
+			files:  files(8, 8, 8),
+			offset: 8,
+			length: 8,
+			want:   []piece.Destination{{Path: "b", Offset: 0, Start: 0, End: 8}},
+		},
+		{
+			name:   "empty file within a range",
+			files:  files(4, 0, 4),
+			offset: 0,
+			length: 8,
+			want: []piece.Destination{
+				{Path: "a", Offset: 0, Start: 0, End: 4},
+				{Path: "b", Offset: 0, Start: 4, End: 4},
+				{Path: "c", Offset: 0, Start: 4, End: 8},
+			},
+		},
+		{
+			name:   "empty file at the start of a range",
+			files:  files(4, 0, 4),
+			offset: 4,
+			length: 4,
+			want: []piece.Destination{
+				{Path: "b", Offset: 0, Start: 0, End: 0},
+				{Path: "c", Offset: 0, Start: 0, End: 4},
+			},
+		},
+		{
+			name:   "empty file at the end of a range belongs to the next",
+			files:  files(4, 0, 4),
+			offset: 0,
+			length: 4,
+			want:   []piece.Destination{{Path: "a", Offset: 0, Start: 0, End: 4}},
+		},
+		{
+			name:   "empty files at the start",
+			files:  files(0, 0, 4),
+			offset: 0,
+			length: 4,
+			want: []piece.Destination{
+				{Path: "a", Offset: 0, Start: 0, End: 0},
+				{Path: "b", Offset: 0, Start: 0, End: 0},
+				{Path: "c", Offset: 0, Start: 0, End: 4},
+			},
+		},
+		{
+			name:   "empty files at the end",
+			files:  files(4, 4, 0, 0),
+			offset: 4,
+			length: 4,
+			want: []piece.Destination{
+				{Path: "b", Offset: 0, Start: 0, End: 4},
+				{Path: "c", Offset: 0, Start: 4, End: 4},
+				{Path: "d", Offset: 0, Start: 4, End: 4},
+			},
+		},
+		{
+			name: "files separated by gaps",
+			files: []LayoutFile{
+				{Path: "a", Offset: 0, Length: 5},
+				{Path: "b", Offset: 8, Length: 3},
+				{Path: "c", Offset: 16, Length: 8},
+			},
+			offset: 4,
+			length: 16,
+			want: []piece.Destination{
+				{Path: "a", Offset: 4, Start: 0, End: 1},
+				{Path: "b", Offset: 0, Start: 4, End: 7},
+				{Path: "c", Offset: 0, Start: 12, End: 16},
+			},
+		},
+		{
+			name: "range within a gap",
+			files: []LayoutFile{
+				{Path: "a", Offset: 0, Length: 5},
+				{Path: "b", Offset: 16, Length: 8},
+			},
+			offset: 6,
+			length: 8,
+			want:   nil,
+		},
+		{
+			name: "padding files and symlinks are skipped",
+			files: []LayoutFile{
+				{Path: "a", Offset: 0, Length: 5},
+				{Offset: 5, Length: 3, Attr: "p"},
+				{Path: "l", Offset: 8, Length: 0, Attr: "l", Target: "a"},
+				{Path: "b", Offset: 8, Length: 8, Attr: "x"},
+			},
+			offset: 0,
+			length: 16,
+			want: []piece.Destination{
+				{Path: "a", Offset: 0, Start: 0, End: 5},
+				{Path: "b", Offset: 0, Start: 8, End: 16},
+			},
+		},
+		{
+			name:   "range beyond the data",
+			files:  files(4),
+			offset: 8,
+			length: 4,
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewLayout(test.files).Segments(test.offset, test.length)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+// TestLayoutCoversAllData makes sure that the segments of consecutive pieces
+// cover every byte of every file exactly once
+func TestLayoutCoversAllData(t *testing.T) {
+	layouts := [][]int64{
+		{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		{0, 7, 0, 0, 30, 1, 0, 16, 2, 0},
+		{100},
+		{3, 64, 5, 0, 129},
+	}
+
+	for _, lengths := range layouts {
+		layout := NewLayout(files(lengths...))
+
+		for _, pieceLength := range []int{1, 2, 7, 16, 64} {
+			written := make(map[string]int64)
+			seen := make(map[string]bool)
+
+			for offset := int64(0); offset < layout.length; offset += int64(pieceLength) {
+				length := pieceLength
+				if offset+int64(length) > layout.length {
+					length = int(layout.length - offset)
+				}
+
+				for _, dst := range layout.Segments(offset, length) {
+					if dst.Offset != written[dst.Path] {
+						t.Fatalf("%v (piece length %d): expected '%s' to be written at %d, got %d", lengths, pieceLength, dst.Path, written[dst.Path], dst.Offset)
+					}
+
+					written[dst.Path] += int64(dst.End - dst.Start)
+					seen[dst.Path] = true
+				}
+			}
+
+			for _, file := range layout.Files() {
+				if !seen[file.Path] || written[file.Path] != file.Length {
+					t.Fatalf("%v (piece length %d): expected %d bytes of '%s', got %d", lengths, pieceLength, file.Length, file.Path, written[file.Path])
+				}
+			}
+		}
+	}
+}
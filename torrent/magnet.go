@@ -0,0 +1,252 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet represents a magnet link (see BEP 9 and BEP 53)
+type Magnet struct {
+	// InfoHash is the v1 info hash (from `urn:btih:`)
+	InfoHash []byte
+	// InfoHashV2 is the v2 info hash (from `urn:btmh:`)
+	InfoHashV2 []byte
+	Name       string
+	Trackers   []string
+	// Peers are addresses (host:port) of peers which can be connected to
+	// directly (from `x.pe`)
+	Peers []string
+	// WebSeeds are the URLs of web seeds (from `ws`), they're only parsed
+	// (and formatted) since downloading from web seeds isn't supported
+	WebSeeds []string
+	// Select holds the ranges of the indexes of the files to download (from
+	// `so`)
+	Select []FileRange
+}
+
+// FileRange is a range of file indexes, both `First` and `Last` are included
+type FileRange struct {
+	First int
+	Last  int
+}
+
+// Contains returns true if `index` is within the range
+func (r FileRange) Contains(index int) bool {
+	return index >= r.First && index <= r.Last
+}
+
+// multihashSHA256 is the multihash prefix of a SHA-256 hash, which is the
+// only kind used for v2 info hashes
+const multihashSHA256 = "1220"
+
+// parseBTIH parses a v1 info hash, either encoded as hex or as base32
+func parseBTIH(value string) ([]byte, error) {
+	switch len(value) {
+	case 40:
+		return hex.DecodeString(value)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(value))
+	default:
+		return nil, fmt.Errorf("torrent: invalid length of info hash '%s'", value)
+	}
+}
+
+// parseBTMH parses a v2 info hash, which is a hex encoded multihash
+func parseBTMH(value string) ([]byte, error) {
+	if len(value) != 68 || !strings.HasPrefix(value, multihashSHA256) {
+		return nil, fmt.Errorf("torrent: unsupported v2 info hash '%s'", value)
+	}
+
+	return hex.DecodeString(value[4:])
+}
+
+// parseSelection parses the list of file indexes (and ranges of indexes) of
+// `so`, e.g. "0,2,4-6". The ranges are kept as they are, since they're given by
+// untrusted links (and might be huge).
+func parseSelection(value string) ([]FileRange, error) {
+	var ranges []FileRange
+
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		begin, err := strconv.Atoi(first)
+		if err != nil || begin < 0 {
+			return nil, fmt.Errorf("torrent: invalid file index '%s'", part)
+		}
+
+		end := begin
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < begin {
+				return nil, fmt.Errorf("torrent: invalid file range '%s'", part)
+			}
+		}
+
+		ranges = append(ranges, FileRange{First: begin, Last: end})
+	}
+
+	return ranges, nil
+}
+
+// ParseMagnet parses a magnet link, which has to have at least one v1 or v2
+// info hash. All other parameters are optional.
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("torrent: invalid magnet link scheme '%s'", u.Scheme)
+	}
+
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		Name:     values.Get("dn"),
+		Trackers: values["tr"],
+		WebSeeds: values["ws"],
+	}
+
+	// NOTE: any other kind of `xt` (e.g. `urn:sha1:`) is ignored
+	for _, xt := range values["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			hash, err := parseBTIH(xt[len("urn:btih:"):])
+			if err != nil {
+				return nil, fmt.Errorf("torrent: unable to decode info hash (%w)", err)
+			}
+
+			if m.InfoHash != nil && string(m.InfoHash) != string(hash) {
+				return nil, errors.New("torrent: magnet link contains multiple v1 info hashes")
+			}
+
+			m.InfoHash = hash
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			hash, err := parseBTMH(xt[len("urn:btmh:"):])
+			if err != nil {
+				return nil, fmt.Errorf("torrent: unable to decode info hash (%w)", err)
+			}
+
+			if m.InfoHashV2 != nil && string(m.InfoHashV2) != string(hash) {
+				return nil, errors.New("torrent: magnet link contains multiple v2 info hashes")
+			}
+
+			m.InfoHashV2 = hash
+		}
+	}
+
+	if m.InfoHash == nil && m.InfoHashV2 == nil {
+		return nil, errors.New("torrent: missing magnet link param (xt)")
+	}
+
+	for _, pe := range values["x.pe"] {
+		if _, _, err := net.SplitHostPort(pe); err != nil {
+			return nil, fmt.Errorf("torrent: invalid peer address '%s'", pe)
+		}
+
+		m.Peers = append(m.Peers, pe)
+	}
+
+	if so := values.Get("so"); so != "" {
+		if m.Select, err = parseSelection(so); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// formatSelection formats ranges of file indexes as `so`
+func formatSelection(ranges []FileRange) string {
+	parts := make([]string, len(ranges))
+
+	for i, r := range ranges {
+		if r.First == r.Last {
+			parts[i] = strconv.Itoa(r.First)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.First, r.Last)
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// String formats the magnet link, the info hashes comes first
+func (m Magnet) String() string {
+	var params []string
+
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	if m.InfoHash != nil {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(m.InfoHash))
+	}
+
+	if m.InfoHashV2 != nil {
+		params = append(params, "xt=urn:btmh:"+multihashSHA256+hex.EncodeToString(m.InfoHashV2))
+	}
+
+	if m.Name != "" {
+		add("dn", m.Name)
+	}
+
+	for _, tr := range m.Trackers {
+		add("tr", tr)
+	}
+
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+
+	for _, pe := range m.Peers {
+		add("x.pe", pe)
+	}
+
+	if len(m.Select) > 0 {
+		params = append(params, "so="+formatSelection(m.Select))
+	}
+
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// isV2Only returns true if the info hash is the truncated v2 info hash
+func (t Torrent) isV2Only() bool {
+	return len(t.InfoHashV2) > 0 && bytes.Equal(t.InfoHash, t.InfoHashV2[:20])
+}
+
+// Magnet creates a magnet link of the torrent
+func (t Torrent) Magnet() string {
+	m := Magnet{
+		InfoHashV2: t.InfoHashV2,
+		Name:       t.Name(),
+		Peers:      t.PeerHints,
+		WebSeeds:   t.WebSeeds,
+		Select:     t.Selection,
+	}
+
+	// NOTE: v2-only torrents only have a (truncated) v2 hash
+	if !t.isV2Only() {
+		m.InfoHash = t.InfoHash
+	}
+
+	for _, tier := range t.MetaInfo.AnnounceList {
+		m.Trackers = append(m.Trackers, tier...)
+	}
+
+	if len(m.Trackers) == 0 && t.MetaInfo.Announce != "" {
+		m.Trackers = []string{t.MetaInfo.Announce}
+	}
+
+	return m.String()
+}
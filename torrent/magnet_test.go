@@ -0,0 +1,252 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"trumtorrent/extension"
+	"trumtorrent/metadata"
+	"trumtorrent/piece"
+)
+
+const (
+	testHash   = "0123456789abcdef0123456789abcdef01234567"
+	testHashV2 = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestParseMagnet(t *testing.T) {
+	var (
+		hash   = decodeHex(t, testHash)
+		hashV2 = decodeHex(t, testHashV2)
+	)
+
+	tests := []struct {
+		name string
+		link string
+		want *Magnet
+		err  bool
+	}{
+		{
+			name: "hex btih",
+			link: "magnet:?xt=urn:btih:" + testHash + "&dn=a+name&tr=http%3A%2F%2Ftracker%2Fannounce",
+			want: &Magnet{InfoHash: hash, Name: "a name", Trackers: []string{"http://tracker/announce"}},
+		},
+		{
+			name: "base32 btih",
+			link: "magnet:?xt=urn:btih:aerukz4jvpg66ajdivtytk6n54asgrlh",
+			want: &Magnet{InfoHash: hash},
+		},
+		{
+			name: "uppercase hex btih",
+			link: "magnet:?xt=urn:btih:" + strings.ToUpper(testHash),
+			want: &Magnet{InfoHash: hash},
+		},
+		{
+			name: "btmh",
+			link: "magnet:?xt=urn:btmh:1220" + testHashV2,
+			want: &Magnet{InfoHashV2: hashV2},
+		},
+		{
+			name: "hybrid",
+			link: "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btmh:1220" + testHashV2,
+			want: &Magnet{InfoHash: hash, InfoHashV2: hashV2},
+		},
+		{
+			name: "repeated btih",
+			link: "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btih:aerukz4jvpg66ajdivtytk6n54asgrlh",
+			want: &Magnet{InfoHash: hash},
+		},
+		{
+			name: "unknown xt is ignored",
+			link: "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + testHash,
+			want: &Magnet{InfoHash: hash},
+		},
+		{
+			name: "multiple trackers and peers",
+			link: "magnet:?xt=urn:btih:" + testHash + "&tr=udp%3A%2F%2Fa%3A80&tr=udp%3A%2F%2Fb%3A80&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6881",
+			want: &Magnet{
+				InfoHash: hash,
+				Trackers: []string{"udp://a:80", "udp://b:80"},
+				Peers:    []string{"10.0.0.1:6881", "[::1]:6881"},
+			},
+		},
+		{
+			name: "web seeds",
+			link: "magnet:?xt=urn:btih:" + testHash + "&ws=http%3A%2F%2Fseed%2Ffile",
+			want: &Magnet{InfoHash: hash, WebSeeds: []string{"http://seed/file"}},
+		},
+		{
+			name: "selection",
+			link: "magnet:?xt=urn:btih:" + testHash + "&so=0,2,4-6",
+			want: &Magnet{InfoHash: hash, Select: []FileRange{{0, 0}, {2, 2}, {4, 6}}},
+		},
+		{
+			name: "huge selection",
+			link: "magnet:?xt=urn:btih:" + testHash + "&so=0-2000000000",
+			want: &Magnet{InfoHash: hash, Select: []FileRange{{0, 2000000000}}},
+		},
+		{name: "missing xt", link: "magnet:?dn=name", err: true},
+		{name: "invalid scheme", link: "http://example.com/?xt=urn:btih:" + testHash, err: true},
+		{name: "short btih", link: "magnet:?xt=urn:btih:0123", err: true},
+		{name: "invalid hex", link: "magnet:?xt=urn:btih:" + strings.Repeat("z", 40), err: true},
+		{name: "unsupported multihash", link: "magnet:?xt=urn:btmh:1114" + testHashV2, err: true},
+		{
+			name: "conflicting btih",
+			link: "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btih:" + strings.Repeat("0", 40),
+			err:  true,
+		},
+		{name: "invalid peer", link: "magnet:?xt=urn:btih:" + testHash + "&x.pe=10.0.0.1", err: true},
+		{name: "negative selection", link: "magnet:?xt=urn:btih:" + testHash + "&so=-1", err: true},
+		{name: "reversed selection", link: "magnet:?xt=urn:btih:" + testHash + "&so=6-4", err: true},
+		{name: "overflowing selection", link: "magnet:?xt=urn:btih:" + testHash + "&so=0-99999999999999999999", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMagnet(test.link)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	m := &Magnet{
+		InfoHash:   decodeHex(t, testHash),
+		InfoHashV2: decodeHex(t, testHashV2),
+		Name:       "a name & more",
+		Trackers:   []string{"udp://a:80/announce", "http://b/announce?key=1"},
+		Peers:      []string{"10.0.0.1:6881"},
+		WebSeeds:   []string{"http://seed/file"},
+		Select:     []FileRange{{0, 0}, {3, 5}},
+	}
+
+	got, err := ParseMagnet(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("expected %+v, got %+v", m, got)
+	}
+}
+
+func TestTorrentMagnet(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"v1", "magnet:?xt=urn:btih:" + testHash + "&dn=name&tr=udp%3A%2F%2Fa%3A80&x.pe=10.0.0.1%3A6881&so=1-2"},
+		{"hybrid", "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btmh:1220" + testHashV2},
+		// NOTE: v2-only torrents use the truncated v2 info hash on the wire,
+		// 		 so only the v2 info hash is a part of the link
+		{"v2-only", "magnet:?xt=urn:btmh:1220" + testHashV2 + "&dn=name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := Open(test.link)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tr.Magnet(); got != test.link {
+				t.Fatalf("expected %s, got %s", test.link, got)
+			}
+		})
+	}
+}
+
+// TestV2OnlyMagnet makes sure that the metadata of v2-only magnet links is
+// verified by the v2 info hash, and that it's only used if all of its files can
+// be verified without the piece layers (i.e. by their pieces root)
+func TestV2OnlyMagnet(t *testing.T) {
+	tests := []struct {
+		name string
+		// file is the name of a file of the hybrid torrent (see
+		// `hybridFile`), at `index`
+		file   string
+		index  int
+		length int
+		err    bool
+	}{
+		{name: "single piece files", file: "b", index: 1, length: 20000},
+		{name: "files larger than a piece", file: "a", index: 0, length: 150000, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := string(decodeHex(t, hybridRoots[test.file]))
+			data := fmt.Sprintf("d9:file treed1:%sd0:d6:lengthi%de11:pieces root32:%seee12:meta versioni2e4:name1:t12:piece lengthi32768ee", test.file, test.length, root)
+			hash := sha256.Sum256([]byte(data))
+
+			tr, err := Open("magnet:?xt=urn:btmh:1220" + hex.EncodeToString(hash[:]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(tr.InfoHash, hash[:20]) {
+				t.Fatalf("expected the truncated v2 info hash %x, got %x", hash[:20], tr.InfoHash)
+			}
+
+			// Metadata which doesn't match the v2 info hash is requested again
+			tr.Metadata = metadata.New(len(data))
+			tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: []byte(strings.ToUpper(data))})
+
+			if tr.Metadata.HasPiece(0) {
+				t.Fatal("expected the metadata to be dropped")
+			}
+
+			tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: []byte(data)})
+
+			if test.err {
+				if !tr.MetaInfo.Incomplete() || !errors.Is(tr.Metadata.Err, ErrInvalidMetadata) {
+					t.Fatalf("expected the metadata to fail, got %v", tr.Metadata.Err)
+				}
+
+				return
+			}
+
+			if tr.MetaInfo.Incomplete() || tr.Metadata.Err != nil {
+				t.Fatalf("expected the metadata to be received, got %v", tr.Metadata.Err)
+			}
+
+			if !tr.IsValidPieceHash(&piece.Piece{Index: 0, Data: hybridFile(test.index, test.length)}) {
+				t.Fatal("expected the piece to be verified by the pieces root")
+			}
+
+			if tr.IsValidPieceHash(&piece.Piece{Index: 0, Data: hybridFile(test.index+1, test.length)}) {
+				t.Fatal("expected other data to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLength is the maximum length (in bytes) of a sanitised file name,
+// which leaves room for collision suffixes within the usual limit of 255
+const maxNameLength = 200
+
+// reservedNames are names which can't be used for files on Windows, with or
+// without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// truncateName shortens a name to maxNameLength bytes (at a rune boundary),
+// the extension is kept and a hash of the full name is added so that names
+// with the same prefix don't collide
+func truncateName(name string) string {
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+
+	n := maxNameLength - len(suffix) - len(ext)
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+
+	return name[:n] + suffix + ext
+}
+
+// sanitizeName makes a single path component safe to use as a file name:
+// separators, control characters and characters reserved on Windows are
+// replaced by '_', as are the names "", "." and "..". Reserved device names
+// are prefixed by '_' and over-long names are truncated.
+func sanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	// NOTE: Windows silently drops trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+
+	if name == "" {
+		return "_"
+	}
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedNames[base] {
+		name = "_" + name
+	}
+
+	return truncateName(name)
+}
+
+// withSuffix adds " (n)" to a path, before the extension of its name
+func withSuffix(p string, n int) string {
+	ext := path.Ext(path.Base(p))
+	if ext == path.Base(p) {
+		ext = ""
+	}
+
+	return strings.TrimSuffix(p, ext) + " (" + strconv.Itoa(n) + ")" + ext
+}
+
+// pathSanitizer creates safe and unique (relative) paths for the files of a
+// torrent, every destination goes through it
+type pathSanitizer struct {
+	// used holds every file and directory path handed out so far, in lower case
+	// since some file systems are case insensitive
+	used map[string]bool
+	// dirs maps the (original) path of each directory to its sanitised path,
+	// so that all files of a directory stay together
+	dirs map[string]string
+	// files maps the (original) path of each file to its sanitised path
+	files map[string]string
+}
+
+func newPathSanitizer() *pathSanitizer {
+	return &pathSanitizer{
+		used:  make(map[string]bool),
+		dirs:  make(map[string]string),
+		files: make(map[string]string),
+	}
+}
+
+// unique returns `p`, or `p` with a " (n)" suffix if it's already been used
+func (s *pathSanitizer) unique(p string) string {
+	candidate := p
+
+	for n := 1; s.used[strings.ToLower(candidate)]; n++ {
+		candidate = withSuffix(p, n)
+	}
+
+	s.used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// file returns the sanitised path of a file, given as its path components
+// (including the name of the torrent for multiple file torrents). Collisions
+// are resolved in order, i.e. the first file keeps its name.
+func (s *pathSanitizer) file(components []string) string {
+	var dir string
+
+	for i, name := range components[:len(components)-1] {
+		key := strings.Join(components[:i+1], "\x00")
+
+		if sanitized, ok := s.dirs[key]; ok {
+			dir = sanitized
+			continue
+		}
+
+		dir = s.unique(path.Join(dir, sanitizeName(name)))
+		s.dirs[key] = dir
+	}
+
+	sanitized := s.unique(path.Join(dir, sanitizeName(components[len(components)-1])))
+	s.files[strings.Join(components, "\x00")] = sanitized
+	return sanitized
+}
+
+// target returns the sanitised path of a symlink target, which is the path of
+// the file (or directory) it points to if it's within the torrent
+func (s *pathSanitizer) target(components []string) string {
+	if sanitized, ok := s.files[strings.Join(components, "\x00")]; ok {
+		return sanitized
+	}
+
+	var target string
+
+	for i, name := range components {
+		if sanitized, ok := s.dirs[strings.Join(components[:i+1], "\x00")]; ok {
+			target = sanitized
+			continue
+		}
+
+		target = path.Join(target, sanitizeName(name))
+	}
+
+	return target
+}
+
+// sanitizePaths sets the paths of the files (and the targets of symlinks),
+// `paths` and `targets` are the paths as found in the metadata. Padding files
+// don't get a path since they're never written.
+func sanitizePaths(files []LayoutFile, paths, targets [][]string) {
+	s := newPathSanitizer()
+
+	for i := range files {
+		if !files[i].Attr.IsPadding() {
+			files[i].Path = s.file(paths[i])
+		}
+	}
+
+	// NOTE: symlinks might point to files which come after them
+	for i := range files {
+		if files[i].Attr.IsSymlink() && len(targets[i]) > 0 {
+			files[i].Target = s.target(targets[i])
+		}
+	}
+}
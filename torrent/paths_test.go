@@ -0,0 +1,196 @@
+package torrent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"file.txt", "file.txt"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "_"},
+		{"...", "_"},
+		{"a/b", "a_b"},
+		{"/etc", "_etc"},
+		{`..\..\etc`, `.._.._etc`},
+		{"C:", "C_"},
+		{"a\x00b", "a_b"},
+		{"a\nb\x7f", "a_b_"},
+		{`a*b?c"d<e>f|g`, "a_b_c_d_e_f_g"},
+		{"trailing. ", "trailing"},
+		{"CON", "_CON"},
+		{"con", "_con"},
+		{"con.txt", "_con.txt"},
+		{"Com1.tar.gz", "_Com1.tar.gz"},
+		{"lpt9", "_lpt9"},
+		{"console", "console"},
+		{"COM10", "COM10"},
+		{"invalid \xff utf-8", "invalid _ utf-8"},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeName(test.name); got != test.want {
+			t.Errorf("sanitizeName(%q): expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name string
+		// ext is the extension which is expected to be kept
+		ext string
+	}{
+		{name: strings.Repeat("a", 300) + ".txt", ext: ".txt"},
+		{name: strings.Repeat("a", 300) + "." + strings.Repeat("b", 20), ext: ""},
+		{name: strings.Repeat("ö", 150) + ".mkv", ext: ".mkv"},
+		{name: strings.Repeat("€", 100), ext: ""},
+		{name: "a" + strings.Repeat("😀", 60), ext: ""},
+	}
+
+	for _, test := range tests {
+		got := truncateName(test.name)
+
+		if len(got) > maxNameLength {
+			t.Errorf("expected at most %d bytes, got %d (%q)", maxNameLength, len(got), got)
+		}
+
+		if !utf8.ValidString(got) {
+			t.Errorf("expected a valid UTF-8 name, got %q", got)
+		}
+
+		if !strings.HasSuffix(got, test.ext) || (test.ext == "" && strings.Contains(got[len(got)-9:], ".")) {
+			t.Errorf("expected the extension %q to be kept, got %q", test.ext, got)
+		}
+	}
+
+	// Names with the same prefix don't collide
+	a := truncateName(strings.Repeat("a", 300) + "1")
+	b := truncateName(strings.Repeat("a", 300) + "2")
+
+	if a == b {
+		t.Fatalf("expected truncated names to differ, got %q", a)
+	}
+
+	if name := strings.Repeat("a", maxNameLength); truncateName(name) != name {
+		t.Fatal("expected a name within the limit to be kept as is")
+	}
+
+	// The limit applies to sanitised names as well
+	if got := sanitizeName(strings.Repeat("é", 300)); len(got) > maxNameLength || !utf8.ValidString(got) {
+		t.Fatalf("expected a sanitised name to be truncated, got %q", got)
+	}
+}
+
+func TestPathSanitizerCollisions(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths [][]string
+		want  []string
+	}{
+		{
+			name:  "same name",
+			paths: [][]string{{"t", "a.txt"}, {"t", "a.txt"}, {"t", "a.txt"}},
+			want:  []string{"t/a.txt", "t/a (1).txt", "t/a (2).txt"},
+		},
+		{
+			name:  "case insensitive",
+			paths: [][]string{{"t", "README"}, {"t", "readme"}, {"t", "ReadMe"}},
+			want:  []string{"t/README", "t/readme (1)", "t/ReadMe (2)"},
+		},
+		{
+			name:  "sanitised names",
+			paths: [][]string{{"t", "a:b"}, {"t", "a_b"}, {"t", "a?b"}},
+			want:  []string{"t/a_b", "t/a_b (1)", "t/a_b (2)"},
+		},
+		{
+			name:  "directories stay together",
+			paths: [][]string{{"t", "d", "a"}, {"t", "D", "b"}, {"t", "d", "c"}},
+			want:  []string{"t/d/a", "t/D (1)/b", "t/d/c"},
+		},
+		{
+			name:  "file and directory",
+			paths: [][]string{{"t", "x"}, {"t", "x", "a"}},
+			want:  []string{"t/x", "t/x (1)/a"},
+		},
+		{
+			name:  "parent directories",
+			paths: [][]string{{"t", "..", "a"}, {"t", ".", "a"}},
+			want:  []string{"t/_/a", "t/_ (1)/a"},
+		},
+		{
+			name:  "reserved names",
+			paths: [][]string{{"t", "con"}, {"t", "_con"}},
+			want:  []string{"t/_con", "t/_con (1)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newPathSanitizer()
+
+			for i, p := range test.paths {
+				if got := s.file(p); got != test.want[i] {
+					t.Errorf("expected %q to become %q, got %q", strings.Join(p, "/"), test.want[i], got)
+				}
+			}
+		})
+	}
+}
+
+// TestSanitizedPathsStayWithinRoot makes sure that no matter what the metadata
+// holds, files (and symlink targets) end up within the output directory
+func TestSanitizedPathsStayWithinRoot(t *testing.T) {
+	hostile := [][]string{
+		{"..", "..", "etc", "passwd"},
+		{"/etc", "passwd"},
+		{"/", "etc"},
+		{"a", "..", "..", "b"},
+		{"", "", "c"},
+		{`..\..\windows`, "system32"},
+		{"C:", "windows"},
+		{"a\x00/../b"},
+		{" .. ", "x"},
+		{"....", "x"},
+		{strings.Repeat(".", 300)},
+		{strings.Repeat("../", 100)},
+		{"NUL", "CON.txt"},
+	}
+
+	var (
+		root    = filepath.Join(t.TempDir(), "out")
+		files   = make([]LayoutFile, len(hostile))
+		targets = make([][]string, len(hostile))
+	)
+
+	for i := range files {
+		files[i].Attr = "l"
+		targets[i] = hostile[len(hostile)-1-i]
+	}
+
+	sanitizePaths(files, hostile, targets)
+
+	for i, file := range files {
+		for _, p := range []string{file.Path, file.Target} {
+			name := filepath.Join(root, filepath.FromSlash(p))
+
+			rel, err := filepath.Rel(root, name)
+			if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				t.Errorf("expected %q to stay within the root, got %q", strings.Join(hostile[i], "/"), p)
+			}
+
+			for _, component := range strings.Split(p, "/") {
+				if component == "" || component == "." || component == ".." || len(component) > 255 {
+					t.Errorf("expected %q to have safe components, got %q", strings.Join(hostile[i], "/"), p)
+				}
+			}
+		}
+	}
+}
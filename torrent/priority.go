@@ -0,0 +1,237 @@
+package torrent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"trumtorrent/piece"
+)
+
+// Priority is the download priority of a file, pieces are scheduled by the
+// highest priority of the files they belong to
+type Priority int
+
+const (
+	// PrioritySkip means that the file isn't downloaded (or written) at all
+	PrioritySkip   Priority = -2
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// selection holds how files have been chosen to be downloaded, which is kept
+// until we've got the metadata (e.g. for magnet links)
+type selection struct {
+	only       []string
+	exclude    []string
+	priorities map[int]Priority
+}
+
+// relativePaths returns the path of each file of the layout within the torrent
+// (i.e. without the name of the torrent), as found in the metadata
+func (t Torrent) relativePaths() []string {
+	info := t.MetaInfo.Info
+
+	if info.IsV1() {
+		if !t.IsMultipleFileMode() {
+			return []string{info.Name}
+		}
+
+		paths := make([]string, len(info.Files))
+		for i, file := range info.Files {
+			paths[i] = strings.Join(file.Path, "/")
+		}
+
+		return paths
+	}
+
+	files := t.v2Files()
+	paths := make([]string, len(files))
+
+	for i, file := range files {
+		paths[i] = strings.Join(file.Path, "/")
+	}
+
+	return paths
+}
+
+// matchesAny returns true if any of the patterns matches either the whole path
+// or the name of the file
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selected returns true if the file at `index` is a part of the magnet
+// selection (`so`)
+func (t Torrent) selected(index int) bool {
+	for _, r := range t.Selection {
+		if r.Contains(index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectedPriorities returns the priority of each file of the layout by the
+// selection alone, i.e. whether or not the file has any data. Files are skipped
+// if they're not a part of the magnet selection (`so`), if they don't match
+// any of the `only` patterns or if they match any of the `exclude` patterns.
+// Priorities which have been set explicitly always apply.
+func (t Torrent) selectedPriorities(files []LayoutFile) []Priority {
+	var (
+		priorities = make([]Priority, len(files))
+		paths      = t.relativePaths()
+	)
+
+	for i := range files {
+		switch {
+		case len(t.Selection) > 0 && !t.selected(i):
+			priorities[i] = PrioritySkip
+		case len(t.selection.only) > 0 && !matchesAny(t.selection.only, paths[i]):
+			priorities[i] = PrioritySkip
+		case matchesAny(t.selection.exclude, paths[i]):
+			priorities[i] = PrioritySkip
+		}
+
+		if p, ok := t.selection.priorities[i]; ok {
+			priorities[i] = p
+		}
+	}
+
+	return priorities
+}
+
+// filePriorities returns the priority of each file of the layout (see
+// `selectedPriorities`), files without data are always skipped
+func (t Torrent) filePriorities(files []LayoutFile) []Priority {
+	priorities := t.selectedPriorities(files)
+
+	for i, file := range files {
+		if !file.hasData() {
+			priorities[i] = PrioritySkip
+		}
+	}
+
+	return priorities
+}
+
+// FilePriority returns the priority of the file at `index` (in the order of the
+// metadata), padding files and symlinks are always skipped
+func (t Torrent) FilePriority(index int) Priority {
+	files := t.Layout().Files()
+	if index < 0 || index >= len(files) {
+		return PrioritySkip
+	}
+
+	return t.filePriorities(files)[index]
+}
+
+// prioritize removes the destinations of skipped files from the pieces, and
+// sets the priority of each piece. A piece which is shared by a wanted and a
+// skipped file is still downloaded (it's needed in order to verify it), but
+// only the data of the wanted file is written.
+func (t Torrent) prioritize(pieces []*piece.Piece) []*piece.Piece {
+	var (
+		files      = t.Layout().Files()
+		priorities = t.filePriorities(files)
+		byPath     = make(map[string]Priority, len(files))
+		wanted     = pieces[:0]
+	)
+
+	for i, file := range files {
+		byPath[file.Path] = priorities[i]
+	}
+
+	for _, p := range pieces {
+		var (
+			destinations []piece.Destination
+			priority     = PrioritySkip
+		)
+
+		for _, dst := range p.Destinations {
+			if byPath[dst.Path] == PrioritySkip {
+				continue
+			}
+
+			if byPath[dst.Path] > priority {
+				priority = byPath[dst.Path]
+			}
+
+			destinations = append(destinations, dst)
+		}
+
+		if len(destinations) == 0 {
+			continue
+		}
+
+		p.Destinations = destinations
+		p.Priority = int(priority)
+		wanted = append(wanted, p)
+	}
+
+	return wanted
+}
+
+// SetPriorities sets the priority of files by their index (in the order of the
+// metadata), which is used once the pieces are scheduled
+func (t *Torrent) SetPriorities(priorities map[int]Priority) {
+	if t.selection.priorities == nil {
+		t.selection.priorities = make(map[int]Priority)
+	}
+
+	for index, p := range priorities {
+		t.selection.priorities[index] = p
+	}
+
+	t.schedulePieces()
+}
+
+// SelectFiles chooses which files to download by glob patterns (see
+// `path.Match`), which are matched against both the path of each file within
+// the torrent and its name. Files are skipped unless they match any of `only`
+// (if given), and files which match any of `exclude` are always skipped.
+func (t *Torrent) SelectFiles(only, exclude []string) error {
+	for _, pattern := range append(append([]string(nil), only...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("torrent: invalid pattern '%s' (%w)", pattern, err)
+		}
+	}
+
+	t.selection.only = only
+	t.selection.exclude = exclude
+	t.schedulePieces()
+	return nil
+}
+
+// WantedLength returns the number of bytes of the files which are downloaded,
+// i.e. the length of the torrent without skipped files and padding
+func (t Torrent) WantedLength() int64 {
+	_, wanted := t.Picker.Progress()
+	return wanted
+}
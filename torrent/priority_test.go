@@ -0,0 +1,213 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+	"trumtorrent/piece"
+)
+
+// priorities returns the priority of each file of the torrent
+func priorities(tr *Torrent) []Priority {
+	return tr.filePriorities(tr.Layout().Files())
+}
+
+// TestBoundaryPieces makes sure that a piece shared by a wanted and a skipped
+// file is downloaded, but only written to the wanted file
+func TestBoundaryPieces(t *testing.T) {
+	// The first piece is shared by a and b
+	tr := newFilesTorrent(16, filesOf([]string{"a", "b"}, []int64{10, 10}))
+
+	tests := []struct {
+		name    string
+		skip    int
+		wanted  int64
+		written map[int][]piece.Destination
+	}{
+		{
+			name:   "second file skipped",
+			skip:   1,
+			wanted: 10,
+			written: map[int][]piece.Destination{
+				0: {{Path: "t/a", Offset: 0, Start: 0, End: 10}},
+			},
+		},
+		{
+			name:   "first file skipped",
+			skip:   0,
+			wanted: 10,
+			written: map[int][]piece.Destination{
+				0: {{Path: "t/b", Offset: 0, Start: 10, End: 16}},
+				1: {{Path: "t/b", Offset: 6, Start: 0, End: 4}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr.selection.priorities = nil
+			tr.SetPriorities(map[int]Priority{test.skip: PrioritySkip})
+
+			if tr.WantedLength() != test.wanted {
+				t.Fatalf("expected %d wanted bytes, got %d", test.wanted, tr.WantedLength())
+			}
+
+			got := make(map[int][]piece.Destination)
+			for _, pc := range tr.pieces() {
+				got[pc.Index] = pc.Destinations
+
+				if pc.Index == 0 && pc.Length != tr.PieceLength() {
+					t.Fatalf("expected the whole piece to be downloaded, got %d bytes", pc.Length)
+				}
+			}
+
+			if !reflect.DeepEqual(got, test.written) {
+				t.Fatalf("expected %+v, got %+v", test.written, got)
+			}
+		})
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	var (
+		paths   = []string{"docs/readme.txt", "video/movie.mkv", "video/extra.mkv", "sub.srt", "video/nested/clip.mkv"}
+		lengths = []int64{1, 2, 4, 8, 16}
+	)
+
+	const (
+		skip   = PrioritySkip
+		normal = PriorityNormal
+	)
+
+	tests := []struct {
+		name    string
+		only    []string
+		exclude []string
+		want    []Priority
+	}{
+		{
+			name: "everything",
+			want: []Priority{normal, normal, normal, normal, normal},
+		},
+		{
+			name: "only by name",
+			only: []string{"*.mkv"},
+			want: []Priority{skip, normal, normal, skip, normal},
+		},
+		{
+			name: "only by path",
+			only: []string{"video/*"},
+			want: []Priority{skip, normal, normal, skip, skip},
+		},
+		{
+			name: "several patterns",
+			only: []string{"*.srt", "docs/*"},
+			want: []Priority{normal, skip, skip, normal, skip},
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"extra*", "*.txt"},
+			want:    []Priority{skip, normal, skip, normal, normal},
+		},
+		{
+			name:    "only and exclude",
+			only:    []string{"*.mkv"},
+			exclude: []string{"video/extra.mkv"},
+			want:    []Priority{skip, normal, skip, skip, normal},
+		},
+		{
+			name: "nothing matches",
+			only: []string{"*.iso"},
+			want: []Priority{skip, skip, skip, skip, skip},
+		},
+		{
+			name: "the name of the torrent isn't a part of the path",
+			only: []string{"t/*"},
+			want: []Priority{skip, skip, skip, skip, skip},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newFilesTorrent(16, filesOf(paths, lengths))
+
+			if err := tr.SelectFiles(test.only, test.exclude); err != nil {
+				t.Fatal(err)
+			}
+
+			got := priorities(tr)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+
+			var wanted int64
+			for i, p := range got {
+				if p != PrioritySkip {
+					wanted += lengths[i]
+				}
+			}
+
+			if tr.WantedLength() != wanted {
+				t.Fatalf("expected %d wanted bytes, got %d", wanted, tr.WantedLength())
+			}
+		})
+	}
+
+	if err := newFilesTorrent(16, filesOf(paths, lengths)).SelectFiles([]string{"["}, nil); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+}
+
+// TestMagnetSelection makes sure that the file indexes of `so` map onto the
+// files in the order of the metadata
+func TestMagnetSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection []FileRange
+		want      []Priority
+	}{
+		{
+			name: "everything",
+			want: []Priority{0, 0, 0, 0},
+		},
+		{
+			name:      "single indexes",
+			selection: []FileRange{{0, 0}, {3, 3}},
+			want:      []Priority{0, PrioritySkip, PrioritySkip, 0},
+		},
+		{
+			name:      "range",
+			selection: []FileRange{{1, 2}},
+			want:      []Priority{PrioritySkip, 0, 0, PrioritySkip},
+		},
+		{
+			name:      "range beyond the files",
+			selection: []FileRange{{2, 2000000000}},
+			want:      []Priority{PrioritySkip, PrioritySkip, 0, 0},
+		},
+		{
+			name:      "nothing within the files",
+			selection: []FileRange{{10, 20}},
+			want:      []Priority{PrioritySkip, PrioritySkip, PrioritySkip, PrioritySkip},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newFilesTorrent(16, filesOf([]string{"a", "b", "c", "d"}, []int64{8, 8, 8, 8}))
+			tr.Selection = test.selection
+
+			if got := priorities(tr); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+
+	// Priorities which are set explicitly always apply
+	tr := newFilesTorrent(16, filesOf([]string{"a", "b"}, []int64{8, 8}))
+	tr.Selection = []FileRange{{0, 0}}
+	tr.SetPriorities(map[int]Priority{1: PriorityHigh})
+
+	if got, want := priorities(tr), []Priority{PriorityNormal, PriorityHigh}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
@@ -3,82 +3,191 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/hex"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
-	"net/url"
+	"reflect"
 	"strings"
 	"trumtorrent/bencode"
 	"trumtorrent/extension"
 	"trumtorrent/metadata"
+	"trumtorrent/peer"
+	"trumtorrent/picker"
 	"trumtorrent/piece"
 )
 
 // InfoFile represents one of multiples file within a torrent
 type InfoFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+	Length int64      `bencode:"length,required"`
+	Path   []string   `bencode:"path,required"`
+	Attr   Attributes `bencode:"attr,omitempty"`
+	// SymlinkPath is the target of a symlink, relative to the root of the
+	// torrent
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
 }
 
-// Info contains the practical data of a torrent
+// Info contains the practical data of a torrent, v1 torrents have pieces and
+// v2 (BEP 52) torrents have a file tree, hybrid torrents have both
 type Info struct {
-	Files       []InfoFile `bencode:"files"`
-	Length      int        `bencode:"length"`
-	Name        string     `bencode:"name"`
-	PieceLength int        `bencode:"piece length"`
-	Pieces      string     `bencode:"pieces"`
-	Private     int        `bencode:"private"`
+	Files       []InfoFile `bencode:"files,omitempty"`
+	Length      int64      `bencode:"length,omitempty"`
+	Name        string     `bencode:"name,required"`
+	PieceLength int        `bencode:"piece length,required"`
+	Pieces      string     `bencode:"pieces,omitempty"`
+	Private     int        `bencode:"private,omitempty"`
+	Attr        Attributes `bencode:"attr,omitempty"`
+	MetaVersion int        `bencode:"meta version,omitempty"`
+	FileTree    *FileTree  `bencode:"file tree,omitempty"`
+	// raw is the info dictionary exactly as it was found in the torrent (or
+	// metadata), it includes any keys we don't know of
+	raw bencode.RawMessage
+	// hasLength is true if the info dictionary has a `length` key, which
+	// can't be told from a zero `Length` (see `Validate`)
+	hasLength bool
+}
+
+// plainInfo has the fields of Info but none of its methods, it's used within
+// `Info.UnmarshalBencode` and `Info.MarshalBencode` so that they don't recurse
+// into themselves
+type plainInfo Info
+
+// decodedInfo is the info dictionary as it's decoded, the length (which hides
+// the length of plainInfo) is a pointer so that a `length` key can be told from
+// a missing one
+type decodedInfo struct {
+	plainInfo
+	Length *int64 `bencode:"length,omitempty"`
+}
+
+// UnmarshalBencode decodes the info dictionary and keeps a copy of its bytes
+func (i *Info) UnmarshalBencode(data []byte) error {
+	decoded := decodedInfo{}
+	if err := bencode.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	info := Info(decoded.plainInfo)
+	if decoded.Length != nil {
+		info.Length = *decoded.Length
+		info.hasLength = true
+	}
+
+	if err := info.validate(); err != nil {
+		return err
+	}
+
+	*i = info
+	return i.raw.UnmarshalBencode(data)
+}
+
+// MarshalBencode returns the original bytes of the info dictionary as long as
+// its fields are the ones decoded from them, since re-encoding it might not
+// result in the same bytes (e.g. unknown keys would be lost). Info which has
+// been changed is encoded from its fields.
+func (i Info) MarshalBencode() ([]byte, error) {
+	if len(i.raw) > 0 {
+		var original Info
+		if err := original.UnmarshalBencode(i.raw); err == nil && reflect.DeepEqual(original, i) {
+			return i.raw, nil
+		}
+	}
+
+	return bencode.Marshal(plainInfo(i))
 }
 
 // MetaInfo represents the container for meta data of a torrent
 type MetaInfo struct {
-	AnnounceList [][]string `bencode:"announce-list"`
-	Announce     string     `bencode:"announce"`
-	Comment      string     `bencode:"comment"`
-	CreatedBy    string     `bencode:"created by"`
-	CreationDate int        `bencode:"creation date"`
-	Encoding     string     `bencode:"encoding"`
-	Info         Info       `bencode:"info"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Announce     string     `bencode:"announce,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Encoding     string     `bencode:"encoding,omitempty"`
+	Info         Info       `bencode:"info,required"`
+	// PieceLayers maps the root of each (v2) file to the hashes of its pieces
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
 }
 
 // Incomplete is used in order to check if we need to download the metadata or
 // not (e.g. when we're downloading from a magnet link), this could most likely
 // be done in a better fashion
 func (m MetaInfo) Incomplete() bool {
-	return m.Info.Pieces == "" || m.Info.PieceLength == 0
+	return m.Info.PieceLength == 0 || (!m.Info.IsV1() && !m.Info.IsV2())
 }
 
 type Torrent struct {
 	MetaInfo MetaInfo
+	// InfoHash is the v1 info hash, or the truncated v2 info hash for v2-only
+	// torrents, i.e. what is used by trackers and peers
 	InfoHash []byte
-	PeerId   []byte
-	Pieces   chan *piece.Piece
+	// InfoHashV2 is the (full) v2 info hash, if the torrent is v2 or hybrid
+	InfoHashV2 []byte
+	PeerId     []byte
+	// Picker decides which pieces are downloaded, and in which order
+	Picker   *picker.Picker
 	Metadata *metadata.Metadata
+	// PeerHints are addresses (host:port) of peers given by a magnet link
+	PeerHints []string
+	// WebSeeds are given by a magnet link, but they're not downloaded from
+	WebSeeds []string
+	// Selection holds the ranges of the indexes of the files to download, all
+	// files are downloaded if it's empty
+	Selection []FileRange
+	// selection holds the patterns and priorities of files (see `SelectFiles`
+	// and `SetPriorities`)
+	selection selection
 	// length is simply a cache of the torrent size (since lots of torrents are
 	// in multiple file mode)
-	length int
+	length int64
 }
 
 func (t Torrent) Name() string {
 	return t.MetaInfo.Info.Name
 }
 
+// IsPrivate returns true if the torrent is private (see BEP 27), i.e. peers
+// may only be found through its trackers
+func (t Torrent) IsPrivate() bool {
+	return t.MetaInfo.Info.Private == 1
+}
+
+// AllowsPeerExchange returns true if peers may be found through other peers,
+// which is unknown until we've got the metadata
+func (t Torrent) AllowsPeerExchange() bool {
+	return !t.MetaInfo.Incomplete() && !t.IsPrivate()
+}
+
+// AllowsPeer returns false for peers of private torrents which were not given
+// by a tracker, since private trackers might ban clients which leak peers. It
+// has to be checked again once we've got the metadata, since magnet links
+// don't tell if a torrent is private.
+func (t Torrent) AllowsPeer(source peer.Source) bool {
+	return !t.IsPrivate() || source == peer.SourceTracker
+}
+
 func (t *Torrent) cacheLength() {
 	if t.MetaInfo.Info.Length > 0 {
 		t.length = t.MetaInfo.Info.Length
+		return
 	}
 
-	size := 0
+	var size int64
 	for _, file := range t.MetaInfo.Info.Files {
 		size += file.Length
 	}
 
+	if !t.MetaInfo.Info.IsV1() {
+		for _, file := range t.v2Files() {
+			size += file.Length
+		}
+	}
+
 	t.length = size
 }
 
-func (t Torrent) Length() int {
+func (t Torrent) Length() int64 {
 	if t.length == 0 {
 		t.cacheLength()
 	}
@@ -90,6 +199,25 @@ func (t Torrent) PieceLength() int {
 	return t.MetaInfo.Info.PieceLength
 }
 
+// PieceCount returns the number of pieces of the torrent (including pieces
+// which aren't wanted)
+func (t Torrent) PieceCount() int {
+	if t.MetaInfo.Info.IsV1() {
+		return len(t.MetaInfo.Info.Pieces) / 20
+	}
+
+	var (
+		count       int
+		pieceLength = int64(t.PieceLength())
+	)
+
+	for _, file := range t.v2Files() {
+		count += int((file.Length + pieceLength - 1) / pieceLength)
+	}
+
+	return count
+}
+
 func (t Torrent) IsMultipleFileMode() bool {
 	return len(t.MetaInfo.Info.Files) > 0
 }
@@ -106,162 +234,182 @@ func (t Torrent) PieceHash(index int) []byte {
 	return []byte(hash)
 }
 
+// IsValidPieceHash verifies a piece using the merkle trees of v2 torrents (see
+// `isValidV2Piece`) and the piece hashes of v1 torrents, hybrid torrents has to
+// pass both. The piece layers aren't a part of the metadata we get from peers,
+// so hybrid torrents without them (i.e. from magnet links) are only verified
+// by their v1 hashes.
 func (t Torrent) IsValidPieceHash(p *piece.Piece) bool {
-	pieceHash := sha1.Sum(p.Data)
-	return bytes.Equal(t.PieceHash(p.Index), pieceHash[:])
-}
-
-// destinations calculates where data from a Piece is supposed to be written (in
-// many cases it is split across multiple files)
-func (t Torrent) destinations(offset int, length int) []piece.Destination {
-	// If we're downloading a single file, we've only got one destination
-	if !t.IsMultipleFileMode() {
-		dst := piece.Destination{
-			Path:   t.Name(),
-			Offset: offset,
-			Start:  0,
-			End:    length,
-		}
+	verifyV2 := t.MetaInfo.Info.IsV2() && (len(t.MetaInfo.PieceLayers) > 0 || !t.MetaInfo.Info.IsV1())
 
-		return []piece.Destination{dst}
+	if verifyV2 && !t.isValidV2Piece(p.Index, p.Data) {
+		return false
 	}
 
-	var (
-		currOffset   int
-		overlap      int
-		destinations []piece.Destination
-	)
-
-	// FIXME: we need to check to see if this works with a piece split across
-	//        more then two files
-	for _, file := range t.MetaInfo.Info.Files {
-		boundary := currOffset + file.Length
-
-		dst := piece.Destination{
-			Path: t.Name() + "/" + strings.Join(file.Path, "/"),
-		}
+	if !t.MetaInfo.Info.IsV1() {
+		return t.MetaInfo.Info.IsV2()
+	}
 
-		// Whole piece fits within this file
-		if offset+length <= boundary {
-			if overlap > 0 {
-				dst.Offset = 0
-				dst.Start = overlap
-			} else {
-				dst.Offset = offset - currOffset
-				dst.Start = 0
-			}
-
-			dst.End = length
-			destinations = append(destinations, dst)
-			break
-		}
+	pieceHash := sha1.Sum(p.Data)
+	return bytes.Equal(t.PieceHash(p.Index), pieceHash[:])
+}
 
-		// Piece overlap file boundaries
-		if offset < boundary {
-			overlap = boundary - offset
-			dst.Offset = offset - currOffset
-			dst.Start = 0
-			dst.End = overlap
-			destinations = append(destinations, dst)
-		}
+func (t Torrent) pieces() []*piece.Piece {
+	var pieces []*piece.Piece
 
-		currOffset += file.Length - overlap
+	if t.MetaInfo.Info.IsV1() {
+		pieces = t.v1Pieces()
+	} else {
+		pieces = t.v2Pieces()
 	}
 
-	return destinations
+	return t.prioritize(pieces)
 }
 
-func (t Torrent) pieces() []*piece.Piece {
+func (t Torrent) v1Pieces() []*piece.Piece {
 	pieces := make([]*piece.Piece, len(t.MetaInfo.Info.Pieces)/20)
 
 	if len(pieces) == 0 {
 		return pieces
 	}
 
+	layout := t.v1Layout()
+
 	for index := range pieces {
 		length := t.PieceLength()
-		offset := index * t.PieceLength()
+		offset := int64(index) * int64(length)
 
 		// Last piece might be truncated
-		if index*length+length > t.Length() {
-			length = t.Length() - index*length
+		if offset+int64(length) > t.Length() {
+			length = int(t.Length() - offset)
 		}
 
 		pieces[index] = &piece.Piece{
 			Index:        index,
 			Length:       length,
 			Offset:       offset,
-			Destinations: t.destinations(offset, length),
+			Destinations: layout.Segments(offset, length),
 		}
 	}
 
-	// NOTE: It's not always the case that downloading in ascending order is the
-	// fastest (nothing I've tested though but from reading stuff online simply
-	// downloading in random order might prove to be more performant)
-	rand.Shuffle(len(pieces), func(i, j int) {
-		pieces[i], pieces[j] = pieces[j], pieces[i]
-	})
-
 	return pieces
 }
 
-func (t Torrent) Trackers() []string {
-	if len(t.MetaInfo.AnnounceList) == 0 {
-		if t.MetaInfo.Announce == "" {
-			return nil
-		}
+// Tiers returns the tiers of trackers (see BEP 12), which is a single tier with
+// the announce URL if there's no announce list
+func (t Torrent) Tiers() [][]string {
+	var tiers [][]string
 
-		return []string{t.MetaInfo.Announce}
+	for _, tier := range t.MetaInfo.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, append([]string(nil), tier...))
+		}
 	}
 
-	trackers := make([]string, len(t.MetaInfo.AnnounceList))
-	for i, announce := range t.MetaInfo.AnnounceList {
-		trackers[i] = announce[0]
+	if len(tiers) == 0 && t.MetaInfo.Announce != "" {
+		tiers = [][]string{{t.MetaInfo.Announce}}
 	}
 
-	return trackers
+	return tiers
 }
 
+// ErrInvalidMetadata is the error of metadata which matches the info hash but
+// can't be used, i.e. the torrent itself is broken
+var ErrInvalidMetadata = errors.New("torrent: invalid metadata")
+
 // ReceiveMetadata is used for collecting metadata messages
 func (t *Torrent) ReceiveMetadata(msg extension.Message) {
+	if t.Metadata.Err != nil {
+		return
+	}
+
 	t.Metadata.Receive(msg)
 
 	if t.Metadata.Complete() && t.MetaInfo.Incomplete() {
-		// TODO: handle this error
+		// NOTE: we can't tell which of the peers sent bad data, so all of the
+		// 		 pieces are requested again
+		if !t.matchesMetadata(t.Metadata.Data) {
+			fmt.Println("torrent: metadata does not match the info hash")
+			t.Metadata.Reset()
+			return
+		}
+
 		info := &Info{}
-		if err := bencode.Unmarshal(t.Metadata.Data, info); err != nil {
-			fmt.Println(err)
+		if err := bencode.Unmarshal(t.Metadata.Data, info, bencode.NetworkLimits()); err != nil {
+			t.Metadata.Fail(fmt.Errorf("%w: %v", ErrInvalidMetadata, err))
 			return
 		}
 
-		t.MetaInfo.Info = *info
-		t.populatePieceChannel()
+		// NOTE: the metadata is dropped if it's invalid, e.g. if there are more
+		// 		 pieces than the length implies
+		metainfo := t.MetaInfo
+		metainfo.Info = *info
+
+		if err := validateMetaInfo(&metainfo, false); err != nil {
+			t.Metadata.Fail(fmt.Errorf("%w: %v", ErrInvalidMetadata, err))
+			return
+		}
+
+		// NOTE: the piece layers aren't a part of the metadata, and requesting
+		// 		 them from peers (i.e. BEP 52 hash requests) isn't supported.
+		// 		 Hybrid torrents are verified by their v1 hashes instead.
+		if !info.IsV1() && (Torrent{MetaInfo: metainfo}).missesPieceLayers() {
+			t.Metadata.Fail(fmt.Errorf("%w: files larger than a piece can't be verified without the piece layers", ErrInvalidMetadata))
+			return
+		}
+
+		t.MetaInfo = metainfo
+
+		if info.IsV2() && t.InfoHashV2 == nil {
+			hash := sha256.Sum256(t.Metadata.Data)
+			t.InfoHashV2 = hash[:]
+		}
+
+		t.schedulePieces()
 		t.cacheLength()
 		close(t.Metadata.Wait)
 	}
 }
 
-func (t *Torrent) populatePieceChannel() {
-	if t.MetaInfo.Incomplete() {
-		return
+// matchesMetadata verifies the metadata (i.e. the info dictionary) against the
+// info hash, or against the v2 info hash for v2-only torrents
+func (t Torrent) matchesMetadata(data []byte) bool {
+	if t.isV2Only() {
+		hash := sha256.Sum256(data)
+		return bytes.Equal(hash[:], t.InfoHashV2)
 	}
 
-	pieces := t.pieces()
-	t.Pieces = make(chan *piece.Piece, len(pieces))
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], t.InfoHash)
+}
 
-	for _, piece := range pieces {
-		t.Pieces <- piece
+// schedulePieces hands the wanted pieces to the picker
+func (t *Torrent) schedulePieces() {
+	if t.MetaInfo.Incomplete() {
+		return
 	}
+
+	t.Picker.Reset(t.pieces())
 }
 
-func generateInfoHash(i Info) ([]byte, error) {
+// Hashes hashes the info dictionary, which (for an opened torrent) are the
+// bytes found on disk. The v1 hash is SHA-1 and the v2 hash is SHA-256 (the
+// latter is only returned for v2 and hybrid torrents).
+func (i Info) Hashes() (v1 []byte, v2 []byte, err error) {
 	data, err := bencode.Marshal(i)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	hash := sha1.Sum(data)
-	return hash[:], nil
+	v1 = hash[:]
+
+	if i.IsV2() {
+		hash := sha256.Sum256(data)
+		v2 = hash[:]
+	}
+
+	return v1, v2, nil
 }
 
 func generatePeerId() ([]byte, error) {
@@ -279,64 +427,68 @@ func generatePeerId() ([]byte, error) {
 // openTorrentFromMagnet creates a new 'incomplete' Torrent, which will require downloading
 // the metadata from Peers before the actual torrent
 func openTorrentFromMagnet(magnetLink string) (*Torrent, error) {
-	url, err := url.Parse(magnetLink)
+	m, err := ParseMagnet(magnetLink)
 	if err != nil {
 		return nil, err
 	}
 
-	values := url.Query()
-
-	if !values.Has("xt") || !values.Has("dn") || !values.Has("tr") {
-		return nil, errors.New("torrent: missing magnet link param (xt/dn/tr)")
+	metainfo := &MetaInfo{
+		Info: Info{Name: m.Name},
 	}
 
-	xt := values.Get("xt")
-
-	if !strings.HasPrefix(xt, "urn:btih:") {
-		return nil, fmt.Errorf("torrent: invalid prefix for param 'xt', got %s", xt)
+	for _, tracker := range m.Trackers {
+		metainfo.AnnounceList = append(metainfo.AnnounceList, []string{tracker})
 	}
 
-	tr := values["tr"]
-
-	if len(tr) == 0 {
-		return nil, errors.New("torrent: no trackers")
+	if len(m.Trackers) > 0 {
+		metainfo.Announce = m.Trackers[0]
 	}
 
-	trackers := make([][]string, len(tr))
-	for i, tracker := range tr {
-		trackers[i] = []string{tracker}
+	// NOTE: v2-only torrents use the truncated v2 info hash on the wire, the
+	// 		 metadata is verified against the whole v2 info hash
+	infoHash := m.InfoHash
+	if infoHash == nil {
+		infoHash = m.InfoHashV2[:20]
 	}
 
-	// len("urn:btih:")
-	hashAsHex := []byte(xt[9:])
-	hash := make([]byte, hex.DecodedLen(len(hashAsHex)))
-	_, err = hex.Decode(hash, hashAsHex)
+	peerId, err := generatePeerId()
 	if err != nil {
-		return nil, errors.New("torrent: unable to decode info hash")
+		return nil, err
 	}
 
-	name := values.Get("dn")
+	return &Torrent{
+		MetaInfo:   *metainfo,
+		InfoHash:   infoHash,
+		InfoHashV2: m.InfoHashV2,
+		PeerId:     peerId,
+		Picker:     picker.New(),
+		PeerHints:  m.Peers,
+		WebSeeds:   m.WebSeeds,
+		Selection:  m.Select,
+	}, nil
+}
 
-	if len(name) == 0 {
-		return nil, errors.New("torrent: empty name")
+// Load reads the MetaInfo of a .torrent file, without validating it (see
+// `Validate`). The file has to be in canonical form (see `bencode.Strict`),
+// since unsorted or duplicate keys might be read differently by other clients
+// for the same info hash, a `ValidationError` is returned if it isn't.
+func Load(path string) (*MetaInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	metainfo := &MetaInfo{
-		AnnounceList: trackers,
-		Announce:     trackers[0][0],
-		Info:         Info{Name: name},
-	}
+	metainfo := &MetaInfo{}
+	if err = bencode.Unmarshal(data, metainfo, bencode.Strict()); err != nil {
+		var serr *bencode.SyntaxError
+		if errors.As(err, &serr) {
+			return nil, &ValidationError{Problems: []string{"the file is not well formed: " + serr.Error()}}
+		}
 
-	peerId, err := generatePeerId()
-	if err != nil {
 		return nil, err
 	}
 
-	return &Torrent{
-		MetaInfo: *metainfo,
-		InfoHash: hash,
-		PeerId:   peerId,
-	}, nil
+	return metainfo, nil
 }
 
 // Open reads a torrent from disk (a .torrent file) or a incomplete torrent from
@@ -346,33 +498,39 @@ func Open(path string) (*Torrent, error) {
 		return openTorrentFromMagnet(path)
 	}
 
-	data, err := ioutil.ReadFile(path)
+	metainfo, err := Load(path)
 	if err != nil {
 		return nil, err
 	}
 
-	metainfo := &MetaInfo{}
-	if err = bencode.Unmarshal(data, metainfo); err != nil {
+	if err = Validate(metainfo); err != nil {
 		return nil, err
 	}
 
-	hash, err := generateInfoHash(metainfo.Info)
+	hash, hashV2, err := metainfo.Info.Hashes()
 	if err != nil {
 		return nil, err
 	}
 
+	// NOTE: v2-only torrents use the truncated v2 hash on the wire
+	if !metainfo.Info.IsV1() {
+		hash = hashV2[:20]
+	}
+
 	peerId, err := generatePeerId()
 	if err != nil {
 		return nil, err
 	}
 
 	t := &Torrent{
-		MetaInfo: *metainfo,
-		InfoHash: hash,
-		PeerId:   peerId,
+		MetaInfo:   *metainfo,
+		InfoHash:   hash,
+		InfoHashV2: hashV2,
+		PeerId:     peerId,
+		Picker:     picker.New(),
 	}
 
-	t.populatePieceChannel()
+	t.schedulePieces()
 	t.cacheLength()
 	return t, nil
 }
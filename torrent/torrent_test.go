@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"trumtorrent/bencode"
+	"trumtorrent/extension"
+	"trumtorrent/metadata"
+)
+
+// receiveMetadata opens a magnet link of the info dictionary `data`, and
+// receives `data` as its metadata
+func receiveMetadata(t *testing.T, data string) *Torrent {
+	t.Helper()
+
+	hash := sha1.Sum([]byte(data))
+
+	tr, err := Open("magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Metadata = metadata.New(len(data))
+	tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: []byte(data)})
+	return tr
+}
+
+func TestReceiveMetadata(t *testing.T) {
+	tr := receiveMetadata(t, "d6:lengthi40e4:name1:a12:piece lengthi16e6:pieces60:"+pieces(3)+"e")
+
+	if tr.MetaInfo.Incomplete() {
+		t.Fatal("expected the metadata to be received")
+	}
+
+	if tr.PieceCount() != 3 || tr.WantedLength() != 40 {
+		t.Fatalf("expected 3 pieces of 40 bytes, got %d pieces of %d bytes", tr.PieceCount(), tr.WantedLength())
+	}
+
+	select {
+	case <-tr.Metadata.Wait:
+	default:
+		t.Fatal("expected the metadata to be complete")
+	}
+}
+
+// TestReceiveInvalidMetadata makes sure that metadata which is invalid (even
+// though it matches the info hash) is dropped, rather than making the last
+// piece have a negative length
+func TestReceiveInvalidMetadata(t *testing.T) {
+	tr := receiveMetadata(t, "d6:lengthi16e4:name1:a12:piece lengthi16e6:pieces60:"+pieces(3)+"e")
+
+	if !tr.MetaInfo.Incomplete() {
+		t.Fatal("expected invalid metadata to be dropped")
+	}
+
+	if tr.WantedLength() != 0 {
+		t.Fatalf("expected no pieces to be scheduled, got %d bytes", tr.WantedLength())
+	}
+
+	// Clients which wait for the metadata are given the error
+	select {
+	case <-tr.Metadata.Wait:
+	default:
+		t.Fatal("expected the metadata to be failed")
+	}
+
+	if !errors.Is(tr.Metadata.Err, ErrInvalidMetadata) {
+		t.Fatalf("expected %v, got %v", ErrInvalidMetadata, tr.Metadata.Err)
+	}
+
+	// More pieces of the metadata are ignored
+	tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: tr.Metadata.Data})
+}
+
+// TestReceiveMismatchedMetadata makes sure that metadata which doesn't match
+// the info hash is requested again
+func TestReceiveMismatchedMetadata(t *testing.T) {
+	data := "d6:lengthi40e4:name1:a12:piece lengthi16e6:pieces60:" + pieces(3) + "e"
+	hash := sha1.Sum([]byte(data))
+
+	tr, err := Open("magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Metadata = metadata.New(len(data))
+	<-tr.Metadata.Pieces
+
+	tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: []byte(strings.ToUpper(data))})
+
+	if !tr.MetaInfo.Incomplete() || tr.Metadata.HasPiece(0) {
+		t.Fatal("expected the metadata to be dropped")
+	}
+
+	select {
+	case piece := <-tr.Metadata.Pieces:
+		if piece != 0 {
+			t.Fatalf("expected piece 0 to be requested again, got %d", piece)
+		}
+	default:
+		t.Fatal("expected the pieces to be requested again")
+	}
+
+	tr.ReceiveMetadata(extension.Message{Type: extension.MessageData, Piece: 0, Metadata: []byte(data)})
+
+	if tr.MetaInfo.Incomplete() || tr.Metadata.Err != nil {
+		t.Fatalf("expected the metadata to be received, got %v", tr.Metadata.Err)
+	}
+}
+
+// TestLoadStrict makes sure that .torrent files which aren't in canonical form
+// are rejected, with the offset and path of the problem
+func TestLoadStrict(t *testing.T) {
+	info := "d6:lengthi32e4:name1:a12:piece lengthi16e6:pieces40:" + pieces(2) + "e"
+
+	tests := []struct {
+		name string
+		data string
+		// problem is a part of the expected problem, the file is expected to
+		// be loaded if it's empty
+		problem string
+	}{
+		{name: "canonical", data: "d8:announce3:url4:info" + info + "e"},
+		{name: "unsorted keys", data: "d4:info" + info + "8:announce3:urle", problem: "at offset 100"},
+		{
+			name:    "duplicate key within info",
+			data:    "d4:infod6:lengthi32e6:lengthi32e4:name1:a12:piece lengthi16e6:pieces40:" + pieces(2) + "ee",
+			problem: "(in 'info')",
+		},
+		{name: "leading zero", data: "d4:infod6:lengthi032e4:name1:a12:piece lengthi16e6:pieces40:" + pieces(2) + "ee", problem: "at offset 16 (in 'info.length')"},
+		{name: "trailing data", data: "d4:info" + info + "etrailing", problem: "at offset 101"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "a.torrent")
+			if err := os.WriteFile(name, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Load(name)
+			if test.problem == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || len(verr.Problems) != 1 || !strings.Contains(verr.Problems[0], test.problem) {
+				t.Fatalf("expected a problem containing '%s', got %v", test.problem, err)
+			}
+		})
+	}
+}
+
+// TestInfoMarshal makes sure that the info dictionary keeps its original bytes
+// (including keys we don't know of), unless its fields are changed
+func TestInfoMarshal(t *testing.T) {
+	data := "d6:lengthi32e4:name1:a12:piece lengthi16e6:pieces40:" + pieces(2) + "7:privatei0e6:source3:abce"
+
+	var info Info
+	if err := bencode.Unmarshal([]byte(data), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.hasLength {
+		t.Fatal("expected the length key to be found")
+	}
+
+	got, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != data {
+		t.Fatalf("expected the original bytes %q, got %q", data, got)
+	}
+
+	hash, _, err := info.Hashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.Name = "b"
+
+	got, err = bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "d6:lengthi32e4:name1:b12:piece lengthi16e6:pieces40:" + pieces(2) + "e"; string(got) != want {
+		t.Fatalf("expected the changed info to be encoded as %q, got %q", want, got)
+	}
+
+	if changed, _, _ := info.Hashes(); bytes.Equal(changed, hash) {
+		t.Fatal("expected the info hash to change along with the info")
+	}
+
+	// A missing length can be told from a zero length
+	var files Info
+	if err := bencode.Unmarshal([]byte("d5:filesld6:lengthi1e4:pathl1:aeee4:name1:a12:piece lengthi16e6:pieces20:"+pieces(1)+"e"), &files); err != nil {
+		t.Fatal(err)
+	}
+
+	if files.hasLength {
+		t.Fatal("expected the length key to be missing")
+	}
+}
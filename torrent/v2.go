@@ -0,0 +1,374 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"trumtorrent/bencode"
+	"trumtorrent/piece"
+)
+
+// BlockSize is the size of the leaves of the (v2) merkle trees
+const BlockSize = 16 << 10
+
+// FileTreeFile holds the attributes of a file within the (v2) file tree
+type FileTreeFile struct {
+	Length int64 `bencode:"length,required"`
+	// PiecesRoot is the root of the merkle tree of the file, it's empty for
+	// empty files
+	PiecesRoot  string     `bencode:"pieces root,omitempty"`
+	Attr        Attributes `bencode:"attr,omitempty"`
+	SymlinkPath []string   `bencode:"symlink path,omitempty"`
+}
+
+// FileTree represents the (v2) tree of directories and files of a torrent.
+// Files are bencoded as a dictionary with a single empty key ("") holding the
+// attributes of the file.
+type FileTree struct {
+	File *FileTreeFile
+	Dir  map[string]*FileTree
+}
+
+// UnmarshalBencode decodes one level of the file tree at a time
+func (t *FileTree) UnmarshalBencode(data []byte) error {
+	var entries map[string]bencode.RawMessage
+	if err := bencode.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	*t = FileTree{}
+
+	for name, raw := range entries {
+		if name == "" {
+			file := &FileTreeFile{}
+			if err := bencode.Unmarshal(raw, file); err != nil {
+				return err
+			}
+
+			if file.Length > 0 && len(file.PiecesRoot) != sha256.Size {
+				return errors.New("torrent: invalid 'pieces root' in file tree")
+			}
+
+			t.File = file
+			continue
+		}
+
+		child := &FileTree{}
+		if err := child.UnmarshalBencode(raw); err != nil {
+			return err
+		}
+
+		if t.Dir == nil {
+			t.Dir = make(map[string]*FileTree)
+		}
+
+		t.Dir[name] = child
+	}
+
+	if t.File != nil && len(t.Dir) > 0 {
+		return errors.New("torrent: file tree entry is both a file and a directory")
+	}
+
+	return nil
+}
+
+func (t FileTree) MarshalBencode() ([]byte, error) {
+	if t.File != nil {
+		return bencode.Marshal(map[string]*FileTreeFile{"": t.File})
+	}
+
+	return bencode.Marshal(t.Dir)
+}
+
+// V2File represents a file found in the (v2) file tree
+type V2File struct {
+	Path        []string
+	Length      int64
+	PiecesRoot  []byte
+	Attr        Attributes
+	SymlinkPath []string
+}
+
+func (t *FileTree) walk(path []string, files []V2File) []V2File {
+	if t.File != nil {
+		return append(files, V2File{
+			Path:        append([]string(nil), path...),
+			Length:      t.File.Length,
+			PiecesRoot:  []byte(t.File.PiecesRoot),
+			Attr:        t.File.Attr,
+			SymlinkPath: t.File.SymlinkPath,
+		})
+	}
+
+	names := make([]string, 0, len(t.Dir))
+	for name := range t.Dir {
+		names = append(names, name)
+	}
+
+	// NOTE: files are ordered as they're found in the (bencoded) tree
+	sort.Strings(names)
+
+	for _, name := range names {
+		files = t.Dir[name].walk(append(path, name), files)
+	}
+
+	return files
+}
+
+// Files returns all files of the tree in order
+func (t *FileTree) Files() []V2File {
+	if t == nil {
+		return nil
+	}
+
+	return t.walk(nil, nil)
+}
+
+// hashPair is used for computing the parent of two nodes in a merkle tree
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// merkleRoot returns the root of a merkle tree with `width` leaves (a power of
+// two), leaves beyond the given ones are set to `pad`
+func merkleRoot(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, leaves)
+
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := layer[:len(layer)/2]
+
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+
+		layer = next
+	}
+
+	return layer[0]
+}
+
+// nextPowerOfTwo returns the smallest power of two which is >= n
+func nextPowerOfTwo(n int) int {
+	width := 1
+	for width < n {
+		width *= 2
+	}
+
+	return width
+}
+
+// blockHashes returns the leaves (the hashes of each 16 KiB block) of `data`
+func blockHashes(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+
+	for len(data) > 0 {
+		n := BlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		leaves = append(leaves, sha256.Sum256(data[:n]))
+		data = data[n:]
+	}
+
+	return leaves
+}
+
+// padHash returns the root of a tree of `width` zero leaves, i.e. what the
+// piece layer is padded with
+func padHash(width int) [32]byte {
+	return merkleRoot(nil, width, [32]byte{})
+}
+
+// IsV1 returns true if the info contains v1 data (i.e. pieces)
+func (i Info) IsV1() bool {
+	return i.Pieces != ""
+}
+
+// IsV2 returns true if the info contains v2 data (i.e. a file tree)
+func (i Info) IsV2() bool {
+	return i.MetaVersion == 2 && i.FileTree != nil
+}
+
+// IsHybrid returns true if the info contains both v1 and v2 data
+func (i Info) IsHybrid() bool {
+	return i.IsV1() && i.IsV2()
+}
+
+// validate makes sure that the info contains the fields required by either v1
+// or v2 torrents
+func (i Info) validate() error {
+	if i.MetaVersion != 0 && i.MetaVersion != 2 {
+		return fmt.Errorf("torrent: unsupported meta version %d", i.MetaVersion)
+	}
+
+	if i.MetaVersion == 2 {
+		if i.FileTree == nil {
+			return &bencode.MissingFieldError{Field: "file tree"}
+		}
+
+		// NOTE: v2 requires the piece length to be a power of two (>= 16 KiB)
+		if i.PieceLength < BlockSize || i.PieceLength&(i.PieceLength-1) != 0 {
+			return fmt.Errorf("torrent: invalid v2 piece length %d", i.PieceLength)
+		}
+
+		if i.FileTree.File != nil {
+			return errors.New("torrent: the root of the file tree can't be a file")
+		}
+
+		return nil
+	}
+
+	if i.Pieces == "" {
+		return &bencode.MissingFieldError{Field: "pieces"}
+	}
+
+	return nil
+}
+
+// v2Files returns the files of the file tree
+func (t Torrent) v2Files() []V2File {
+	return t.MetaInfo.Info.FileTree.Files()
+}
+
+// v2Piece returns the file of the piece at `index` and the index of the piece
+// within that file (v2 pieces never span multiple files)
+func (t Torrent) v2Piece(index int) (V2File, int, bool) {
+	pieceLength := int64(t.PieceLength())
+
+	for _, file := range t.v2Files() {
+		count := int((file.Length + pieceLength - 1) / pieceLength)
+
+		if index < count {
+			return file, index, true
+		}
+
+		index -= count
+	}
+
+	return V2File{}, 0, false
+}
+
+// v2Pieces returns the pieces of a v2 torrent, each file starts at a piece
+// boundary (as if each file was padded)
+func (t Torrent) v2Pieces() []*piece.Piece {
+	var (
+		layout      = t.v2Layout()
+		pieceLength = int64(t.PieceLength())
+		pieces      []*piece.Piece
+	)
+
+	for _, file := range layout.Files() {
+		for begin := int64(0); begin < file.Length; begin += pieceLength {
+			length := pieceLength
+			if begin+length > file.Length {
+				length = file.Length - begin
+			}
+
+			pieces = append(pieces, &piece.Piece{
+				Index:        len(pieces),
+				Length:       int(length),
+				Offset:       file.Offset + begin,
+				Destinations: layout.Segments(file.Offset+begin, int(length)),
+			})
+		}
+	}
+
+	return pieces
+}
+
+// missesPieceLayers returns true if there's a file larger than one piece which
+// hasn't got a piece layer, i.e. whose pieces can't be verified
+func (t Torrent) missesPieceLayers() bool {
+	pieceLength := int64(t.PieceLength())
+
+	for _, file := range t.v2Files() {
+		if file.Length > pieceLength && len(t.MetaInfo.PieceLayers[string(file.PiecesRoot)]) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isValidV2Piece verifies the data of a piece against the piece layer of its
+// file, or against the root of the file if it only consists of one piece
+func (t Torrent) isValidV2Piece(index int, data []byte) bool {
+	file, n, ok := t.v2Piece(index)
+	if !ok {
+		return false
+	}
+
+	pieceLength := int64(t.PieceLength())
+
+	// NOTE: for hybrid torrents the data of the last piece of a file might
+	// 		 contain padding, which isn't a part of the file
+	if remaining := file.Length - int64(n)*pieceLength; int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+
+	leaves := blockHashes(data)
+
+	if file.Length <= pieceLength {
+		root := merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+		return bytes.Equal(root[:], file.PiecesRoot)
+	}
+
+	layer := t.MetaInfo.PieceLayers[string(file.PiecesRoot)]
+	begin := n * sha256.Size
+
+	if begin+sha256.Size > len(layer) {
+		return false
+	}
+
+	root := merkleRoot(leaves, int(pieceLength/BlockSize), [32]byte{})
+	return layer[begin:begin+sha256.Size] == string(root[:])
+}
+
+// validatePieceLayers makes sure that the piece layers (of each file larger
+// than one piece) hash to the root of each file, i.e. the piece layers are the
+// proofs of the pieces
+func (m MetaInfo) validatePieceLayers() error {
+	pieceLength := int64(m.Info.PieceLength)
+	if pieceLength < BlockSize {
+		return fmt.Errorf("torrent: invalid v2 piece length %d", pieceLength)
+	}
+
+	pad := padHash(int(pieceLength / BlockSize))
+
+	for _, file := range m.Info.FileTree.Files() {
+		if file.Length <= pieceLength {
+			continue
+		}
+
+		layer, ok := m.PieceLayers[string(file.PiecesRoot)]
+		count := int((file.Length + pieceLength - 1) / pieceLength)
+
+		if !ok || len(layer) != count*sha256.Size {
+			return fmt.Errorf("torrent: missing or invalid piece layer of '%s'", strings.Join(file.Path, "/"))
+		}
+
+		hashes := make([][32]byte, count)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*sha256.Size:])
+		}
+
+		root := merkleRoot(hashes, nextPowerOfTwo(count), pad)
+		if !bytes.Equal(root[:], file.PiecesRoot) {
+			return fmt.Errorf("torrent: piece layer of '%s' does not match its root", strings.Join(file.Path, "/"))
+		}
+	}
+
+	return nil
+}
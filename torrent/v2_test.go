@@ -0,0 +1,248 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"trumtorrent/piece"
+)
+
+// The known answers of testdata/hybrid.torrent, which were computed by an
+// independent implementation of BEP 52 (building the whole merkle tree of each
+// file rather than going through the piece layers). Its files are:
+//
+//	a	150000 bytes (5 pieces, i.e. the piece layer is padded)
+//	b	20000 bytes (a single piece of two blocks)
+//	c/d	5 bytes
+//	e	empty
+//
+// The v1 part has padding files after a and b.
+const (
+	hybridInfoHash   = "aad22e2ceb8a16a8309440550f01cebae3fac9b8"
+	hybridInfoHashV2 = "1a0ffa3ff29a1ee66cc16a1dc9bd7664f272e28351c890969fb92e7c28bd23d1"
+	hybridPieceLayer = "60790c906a65c0dc99ec746dc8911c2c5ab806ba728f5e8b45e9c133dfe83a87" +
+		"89e5f7c6dec9953430dc83c4140f609fd6f7db8ca34adb1ada1db8ea7b47ddc1" +
+		"7cb9292ab8b98b9f5547741682687e24b9fa71e9a86b2ad131354b43f2fe0a74" +
+		"422915ba52f7e0f3b5abda288598bf918e3dcf092e988283f258537196ce435a" +
+		"ca165ed568fdf20513c1ac6064de3f8ce3173315209cf12ffd910ec56698bb44"
+)
+
+var hybridRoots = map[string]string{
+	"a":   "808a7953d892abe33a27b48b047d4bbc9c6488f026be165b09dea492fe5285a4",
+	"b":   "88daaef749b0d24a3ba43e6e6285e575d93d730549555c048e462144aa519024",
+	"c/d": "15af25bcdd8e72e816db3b97e9e9b4ae5dad2ae147a5449d4ca860a6a3e11570",
+}
+
+// hybridFile returns the data of the file at `index` of the hybrid torrent,
+// which is generated by a linear congruential generator
+func hybridFile(index int, length int) []byte {
+	var (
+		x    = uint32(index + 1)
+		data = make([]byte, length)
+	)
+
+	for i := range data {
+		x = (x*1103515245 + 12345) & 0x7fffffff
+		data[i] = byte(x >> 16)
+	}
+
+	return data
+}
+
+// hybridData returns the data of the hybrid torrent as it's laid out in pieces,
+// i.e. with the padding of the v1 part
+func hybridData() []byte {
+	var data []byte
+
+	for index, length := range []int{150000, 20000, 5} {
+		data = append(data, hybridFile(index, length)...)
+
+		if index < 2 {
+			data = append(data, make([]byte, 32768-length%32768)...)
+		}
+	}
+
+	return data
+}
+
+func openHybrid(t *testing.T) *Torrent {
+	t.Helper()
+
+	tr, err := Open(filepath.Join("testdata", "hybrid.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tr
+}
+
+func TestMerkleRoot(t *testing.T) {
+	// A file of a single piece is the root of its blocks
+	b := hybridFile(1, 20000)
+	leaves := blockHashes(b)
+
+	if root := merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{}); hex.EncodeToString(root[:]) != hybridRoots["b"] {
+		t.Fatalf("expected the root of b to be %s, got %x", hybridRoots["b"], root)
+	}
+
+	// A file of a single block is the hash of the block
+	d := hybridFile(2, 5)
+	if root := merkleRoot(blockHashes(d), 1, [32]byte{}); hex.EncodeToString(root[:]) != hybridRoots["c/d"] {
+		t.Fatalf("expected the root of c/d to be %s, got %x", hybridRoots["c/d"], root)
+	}
+
+	// Larger files go through the piece layer, which is padded with the root
+	// of a piece of zeros
+	a := hybridFile(0, 150000)
+
+	var layer [][32]byte
+	for begin := 0; begin < len(a); begin += 32768 {
+		end := begin + 32768
+		if end > len(a) {
+			end = len(a)
+		}
+
+		layer = append(layer, merkleRoot(blockHashes(a[begin:end]), 2, [32]byte{}))
+	}
+
+	var got string
+	for _, hash := range layer {
+		got += hex.EncodeToString(hash[:])
+	}
+
+	if got != hybridPieceLayer {
+		t.Fatalf("expected the piece layer of a to be %s, got %s", hybridPieceLayer, got)
+	}
+
+	if root := merkleRoot(layer, nextPowerOfTwo(len(layer)), padHash(2)); hex.EncodeToString(root[:]) != hybridRoots["a"] {
+		t.Fatalf("expected the root of a to be %s, got %x", hybridRoots["a"], root)
+	}
+}
+
+func TestHybridTorrent(t *testing.T) {
+	tr := openHybrid(t)
+
+	if !tr.MetaInfo.Info.IsHybrid() {
+		t.Fatal("expected a hybrid torrent")
+	}
+
+	if hex.EncodeToString(tr.InfoHash) != hybridInfoHash {
+		t.Fatalf("expected the info hash %s, got %x", hybridInfoHash, tr.InfoHash)
+	}
+
+	if hex.EncodeToString(tr.InfoHashV2) != hybridInfoHashV2 {
+		t.Fatalf("expected the v2 info hash %s, got %x", hybridInfoHashV2, tr.InfoHashV2)
+	}
+
+	for _, file := range tr.MetaInfo.Info.FileTree.Files() {
+		if want := hybridRoots[strings.Join(file.Path, "/")]; hex.EncodeToString(file.PiecesRoot) != want {
+			t.Errorf("expected the root of %s to be %s, got %x", strings.Join(file.Path, "/"), want, file.PiecesRoot)
+		}
+	}
+
+	if tr.PieceCount() != 7 {
+		t.Fatalf("expected 7 pieces, got %d", tr.PieceCount())
+	}
+}
+
+// TestVerifyV2Pieces verifies every piece of the hybrid torrent, both as it is
+// and as a v2-only torrent (i.e. only by the merkle trees)
+func TestVerifyV2Pieces(t *testing.T) {
+	hybrid := openHybrid(t)
+
+	v2 := *hybrid
+	v2.MetaInfo.Info.Pieces = ""
+	v2.MetaInfo.Info.Files = nil
+
+	data := hybridData()
+
+	for name, tr := range map[string]*Torrent{"hybrid": hybrid, "v2": &v2} {
+		t.Run(name, func(t *testing.T) {
+			for index := 0; index < tr.PieceCount(); index++ {
+				begin := index * tr.PieceLength()
+				end := begin + tr.PieceLength()
+
+				if end > len(data) {
+					end = len(data)
+				}
+
+				p := &piece.Piece{Index: index, Data: append([]byte(nil), data[begin:end]...)}
+				if !tr.IsValidPieceHash(p) {
+					t.Fatalf("expected piece %d to be valid", index)
+				}
+
+				p.Data[len(p.Data)/2] ^= 0xff
+				if tr.IsValidPieceHash(p) {
+					t.Fatalf("expected corrupt piece %d to be invalid", index)
+				}
+			}
+		})
+	}
+
+	// Pieces can't be swapped within a file
+	p := &piece.Piece{Index: 1, Data: data[:32768]}
+	if v2.IsValidPieceHash(p) {
+		t.Fatal("expected a piece at the wrong index to be invalid")
+	}
+}
+
+// TestVerifyHybridWithoutPieceLayers makes sure that hybrid torrents from magnet
+// links (which don't have the piece layers) are verified by their v1 hashes
+func TestVerifyHybridWithoutPieceLayers(t *testing.T) {
+	tr := openHybrid(t)
+	tr.MetaInfo.PieceLayers = nil
+
+	data := hybridData()
+	p := &piece.Piece{Index: 1, Data: data[32768:65536]}
+
+	if !tr.IsValidPieceHash(p) {
+		t.Fatal("expected the piece to be verified by its v1 hash")
+	}
+
+	if p.Index = 2; tr.IsValidPieceHash(p) {
+		t.Fatal("expected a piece at the wrong index to be invalid")
+	}
+}
+
+func TestValidatePieceLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *MetaInfo)
+	}{
+		{"missing piece layer", func(m *MetaInfo) {
+			m.PieceLayers = nil
+		}},
+		{"short piece layer", func(m *MetaInfo) {
+			for root, layer := range m.PieceLayers {
+				m.PieceLayers[root] = layer[32:]
+			}
+		}},
+		{"tampered piece layer", func(m *MetaInfo) {
+			for root, layer := range m.PieceLayers {
+				m.PieceLayers[root] = layer[32:64] + layer[32:]
+			}
+		}},
+		{"zero piece length", func(m *MetaInfo) {
+			m.Info.PieceLength = 0
+		}},
+		{"tiny piece length", func(m *MetaInfo) {
+			m.Info.PieceLength = 1
+		}},
+	}
+
+	if err := Validate(&openHybrid(t).MetaInfo); err != nil {
+		t.Fatalf("expected the hybrid torrent to be valid, got %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := openHybrid(t).MetaInfo
+			test.modify(&m)
+
+			if err := Validate(&m); err == nil {
+				t.Fatal("expected the piece layers to be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError holds all problems found when validating a MetaInfo
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "torrent: invalid metainfo (" + strings.Join(e.Problems, "; ") + ")"
+}
+
+// isSafePathComponent returns false for components which could place a file
+// outside of the torrent directory (e.g. `..` or absolute paths)
+func isSafePathComponent(name string) bool {
+	switch name {
+	case "", ".", "..":
+		return false
+	}
+
+	return !strings.ContainsAny(name, "/\\\x00") && !(len(name) >= 2 && name[1] == ':')
+}
+
+// validator collects the problems found while validating
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// symlink validates the target of a symlink, which must be within the torrent
+func (v *validator) symlink(path, target []string) {
+	if len(target) == 0 {
+		v.addf("symlink '%s' is missing its target", strings.Join(path, "/"))
+		return
+	}
+
+	v.path(target)
+}
+
+func (v *validator) path(path []string) {
+	if len(path) == 0 {
+		v.addf("file has an empty path")
+		return
+	}
+
+	for _, name := range path {
+		if !isSafePathComponent(name) {
+			v.addf("unsafe path '%s'", strings.Join(path, "/"))
+			return
+		}
+	}
+}
+
+// v1 validates the pieces, lengths and paths of a v1 (or hybrid) torrent
+func (v *validator) v1(i Info) int64 {
+	switch {
+	case (i.Length != 0 || i.hasLength) && len(i.Files) > 0:
+		v.addf("both 'length' and 'files' are present")
+	case i.Length < 0:
+		v.addf("invalid length %d", i.Length)
+	case i.Length == 0 && len(i.Files) == 0:
+		v.addf("missing 'length' or 'files'")
+	}
+
+	length := i.Length
+
+	// NOTE: empty files are allowed within multiple file torrents (they're
+	// 		 quite common), but the torrent as a whole can't be empty
+	for _, file := range i.Files {
+		if file.Length < 0 {
+			v.addf("invalid length %d of '%s'", file.Length, strings.Join(file.Path, "/"))
+		}
+
+		v.path(file.Path)
+		length += file.Length
+
+		if file.Attr.IsSymlink() {
+			v.symlink(file.Path, file.SymlinkPath)
+		}
+	}
+
+	if len(i.Files) > 0 && length <= 0 {
+		v.addf("all files are empty")
+	}
+
+	if len(i.Pieces)%20 != 0 {
+		v.addf("length of pieces (%d) is not a multiple of 20", len(i.Pieces))
+	} else if i.PieceLength > 0 && length > 0 {
+		expected := (length + int64(i.PieceLength) - 1) / int64(i.PieceLength)
+
+		if count := int64(len(i.Pieces) / 20); count != expected {
+			v.addf("expected %d pieces for a length of %d, got %d", expected, length, count)
+		}
+	}
+
+	return length
+}
+
+// v2 validates the lengths and paths of the file tree, and its piece layers if
+// `layers` is true
+func (v *validator) v2(m *MetaInfo, layers bool) int64 {
+	var length int64
+
+	files := m.Info.FileTree.Files()
+	if len(files) == 0 {
+		v.addf("file tree is empty")
+	}
+
+	for _, file := range files {
+		if file.Length < 0 {
+			v.addf("invalid length %d of '%s'", file.Length, strings.Join(file.Path, "/"))
+		}
+
+		v.path(file.Path)
+		length += file.Length
+
+		if file.Attr.IsSymlink() {
+			v.symlink(file.Path, file.SymlinkPath)
+		}
+	}
+
+	if !layers {
+		return length
+	}
+
+	if err := m.validatePieceLayers(); err != nil {
+		v.addf("%s", strings.TrimPrefix(err.Error(), "torrent: "))
+	}
+
+	return length
+}
+
+// Validate checks the metainfo for problems which would make the torrent
+// impossible (or unsafe) to download, all problems are returned as a
+// ValidationError
+func Validate(m *MetaInfo) error {
+	return validateMetaInfo(m, true)
+}
+
+// validateMetaInfo is `Validate`, but the piece layers are only checked if
+// `layers` is true since they're not a part of the metadata we get from peers
+func validateMetaInfo(m *MetaInfo, layers bool) error {
+	v := &validator{}
+	i := m.Info
+
+	if !isSafePathComponent(i.Name) {
+		v.addf("unsafe name '%s'", i.Name)
+	}
+
+	if i.PieceLength <= 0 {
+		v.addf("invalid piece length %d", i.PieceLength)
+	}
+
+	var v1Length, v2Length int64
+
+	if i.IsV1() || !i.IsV2() {
+		v1Length = v.v1(i)
+	}
+
+	if i.IsV2() {
+		v2Length = v.v2(m, layers)
+	}
+
+	// NOTE: the v1 part of hybrid torrents has padding files, which might add
+	// 		 to the length but never take away from it
+	if i.IsHybrid() && v1Length < v2Length {
+		v.addf("v1 length %d is less than the v2 length %d", v1Length, v2Length)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package torrent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"trumtorrent/bencode"
+	"trumtorrent/picker"
+)
+
+// pieces returns the (zeroed) hashes of `count` pieces
+func pieces(count int) string {
+	return strings.Repeat("\x00", count*20)
+}
+
+// newFilesTorrent creates a multiple file torrent "t" of `files`, with as many
+// (zeroed) piece hashes as the lengths of the files add up to
+func newFilesTorrent(pieceLength int, files []InfoFile) *Torrent {
+	var length int64
+	for _, file := range files {
+		length += file.Length
+	}
+
+	tr := &Torrent{
+		MetaInfo: MetaInfo{Info: Info{
+			Name:        "t",
+			PieceLength: pieceLength,
+			Pieces:      pieces(int((length + int64(pieceLength) - 1) / int64(pieceLength))),
+			Files:       files,
+		}},
+		Picker: picker.New(),
+	}
+
+	tr.schedulePieces()
+	return tr
+}
+
+// filesOf returns files with the given paths (slash separated) and lengths
+func filesOf(paths []string, lengths []int64) []InfoFile {
+	files := make([]InfoFile, len(paths))
+	for i := range paths {
+		files[i] = InfoFile{Path: strings.Split(paths[i], "/"), Length: lengths[i]}
+	}
+
+	return files
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		info Info
+		// problem is a part of the expected problem, the info is expected to
+		// be valid if it's empty
+		problem string
+	}{
+		{
+			name: "single file",
+			info: Info{Name: "a", Length: 40, PieceLength: 16, Pieces: pieces(3)},
+		},
+		{
+			name: "multiple files",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(2), Files: []InfoFile{
+				{Length: 20, Path: []string{"b", "c"}},
+				{Length: 0, Path: []string{"empty"}},
+				{Length: 12, Path: []string{"d"}},
+			}},
+		},
+		{
+			name:    "pieces not a multiple of 20",
+			info:    Info{Name: "a", Length: 16, PieceLength: 16, Pieces: pieces(1) + "x"},
+			problem: "not a multiple of 20",
+		},
+		{
+			name:    "too many pieces",
+			info:    Info{Name: "a", Length: 16, PieceLength: 16, Pieces: pieces(3)},
+			problem: "expected 1 pieces for a length of 16, got 3",
+		},
+		{
+			name:    "too few pieces",
+			info:    Info{Name: "a", Length: 40, PieceLength: 16, Pieces: pieces(2)},
+			problem: "expected 3 pieces",
+		},
+		{
+			name: "too many pieces for multiple files",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(4), Files: []InfoFile{
+				{Length: 10, Path: []string{"b"}},
+				{Length: 10, Path: []string{"c"}},
+			}},
+			problem: "expected 2 pieces",
+		},
+		{
+			name:    "zero length",
+			info:    Info{Name: "a", PieceLength: 16, Pieces: pieces(1)},
+			problem: "missing 'length' or 'files'",
+		},
+		{
+			name:    "negative length",
+			info:    Info{Name: "a", Length: -16, PieceLength: 16, Pieces: pieces(1)},
+			problem: "invalid length -16",
+		},
+		{
+			name: "negative file length",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 32, Path: []string{"b"}},
+				{Length: -16, Path: []string{"c"}},
+			}},
+			problem: "invalid length -16 of 'c'",
+		},
+		{
+			name: "only empty files",
+			info: Info{Name: "a", PieceLength: 16, Files: []InfoFile{
+				{Length: 0, Path: []string{"b"}},
+			}},
+			problem: "all files are empty",
+		},
+		{
+			name:    "zero piece length",
+			info:    Info{Name: "a", Length: 16, PieceLength: 0, Pieces: pieces(1)},
+			problem: "invalid piece length 0",
+		},
+		{
+			name:    "negative piece length",
+			info:    Info{Name: "a", Length: 16, PieceLength: -1, Pieces: pieces(1)},
+			problem: "invalid piece length -1",
+		},
+		{
+			name: "length and files",
+			info: Info{Name: "a", Length: 16, PieceLength: 16, Pieces: pieces(2), Files: []InfoFile{
+				{Length: 16, Path: []string{"b"}},
+			}},
+			problem: "both 'length' and 'files' are present",
+		},
+		{
+			name:    "parent name",
+			info:    Info{Name: "..", Length: 16, PieceLength: 16, Pieces: pieces(1)},
+			problem: "unsafe name '..'",
+		},
+		{
+			name:    "empty name",
+			info:    Info{Name: "", Length: 16, PieceLength: 16, Pieces: pieces(1)},
+			problem: "unsafe name",
+		},
+		{
+			name:    "name with a separator",
+			info:    Info{Name: "a/../../b", Length: 16, PieceLength: 16, Pieces: pieces(1)},
+			problem: "unsafe name",
+		},
+		{
+			name: "parent path",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"b", "..", "..", "c"}},
+			}},
+			problem: "unsafe path 'b/../../c'",
+		},
+		{
+			name: "absolute path",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"/etc", "passwd"}},
+			}},
+			problem: "unsafe path '/etc/passwd'",
+		},
+		{
+			name: "windows drive",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"C:", "b"}},
+			}},
+			problem: "unsafe path",
+		},
+		{
+			name: "backslash",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"..\\b"}},
+			}},
+			problem: "unsafe path",
+		},
+		{
+			name: "empty path component",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"b", "", "c"}},
+			}},
+			problem: "unsafe path 'b//c'",
+		},
+		{
+			name: "empty path",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{}},
+			}},
+			problem: "file has an empty path",
+		},
+		{
+			name: "symlink outside of the torrent",
+			info: Info{Name: "a", PieceLength: 16, Pieces: pieces(1), Files: []InfoFile{
+				{Length: 16, Path: []string{"b"}},
+				{Path: []string{"c"}, Attr: "l", SymlinkPath: []string{"..", "etc"}},
+			}},
+			problem: "unsafe path '../etc'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(&MetaInfo{Info: test.info})
+
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("expected the info to be valid, got %v", err)
+				}
+
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+
+			for _, problem := range verr.Problems {
+				if strings.Contains(problem, test.problem) {
+					return
+				}
+			}
+
+			t.Fatalf("expected a problem containing %q, got %q", test.problem, verr.Problems)
+		})
+	}
+}
+
+// TestValidateZeroLengthAndFiles makes sure that a `length` key next to `files`
+// is found, even if it's zero
+func TestValidateZeroLengthAndFiles(t *testing.T) {
+	data := "d4:infod5:filesld6:lengthi16e4:pathl1:beee6:lengthi0e4:name1:a12:piece lengthi16e6:pieces20:" +
+		pieces(1) + "ee"
+
+	metainfo := &MetaInfo{}
+	if err := bencode.Unmarshal([]byte(data), metainfo); err != nil {
+		t.Fatal(err)
+	}
+
+	var verr *ValidationError
+	if err := Validate(metainfo); !errors.As(err, &verr) || !strings.Contains(verr.Error(), "both 'length' and 'files'") {
+		t.Fatalf("expected 'length' and 'files' to be found, got %v", err)
+	}
+
+	// Without the `length` key it's valid
+	data = strings.Replace(data, "6:lengthi0e", "", 1)
+
+	metainfo = &MetaInfo{}
+	if err := bencode.Unmarshal([]byte(data), metainfo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(metainfo); err != nil {
+		t.Fatalf("expected the info to be valid, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"trumtorrent/peer"
+	"trumtorrent/torrent"
+)
+
+// Tiers holds the trackers of a torrent grouped in tiers, which are used as
+// described by BEP 12
+type Tiers struct {
+	tiers [][]Tracker
+}
+
+// Announce tries the trackers in order, tier by tier, until one of them works
+// (the next tier is only used if all trackers of the current tier fails). The
+// tracker which works is moved to the front of its tier.
+func (t *Tiers) Announce() ([]*peer.Peer, error) {
+	var lastErr error
+
+	for _, tier := range t.tiers {
+		for i, tr := range tier {
+			if err := tr.Announce(); err != nil {
+				lastErr = fmt.Errorf("%w (%v)", err, tr)
+				continue
+			}
+
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tr
+			return tr.Peers(), nil
+		}
+	}
+
+	if lastErr == nil {
+		return nil, errors.New("tracker: no trackers")
+	}
+
+	return nil, fmt.Errorf("tracker: all trackers failed, last error: %w", lastErr)
+}
+
+// Len returns the total number of trackers
+func (t *Tiers) Len() int {
+	var n int
+	for _, tier := range t.tiers {
+		n += len(tier)
+	}
+
+	return n
+}
+
+// NewTiers creates the trackers of each tier of the torrent, the trackers
+// within each tier are shuffled. Trackers with unsupported schemes are skipped.
+func NewTiers(t *torrent.Torrent) *Tiers {
+	tiers := &Tiers{}
+
+	for _, addrs := range t.Tiers() {
+		var tier []Tracker
+
+		for _, addr := range addrs {
+			tr, err := New(addr, t)
+			if err != nil {
+				continue
+			}
+
+			tier = append(tier, tr)
+		}
+
+		if len(tier) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+
+		tiers.tiers = append(tiers.tiers, tier)
+	}
+
+	return tiers
+}
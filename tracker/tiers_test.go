@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"trumtorrent/peer"
+	"trumtorrent/torrent"
+)
+
+// fakeTracker is a tracker which either fails or returns a single peer, every
+// announce is appended to `announces`
+type fakeTracker struct {
+	name      string
+	fails     bool
+	announces *[]string
+}
+
+func (t *fakeTracker) Scheme() string {
+	return "fake"
+}
+
+func (t *fakeTracker) Announce() error {
+	*t.announces = append(*t.announces, t.name)
+
+	if t.fails {
+		return errors.New("tracker: failed")
+	}
+
+	return nil
+}
+
+func (t *fakeTracker) Peers() []*peer.Peer {
+	return []*peer.Peer{peer.New(net.IPv4(10, 0, 0, 1), 6881, peer.SourceTracker)}
+}
+
+func (t *fakeTracker) String() string {
+	return t.name
+}
+
+// newFakeTiers creates tiers of fake trackers, names which start with "!" are
+// trackers which fail
+func newFakeTiers(tiers [][]string) (*Tiers, *[]string) {
+	var (
+		announces []string
+		t         = &Tiers{}
+	)
+
+	for _, names := range tiers {
+		var tier []Tracker
+
+		for _, name := range names {
+			tier = append(tier, &fakeTracker{name: name, fails: name[0] == '!', announces: &announces})
+		}
+
+		t.tiers = append(t.tiers, tier)
+	}
+
+	return t, &announces
+}
+
+// names returns the names of the trackers of each tier
+func names(t *Tiers) [][]string {
+	var tiers [][]string
+
+	for _, tier := range t.tiers {
+		var names []string
+		for _, tr := range tier {
+			names = append(names, tr.String())
+		}
+
+		tiers = append(tiers, names)
+	}
+
+	return tiers
+}
+
+func TestNewTiers(t *testing.T) {
+	tr := &torrent.Torrent{MetaInfo: torrent.MetaInfo{
+		Announce: "udp://a:80",
+		AnnounceList: [][]string{
+			{"udp://a:80", "udp://b:80", "udp://c:80", "udp://d:80", "udp://e:80", "udp://f:80"},
+			{"wss://unsupported"},
+			{"udp://g:80", "wss://unsupported"},
+		},
+	}}
+
+	var shuffled bool
+
+	for i := 0; i < 20; i++ {
+		tiers := NewTiers(tr)
+
+		if tiers.Len() != 7 {
+			t.Fatalf("expected 7 trackers, got %d", tiers.Len())
+		}
+
+		got := names(tiers)
+		if len(got) != 2 || !reflect.DeepEqual(got[1], []string{"udp://g:80"}) {
+			t.Fatalf("expected the tiers to keep their order without unsupported trackers, got %v", got)
+		}
+
+		seen := make(map[string]bool)
+		for _, name := range got[0] {
+			seen[name] = true
+		}
+
+		for _, name := range tr.MetaInfo.AnnounceList[0] {
+			if !seen[name] {
+				t.Fatalf("expected '%s' to be in the first tier, got %v", name, got[0])
+			}
+		}
+
+		if !reflect.DeepEqual(got[0], tr.MetaInfo.AnnounceList[0]) {
+			shuffled = true
+		}
+	}
+
+	// NOTE: the chance of 20 shuffles of 6 trackers all keeping their order
+	// 		 is negligible
+	if !shuffled {
+		t.Fatal("expected the trackers within a tier to be shuffled")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	tests := []struct {
+		name      string
+		tiers     [][]string
+		announces []string
+		after     [][]string
+		err       bool
+	}{
+		{
+			name:      "first tracker works",
+			tiers:     [][]string{{"a", "b"}, {"c"}},
+			announces: []string{"a"},
+			after:     [][]string{{"a", "b"}, {"c"}},
+		},
+		{
+			name:      "working tracker is moved to the front",
+			tiers:     [][]string{{"!a", "!b", "c", "d"}, {"e"}},
+			announces: []string{"!a", "!b", "c"},
+			after:     [][]string{{"c", "!a", "!b", "d"}, {"e"}},
+		},
+		{
+			name:      "next tier once every tracker failed",
+			tiers:     [][]string{{"!a", "!b"}, {"!c", "d"}, {"e"}},
+			announces: []string{"!a", "!b", "!c", "d"},
+			after:     [][]string{{"!a", "!b"}, {"d", "!c"}, {"e"}},
+		},
+		{
+			name:      "every tracker fails",
+			tiers:     [][]string{{"!a"}, {"!b", "!c"}},
+			announces: []string{"!a", "!b", "!c"},
+			after:     [][]string{{"!a"}, {"!b", "!c"}},
+			err:       true,
+		},
+		{
+			name: "no trackers",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tiers, announces := newFakeTiers(test.tiers)
+
+			peers, err := tiers.Announce()
+			if test.err {
+				if err == nil {
+					t.Fatal("expected the announce to fail")
+				}
+			} else if err != nil || len(peers) != 1 {
+				t.Fatalf("expected a peer, got %v (%v)", peers, err)
+			}
+
+			if !reflect.DeepEqual(*announces, test.announces) {
+				t.Fatalf("expected the announces %v, got %v", test.announces, *announces)
+			}
+
+			if got := names(tiers); !reflect.DeepEqual(got, test.after) {
+				t.Fatalf("expected the tiers %v, got %v", test.after, got)
+			}
+		})
+	}
+
+	// The tracker which worked is used first next time
+	tiers, announces := newFakeTiers([][]string{{"!a", "b", "c"}})
+	tiers.Announce()
+	*announces = nil
+
+	if _, err := tiers.Announce(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*announces, []string{"b"}) {
+		t.Fatalf("expected only the working tracker to be announced to, got %v", *announces)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"math/rand"
 	"net"
@@ -40,9 +39,9 @@ type HTTPTracker struct {
 }
 
 type httpResponse struct {
-	Interval      int    `bencode:"interval"`
-	Peers         string `bencode:"peers"`
-	FailureReason string `bencode:"failure reason"`
+	Interval      int               `bencode:"interval"`
+	Peers         peer.CompactAddrs `bencode:"peers"`
+	FailureReason string            `bencode:"failure reason"`
 	// Unused/optional fields
 	TrackerId      string `bencode:"tracker id"`
 	Seeders        int    `bencode:"complete"`
@@ -58,7 +57,7 @@ func (t *HTTPTracker) buildHttpQuery() string {
 	query.Add("port", strconv.Itoa(t.port))
 	query.Add("uploaded", "0")
 	query.Add("downloaded", "0")
-	query.Add("left", strconv.Itoa(t.torrent.Length()))
+	query.Add("left", strconv.FormatInt(t.torrent.Length(), 10))
 	query.Add("compact", "1")
 	query.Add("numwant", "50")
 	return query.Encode()
@@ -100,19 +99,12 @@ func (t *HTTPTracker) Announce() (err error) {
 		return err
 	}
 
-	data, err := io.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return err
-	}
-
-	// result, _, err := bencode.Decode(data)
-	// if err != nil {
-	// 	return err
-	// }
+	defer res.Body.Close()
 
+	// NOTE: we decode straight from the response body, with limits, since we
+	// 		 can't trust the size of the response
 	hres := &httpResponse{}
-	if err = bencode.Unmarshal(data, hres); err != nil {
+	if err = bencode.NewDecoder(res.Body, bencode.NetworkLimits()).Decode(hres); err != nil {
 		return err
 	}
 
@@ -120,13 +112,7 @@ func (t *HTTPTracker) Announce() (err error) {
 		return fmt.Errorf("httptracker: announce failed '%s'", hres.FailureReason)
 	}
 
-	// TODO: Add support for non-compact peers
-	peers, err := parseCompactPeers([]byte(hres.Peers))
-	if err != nil {
-		return err
-	}
-
-	t.peers = peers
+	t.peers = hres.Peers.Peers(peer.SourceTracker)
 	t.response = time.Now()
 	t.interval = hres.Interval
 	return nil
@@ -438,18 +424,10 @@ func New(addr string, t *torrent.Torrent) (Tracker, error) {
 }
 
 func parseCompactPeers(data []byte) ([]*peer.Peer, error) {
-	if len(data)%6 != 0 {
-		return nil, errors.New("tracker: invalid peer binary length")
-	}
-
-	peers := make([]*peer.Peer, len(data)/6)
-
-	for i := 0; i < len(data)/6; i++ {
-		offset := i * 6
-		ip := data[offset : offset+4]
-		port := binary.BigEndian.Uint16(data[offset+4 : offset+6])
-		peers[i] = peer.New(ip, port)
+	addrs, err := peer.ParseCompactAddrs(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return peers, nil
+	return addrs.Peers(peer.SourceTracker), nil
 }